@@ -0,0 +1,304 @@
+/* ****************************************************************************
+ * Copyright 2020 51 Degrees Mobile Experts Limited (51degrees.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations
+ * under the License.
+ * ***************************************************************************/
+
+package cmp
+
+import (
+	"common"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Status values for a complaint case.
+const (
+	caseOpen      = "Open"      // Stored but not delivered to the organization
+	caseDelivered = "Delivered" // Emailed to the organization by the CMP
+	caseResponded = "Responded" // The organization has responded
+	caseClosed    = "Closed"    // The user or organization closed the case
+)
+
+// caseStatuses in the order they are offered to organizations.
+var caseStatuses = []string{caseOpen, caseDelivered, caseResponded, caseClosed}
+
+// errCaseClosed is returned when a follow up is added to a closed case.
+var errCaseClosed = errors.New("Complaint case is closed")
+
+// CaseMessage is a follow up added to a complaint case by the user or the
+// organization.
+type CaseMessage struct {
+	Date time.Time `json:"date"`
+	From string    `json:"from"`
+	Text string    `json:"text"`
+}
+
+// ComplaintCase is a complaint submitted by the CMP on behalf of a user.
+type ComplaintCase struct {
+	ID            string          `json:"id"`                 // Case ID used as the reference in emails
+	Token         string          `json:"token"`              // Secret in the user's status page URL
+	EvidenceToken string          `json:"evidenceToken"`      // Secret in the organization's evidence URL
+	Created       time.Time       `json:"created"`            // When the case was submitted
+	Updated       time.Time       `json:"updated"`            // When the case last changed
+	Status        string          `json:"status"`             // One of the case status values
+	CMP           string          `json:"cmp"`                // Host of the CMP that submitted the case
+	Domain        string          `json:"domain"`             // OWID creator domain complained about
+	Organization  string          `json:"organization"`       // Legal name of the organization
+	Email         string          `json:"email"`              // Privacy contact the complaint was sent to
+	Regulator     string          `json:"regulator"`          // Regulator the user can escalate to
+	RegulatorURL  string          `json:"regulatorUrl"`       // URL to complain to the regulator
+	Subject       string          `json:"subject"`            // Subject of the complaint email
+	Body          string          `json:"body"`               // Body of the complaint email
+	SWANID        string          `json:"swanId"`             // The SWAN ID OWID as base 64
+	PartyID       string          `json:"partyId"`            // The accused party's OWID as base 64
+	DeliveryError string          `json:"deliveryError"`      // Reason the email could not be sent
+	Messages      []*CaseMessage  `json:"messages"`           // Follow ups in date order
+	Evidence      *EvidenceBundle `json:"evidence,omitempty"` // Signed evidence for the complaint
+}
+
+// Closed returns true if the case has been closed.
+func (c *ComplaintCase) Closed() bool { return c.Status == caseClosed }
+
+// caseStore holds the complaint cases in memory and, if a file is configured,
+// writes them to disk after every change so they survive a restart.
+type caseStore struct {
+	mutex sync.Mutex
+	file  string
+	cases map[string]*ComplaintCase
+}
+
+var cases *caseStore    // The single store used by all CMPs
+var casesOnce sync.Once // Used to create the store from the configuration
+
+// getCaseStore returns the store creating it from the configuration the first
+// time it is needed.
+func getCaseStore(c *common.Configuration) *caseStore {
+	casesOnce.Do(func() {
+		cases = &caseStore{
+			file:  c.ComplaintsFile,
+			cases: make(map[string]*ComplaintCase)}
+		err := cases.load()
+		if err != nil {
+			common.Log.Error("complaints not loaded", "error", err)
+		}
+	})
+	return cases
+}
+
+// newCaseToken returns a random value that can't be guessed from the case ID.
+// Tokens are used in URLs so that only the holder of the URL can use it.
+func newCaseToken() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// setTokens sets the case's tokens if they are missing.
+func (c *ComplaintCase) setTokens() error {
+	var err error
+	if c.Token == "" {
+		c.Token, err = newCaseToken()
+		if err != nil {
+			return err
+		}
+	}
+	if c.EvidenceToken == "" {
+		c.EvidenceToken, err = newCaseToken()
+	}
+	return err
+}
+
+// add assigns a new case ID and tokens to the case and stores it.
+func (s *caseStore) add(c *ComplaintCase) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	err := c.setTokens()
+	if err != nil {
+		return err
+	}
+	c.ID = uuid.New().String()
+	c.Created = time.Now().UTC()
+	c.Updated = c.Created
+	s.cases[c.ID] = c
+	return s.save()
+}
+
+// get returns a copy of the case with the ID, or nil if there is no such case.
+func (s *caseStore) get(id string) *ComplaintCase {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	c := s.cases[id]
+	if c == nil {
+		return nil
+	}
+	return c.copy()
+}
+
+// find returns a copy of the first case that f returns true for, or nil if
+// there is no such case.
+func (s *caseStore) find(f func(c *ComplaintCase) bool) *ComplaintCase {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, c := range s.cases {
+		if f(c) {
+			return c.copy()
+		}
+	}
+	return nil
+}
+
+// getByToken returns a copy of the case for the user's token, or nil if there
+// is no such case.
+func (s *caseStore) getByToken(t string) *ComplaintCase {
+	return s.find(func(c *ComplaintCase) bool {
+		return t != "" && c.Token == t
+	})
+}
+
+// getByEvidenceToken returns a copy of the case for the organization's
+// evidence token, or nil if there is no such case.
+func (s *caseStore) getByEvidenceToken(t string) *ComplaintCase {
+	return s.find(func(c *ComplaintCase) bool {
+		return t != "" && c.EvidenceToken == t
+	})
+}
+
+// list returns copies of the cases submitted by the CMP host, optionally only
+// those for the OWID creator domain, with the most recent first.
+func (s *caseStore) list(cmp string, domain string) []*ComplaintCase {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var l []*ComplaintCase
+	for _, c := range s.cases {
+		if c.CMP == cmp && (domain == "" || c.Domain == domain) {
+			l = append(l, c.copy())
+		}
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].Created.After(l[j].Created) })
+	return l
+}
+
+// update calls f with the case for the ID and then saves the store. An error
+// is returned if the case does not exist or f returns one, in which case the
+// store is not saved.
+func (s *caseStore) update(id string, f func(c *ComplaintCase) error) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	c := s.cases[id]
+	if c == nil {
+		return fmt.Errorf("Complaint case '%s' not found", id)
+	}
+	err := f(c)
+	if err != nil {
+		return err
+	}
+	c.Updated = time.Now().UTC()
+	return s.save()
+}
+
+// addMessage appends a follow up to the case and sets the new status if one
+// is provided. errCaseClosed is returned if the case is closed unless the
+// status provided opens it again.
+func (s *caseStore) addMessage(id, from, text, status string) error {
+	return s.update(id, func(c *ComplaintCase) error {
+		if c.Closed() && (status == "" || status == caseClosed) {
+			return errCaseClosed
+		}
+		if text != "" {
+			c.Messages = append(c.Messages, &CaseMessage{
+				Date: time.Now().UTC(),
+				From: from,
+				Text: text})
+		}
+		if status != "" {
+			c.Status = status
+		}
+		return nil
+	})
+}
+
+func (c *ComplaintCase) copy() *ComplaintCase {
+	n := *c
+	n.Messages = append([]*CaseMessage(nil), c.Messages...)
+	return &n
+}
+
+// load reads the cases from the file if one is configured and present.
+func (s *caseStore) load() error {
+	if s.file == "" {
+		return nil
+	}
+	b, err := ioutil.ReadFile(s.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var l []*ComplaintCase
+	err = json.Unmarshal(b, &l)
+	if err != nil {
+		return fmt.Errorf("complaints file '%s': %s", s.file, err)
+	}
+	changed := false
+	for _, c := range l {
+		if c.Token == "" || c.EvidenceToken == "" {
+			err = c.setTokens()
+			if err != nil {
+				return err
+			}
+			changed = true
+		}
+		s.cases[c.ID] = c
+	}
+	if changed {
+		return s.save()
+	}
+	return nil
+}
+
+// save writes all the cases to the file if one is configured. The caller must
+// hold the lock.
+func (s *caseStore) save() error {
+	if s.file == "" {
+		return nil
+	}
+	l := make([]*ComplaintCase, 0, len(s.cases))
+	for _, c := range s.cases {
+		l = append(l, c)
+	}
+	b, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+	t := s.file + ".tmp"
+	err = ioutil.WriteFile(t, b, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(t, s.file)
+}
@@ -0,0 +1,273 @@
+/* ****************************************************************************
+ * Copyright 2020 51 Degrees Mobile Experts Limited (51degrees.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations
+ * under the License.
+ * ***************************************************************************/
+
+package cmp
+
+import (
+	"common"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits on the reminder and confirmation emails that can be requested.
+var (
+	reminderEmailLimit = common.NewRateLimiter(3, time.Hour)  // Per address
+	reminderIPLimit    = common.NewRateLimiter(10, time.Hour) // Per client IP
+)
+
+// emailConfirmTimeout is how long the link in the confirmation email works.
+const emailConfirmTimeout = 24 * time.Hour
+
+// Actions for the links in emails sent by the CMP.
+const (
+	emailConfirm     = "confirm"
+	emailUnsubscribe = "unsubscribe"
+)
+
+// Reasons a reminder email is not sent.
+var (
+	errEmailSuppressed  = errors.New("Reminders to this email have been turned off")
+	errEmailLimit       = errors.New("Too many emails have been requested")
+	errEmailUnconfirmed = errors.New("Email needs to be confirmed")
+)
+
+// emailList records the addresses that have confirmed they want reminder
+// emails and the addresses that have unsubscribed. Only a hash of each
+// address is kept.
+type emailList struct {
+	mutex      sync.Mutex
+	file       string
+	Confirmed  map[string]time.Time `json:"confirmed"`  // When each address was confirmed
+	Suppressed map[string]time.Time `json:"suppressed"` // When each address unsubscribed
+}
+
+var emails *emailList    // The single list used by all CMPs
+var emailsOnce sync.Once // Used to create the list from the configuration
+
+// getEmailList returns the list creating it from the configuration the first
+// time it is needed.
+func getEmailList(c *common.Configuration) *emailList {
+	emailsOnce.Do(func() {
+		emails = &emailList{
+			file:       c.EmailListFile,
+			Confirmed:  make(map[string]time.Time),
+			Suppressed: make(map[string]time.Time)}
+		err := emails.load()
+		if err != nil {
+			common.Log.Error("email list not loaded", "error", err)
+		}
+	})
+	return emails
+}
+
+// isConfirmed returns true if the address has confirmed it wants reminders.
+func (l *emailList) isConfirmed(e string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	_, ok := l.Confirmed[emailKey(e)]
+	return ok
+}
+
+// isSuppressed returns true if the address has unsubscribed.
+func (l *emailList) isSuppressed(e string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	_, ok := l.Suppressed[emailKey(e)]
+	return ok
+}
+
+// confirm records that the address wants reminders. This also removes any
+// suppression as the user has asked for reminders again.
+func (l *emailList) confirm(e string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	k := emailKey(e)
+	l.Confirmed[k] = time.Now().UTC()
+	delete(l.Suppressed, k)
+	return l.save()
+}
+
+// suppress records that the address does not want any more emails.
+func (l *emailList) suppress(e string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	k := emailKey(e)
+	l.Suppressed[k] = time.Now().UTC()
+	delete(l.Confirmed, k)
+	return l.save()
+}
+
+// load reads the list from the file if one is configured and exists.
+func (l *emailList) load() error {
+	if l.file == "" {
+		return nil
+	}
+	b, err := ioutil.ReadFile(l.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(b, l)
+	if err != nil {
+		return fmt.Errorf("email list file '%s': %s", l.file, err)
+	}
+	if l.Confirmed == nil {
+		l.Confirmed = make(map[string]time.Time)
+	}
+	if l.Suppressed == nil {
+		l.Suppressed = make(map[string]time.Time)
+	}
+	return nil
+}
+
+// save writes the list to the file if one is configured. The file is written
+// to a temporary file first and then renamed so that a failure part way
+// through does not lose the list.
+func (l *emailList) save() error {
+	if l.file == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+	t := l.file + ".tmp"
+	err = ioutil.WriteFile(t, b, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(t, l.file)
+}
+
+// emailKey returns the hash of the address used as the key in the list.
+func emailKey(e string) string {
+	h := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(e))))
+	return hex.EncodeToString(h[:])
+}
+
+// checkEmail returns an error if the address has unsubscribed or too many
+// emails have been requested for the address or by the client.
+func checkEmail(d *common.Domain, r *http.Request, e string) error {
+	if getEmailList(d.Config).isSuppressed(e) {
+		return errEmailSuppressed
+	}
+	if common.AllowAll(
+		common.RateKey{
+			Limiter: reminderIPLimit,
+			Key:     common.ClientIP(d.Config, r)},
+		common.RateKey{
+			Limiter: reminderEmailLimit,
+			Key:     emailKey(e)}) == false {
+		return errEmailLimit
+	}
+	return nil
+}
+
+// checkReminder returns an error if a reminder email should not be sent to the
+// address for the request. If the address has not been confirmed then a
+// confirmation email is sent instead and errEmailUnconfirmed returned.
+func checkReminder(
+	d *common.Domain,
+	r *http.Request,
+	e string,
+	m *common.Messages) error {
+	err := checkEmail(d, r, e)
+	if err != nil {
+		return err
+	}
+	if getEmailList(d.Config).isConfirmed(e) == false {
+		err = sendConfirmEmail(d, r, e, m)
+		if err != nil {
+			return err
+		}
+		return errEmailUnconfirmed
+	}
+	return nil
+}
+
+// emailToken is the payload of the OWID the CMP signs for the links in the
+// emails it sends.
+type emailToken struct {
+	Action  string    `json:"action"`            // emailConfirm or emailUnsubscribe
+	Email   string    `json:"email"`             // The address the link is for
+	Expires time.Time `json:"expires,omitempty"` // Zero if the link does not expire
+}
+
+// emailURL returns the URL of the link for the action and address signed by
+// the CMP. Links to unsubscribe do not expire.
+func emailURL(
+	d *common.Domain,
+	r *http.Request,
+	action string,
+	e string) (string, error) {
+	t := emailToken{Action: action, Email: e}
+	if action == emailConfirm {
+		t.Expires = time.Now().UTC().Add(emailConfirmTimeout)
+	}
+	b, err := json.Marshal(&t)
+	if err != nil {
+		return "", err
+	}
+	c, err := d.GetOWIDCreator()
+	if err != nil {
+		return "", err
+	}
+	o, err := c.CreateOWIDandSign(b)
+	if err != nil {
+		return "", err
+	}
+	u := url.URL{
+		Scheme: d.Config.Scheme,
+		Host:   common.RequestHost(d, r),
+		Path:   "/email/" + action}
+	q := u.Query()
+	q.Set("token", o.AsString())
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// readEmailToken returns the token for the action if it was signed by this
+// CMP and has not expired.
+func readEmailToken(
+	d *common.Domain,
+	action string,
+	s string) (*emailToken, error) {
+	o, err := verifyCMPOWID(d, s)
+	if err != nil {
+		return nil, err
+	}
+	var t emailToken
+	err = json.Unmarshal(o.Payload, &t)
+	if err != nil || t.Action != action {
+		return nil, errLinkInvalid
+	}
+	if t.Expires.IsZero() == false && time.Now().After(t.Expires) {
+		return nil, errLinkExpired
+	}
+	return &t, nil
+}
@@ -0,0 +1,327 @@
+/* ****************************************************************************
+ * Copyright 2020 51 Degrees Mobile Experts Limited (51degrees.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations
+ * under the License.
+ * ***************************************************************************/
+
+package cmp
+
+import (
+	"bytes"
+	"common"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"owid"
+	"strings"
+	"swan"
+	"time"
+)
+
+// evidenceVersion is incremented if the structure of the evidence changes.
+const evidenceVersion = 1
+
+// EvidenceBundle is the evidence for a complaint together with a detached
+// signature from the CMP's OWID creator. The signature is an OWID whose payload
+// is the SHA-256 hash of the compact evidence JSON.
+type EvidenceBundle struct {
+	Evidence  json.RawMessage `json:"evidence"`  // The Evidence as JSON
+	Signature string          `json:"signature"` // Base 64 OWID signed by the CMP
+	PublicKey string          `json:"publicKey"` // Public key of the CMP creator
+}
+
+// Evidence is the information the complaint relies on.
+type Evidence struct {
+	Version      int             `json:"version"`      // Version of the structure
+	Created      time.Time       `json:"created"`      // When the CMP created the evidence
+	CMP          string          `json:"cmp"`          // Domain of the CMP that signed the evidence
+	Accused      string          `json:"accused"`      // Domain of the party complained about
+	Organization string          `json:"organization"` // Legal name of the accused party
+	SWANID       string          `json:"swanId"`       // The SWAN ID OWID as base 64
+	SWID         string          `json:"swid"`         // The user's SWID at the time
+	Preferences  string          `json:"preferences"`  // The user's preferences at the time
+	Path         []*EvidenceOWID `json:"path"`         // OWIDs from the root to the accused party
+}
+
+// EvidenceOWID is an OWID in the path with the creator's public key so that
+// the signature can be checked offline.
+type EvidenceOWID struct {
+	OWID      string    `json:"owid"`            // The OWID as base 64
+	Domain    string    `json:"domain"`          // Domain of the creator
+	Date      time.Time `json:"date"`            // Date the OWID was created
+	Role      string    `json:"role,omitempty"`  // Role of the SWAN data in the OWID
+	PublicKey string    `json:"publicKey"`       // Public key of the creator
+	Verified  bool      `json:"verified"`        // True if verified by the CMP
+	Error     string    `json:"error,omitempty"` // Reason verification failed
+}
+
+// EvidenceReport is the result of verifying an evidence bundle.
+type EvidenceReport struct {
+	Valid           bool            `json:"valid"`                     // True if all checks passed
+	Integrity       bool            `json:"integrity"`                 // Evidence matches the signature
+	Signature       bool            `json:"signature"`                 // Signature verified with the CMP key
+	Authenticated   bool            `json:"authenticated"`             // All keys came from a trusted source
+	Unauthenticated []string        `json:"unauthenticated,omitempty"` // Domains only the bundle has keys for
+	Evidence        *Evidence       `json:"evidence"`                  // The evidence verified
+	Path            []*EvidenceOWID `json:"path"`                      // Results for each OWID
+	Errors          []string        `json:"errors,omitempty"`          // Reasons for any failure
+}
+
+// TrustedKeys returns the public key for the creator domain obtained from a
+// trusted source, or an empty string if the key is not known.
+type TrustedKeys func(domain string) string
+
+func (r *EvidenceReport) fail(format string, a ...interface{}) {
+	r.Errors = append(r.Errors, fmt.Sprintf(format, a...))
+}
+
+// newEvidenceBundle creates the evidence for the complaint and signs it with
+// the CMP's OWID creator.
+func newEvidenceBundle(
+	d *common.Domain,
+	c *Complaint) (*EvidenceBundle, error) {
+	var e Evidence
+	e.Version = evidenceVersion
+	e.Created = time.Now().UTC()
+	e.CMP = d.Host
+	e.Accused = c.idOWID.Domain
+	e.Organization = c.Organization
+	e.SWANID = c.swanOWID.AsString()
+	e.SWID = c.ID.SWIDAsString()
+	e.Preferences = c.Preferences()
+
+	// Add the OWIDs from the root to the accused party.
+	for _, o := range evidencePath(c.swanOWID, c.idOWID, c.path) {
+		v, err := newEvidenceOWID(d.Config, o)
+		if err != nil {
+			return nil, err
+		}
+		e.Path = append(e.Path, v)
+	}
+
+	// Sign the hash of the evidence.
+	b, err := json.Marshal(&e)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.Sum256(b)
+	r, err := d.GetOWIDCreator()
+	if err != nil {
+		return nil, err
+	}
+	s, err := r.CreateOWIDandSign(h[:])
+	if err != nil {
+		return nil, err
+	}
+	return &EvidenceBundle{
+		Evidence:  b,
+		Signature: s.AsString(),
+		PublicKey: r.PublicKey()}, nil
+}
+
+// evidencePath returns the OWIDs starting with the root SWAN ID and ending with
+// the accused party. path is in the order provided to the info page which is
+// from the winning bid to the root.
+func evidencePath(
+	swanOWID *owid.OWID,
+	partyOWID *owid.OWID,
+	path []*owid.OWID) []*owid.OWID {
+	p := []*owid.OWID{swanOWID}
+	for i := len(path) - 1; i >= 0; i-- {
+		s := path[i].AsString()
+		if s == swanOWID.AsString() {
+			continue
+		}
+		p = append(p, path[i])
+		if s == partyOWID.AsString() {
+			return p
+		}
+	}
+	if partyOWID.AsString() != swanOWID.AsString() {
+		p = append(p, partyOWID)
+	}
+	return p
+}
+
+func newEvidenceOWID(
+	c *common.Configuration,
+	o *owid.OWID) (*EvidenceOWID, error) {
+	var v EvidenceOWID
+	v.OWID = o.AsString()
+	v.Domain = o.Domain
+	v.Date = o.Date
+	s, err := swan.FromOWID(o)
+	if err == nil {
+		v.Role = common.Role(s)
+	}
+	r, err := c.GetCreator(o.Domain)
+	if err != nil {
+		return nil, err
+	}
+	if r != nil {
+		v.PublicKey = r.PublicKey()
+	}
+	v.Verified = c.VerifyOWID(o)
+	if v.Verified == false {
+		v.Error = "not signed by a demo domain"
+	}
+	return &v, nil
+}
+
+// trustedKey returns the public key for the domain from the trusted keys, or
+// the key in the bundle if there is no trusted key. If the bundle's key is
+// used the domain is recorded as unauthenticated. If the bundle's key differs
+// from the trusted key a failure is recorded.
+func (r *EvidenceReport) trustedKey(
+	t TrustedKeys,
+	domain string,
+	bundleKey string) string {
+	k := ""
+	if t != nil {
+		k = t(domain)
+	}
+	if k == "" {
+		for _, u := range r.Unauthenticated {
+			if u == domain {
+				return bundleKey
+			}
+		}
+		r.Unauthenticated = append(r.Unauthenticated, domain)
+		return bundleKey
+	}
+	if bundleKey != "" && bundleKey != k {
+		r.fail("public key for '%s' does not match the trusted key", domain)
+	}
+	return k
+}
+
+// VerifyEvidence checks the evidence bundle provided as JSON. The signatures
+// are checked with the public keys from t. The keys in the bundle are only
+// used for domains t does not know, and those domains are reported as
+// unauthenticated as anyone could have created the bundle's keys. The bundle
+// is only valid if every key was authenticated.
+func VerifyEvidence(b []byte, t TrustedKeys) (*EvidenceReport, error) {
+	var v EvidenceBundle
+	err := json.Unmarshal(b, &v)
+	if err != nil {
+		return nil, err
+	}
+	var r EvidenceReport
+	err = json.Unmarshal(v.Evidence, &r.Evidence)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check the hash of the evidence matches the payload of the signature and
+	// that the signature was created by the CMP.
+	var e bytes.Buffer
+	err = json.Compact(&e, v.Evidence)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.Sum256(e.Bytes())
+	s, err := owid.FromBase64(v.Signature)
+	if err != nil {
+		r.fail("signature is not a valid OWID: %s", err)
+		return &r, nil
+	}
+	r.Integrity = bytes.Equal(h[:], s.Payload)
+	if r.Integrity == false {
+		r.fail("evidence has been changed since it was signed")
+	}
+	if s.Domain != r.Evidence.CMP {
+		r.fail("signature created by '%s' not CMP '%s'",
+			s.Domain,
+			r.Evidence.CMP)
+	}
+	r.Signature, err = s.VerifyWithPublicKey(
+		r.trustedKey(t, s.Domain, v.PublicKey))
+	if err != nil {
+		r.fail("signature: %s", err)
+	} else if r.Signature == false {
+		r.fail("signature not verified with the CMP public key")
+	}
+
+	// Check each of the OWIDs in the path.
+	for i, p := range r.Evidence.Path {
+		r.Path = append(r.Path, verifyEvidenceOWID(&r, t, i, p))
+	}
+	n := len(r.Evidence.Path)
+	if n == 0 {
+		r.fail("path is empty")
+	} else {
+		if r.Evidence.Path[0].OWID != r.Evidence.SWANID {
+			r.fail("path does not start with the SWAN ID")
+		}
+		if r.Evidence.Path[n-1].Domain != r.Evidence.Accused {
+			r.fail("path does not end with the accused party '%s'",
+				r.Evidence.Accused)
+		}
+	}
+
+	// Check the preferences recorded match those in the SWAN ID.
+	o, err := owid.FromBase64(r.Evidence.SWANID)
+	if err != nil {
+		r.fail("SWAN ID is not a valid OWID: %s", err)
+	} else {
+		id, err := swan.IDFromOWID(o)
+		if err != nil {
+			r.fail("SWAN ID: %s", err)
+		} else if id.PreferencesAsString() != r.Evidence.Preferences {
+			r.fail("preferences do not match the SWAN ID")
+		}
+	}
+
+	r.Authenticated = len(r.Unauthenticated) == 0
+	if r.Authenticated == false {
+		r.fail("public keys not authenticated for %s",
+			strings.Join(r.Unauthenticated, ", "))
+	}
+	r.Valid = len(r.Errors) == 0
+	return &r, nil
+}
+
+// verifyEvidenceOWID returns the result of verifying the OWID at index i in
+// the path with the trusted key for the creator.
+func verifyEvidenceOWID(
+	r *EvidenceReport,
+	t TrustedKeys,
+	i int,
+	p *EvidenceOWID) *EvidenceOWID {
+	v := &EvidenceOWID{
+		OWID:      p.OWID,
+		Domain:    p.Domain,
+		Date:      p.Date,
+		Role:      p.Role,
+		PublicKey: p.PublicKey}
+	o, err := owid.FromBase64(p.OWID)
+	if err != nil {
+		v.Error = err.Error()
+		r.fail("path %d: not a valid OWID", i)
+		return v
+	}
+	if o.Domain != p.Domain || o.Date.Equal(p.Date) == false {
+		v.Error = "domain or date differs from the OWID"
+		r.fail("path %d: %s", i, v.Error)
+		return v
+	}
+	v.Verified, err = o.VerifyWithPublicKey(
+		r.trustedKey(t, p.Domain, p.PublicKey))
+	if err != nil {
+		v.Error = err.Error()
+	}
+	if v.Verified == false {
+		r.fail("path %d: '%s' signature not verified", i, p.Domain)
+	}
+	return v
+}
@@ -0,0 +1,250 @@
+/* ****************************************************************************
+ * Copyright 2020 51 Degrees Mobile Experts Limited (51degrees.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations
+ * under the License.
+ * ***************************************************************************/
+
+package cmp
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"owid"
+	"strings"
+	"testing"
+	"time"
+)
+
+// evidenceTestDate is a whole minute so that it survives the OWID encoding.
+var evidenceTestDate = time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+
+// evidenceTestKeys are the trusted keys for the test creators.
+var evidenceTestKeys = map[string]string{
+	"cmp.example":  "cmp key",
+	"swan.example": "swan key",
+	"dsp.example":  "dsp key"}
+
+// newTestOWID returns an OWID for the domain with the payload provided.
+func newTestOWID(domain string, payload []byte) *owid.OWID {
+	return &owid.OWID{
+		Version:   1,
+		Domain:    domain,
+		Date:      evidenceTestDate,
+		Payload:   payload,
+		Signature: make([]byte, 64)}
+}
+
+// newTestEvidence returns evidence for a complaint about dsp.example with a
+// path from the SWAN ID to the DSP.
+func newTestEvidence() *Evidence {
+	s := newTestOWID("swan.example", []byte("swan id")).AsString()
+	p := newTestOWID("dsp.example", []byte("bid")).AsString()
+	return &Evidence{
+		Version: evidenceVersion,
+		Created: evidenceTestDate,
+		CMP:     "cmp.example",
+		Accused: "dsp.example",
+		SWANID:  s,
+		Path: []*EvidenceOWID{
+			{
+				OWID:      s,
+				Domain:    "swan.example",
+				Date:      evidenceTestDate,
+				PublicKey: "swan key"},
+			{
+				OWID:      p,
+				Domain:    "dsp.example",
+				Date:      evidenceTestDate,
+				PublicKey: "dsp key"}}}
+}
+
+// newTestBundle returns the evidence with a signature from the domain whose
+// payload is the hash of the evidence.
+func newTestBundle(t *testing.T, e *Evidence, domain string) *EvidenceBundle {
+	b, err := json.Marshal(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := sha256.Sum256(b)
+	return &EvidenceBundle{
+		Evidence:  b,
+		Signature: newTestOWID(domain, h[:]).AsString(),
+		PublicKey: "cmp key"}
+}
+
+func TestVerifyEvidence(t *testing.T) {
+	tests := []struct {
+		name     string
+		evidence func(e *Evidence)       // Changes before the evidence is signed
+		bundle   func(b *EvidenceBundle) // Changes after the evidence is signed
+		keys     map[string]string       // Trusted keys if not the test keys
+		want     string                  // Expected error prefix, or empty
+	}{
+		{name: "not changed"},
+		{
+			name: "evidence changed",
+			bundle: func(b *EvidenceBundle) {
+				b.Evidence = json.RawMessage(strings.Replace(
+					string(b.Evidence),
+					"dsp.example",
+					"ssp.example",
+					1))
+			},
+			want: "evidence has been changed since it was signed"},
+		{
+			name: "evidence reformatted",
+			bundle: func(b *EvidenceBundle) {
+				var i json.RawMessage
+				json.Unmarshal(b.Evidence, &i)
+				b.Evidence, _ = json.MarshalIndent(i, "", "  ")
+			}},
+		{
+			name: "signature replaced",
+			bundle: func(b *EvidenceBundle) {
+				b.Signature = newTestOWID("cmp.example", []byte("x")).AsString()
+			},
+			want: "evidence has been changed since it was signed"},
+		{
+			name: "signature not an OWID",
+			bundle: func(b *EvidenceBundle) {
+				b.Signature = "not an OWID"
+			},
+			want: "signature is not a valid OWID"},
+		{
+			name: "signed by another domain",
+			bundle: func(b *EvidenceBundle) {
+				var e Evidence
+				json.Unmarshal(b.Evidence, &e)
+				*b = *newTestBundle(t, &e, "evil.example")
+			},
+			want: "signature created by 'evil.example' not CMP 'cmp.example'"},
+		{
+			name: "CMP key replaced",
+			bundle: func(b *EvidenceBundle) {
+				b.PublicKey = "evil key"
+			},
+			want: "public key for 'cmp.example' does not match the trusted key"},
+		{
+			name: "creator key replaced",
+			evidence: func(e *Evidence) {
+				e.Path[1].PublicKey = "evil key"
+			},
+			want: "public key for 'dsp.example' does not match the trusted key"},
+		{
+			name: "creator not trusted",
+			keys: map[string]string{
+				"cmp.example":  "cmp key",
+				"swan.example": "swan key"},
+			want: "public keys not authenticated for dsp.example"},
+		{
+			name: "no trusted keys",
+			keys: map[string]string{},
+			want: "public keys not authenticated for " +
+				"cmp.example, swan.example, dsp.example"},
+		{
+			name: "path empty",
+			evidence: func(e *Evidence) {
+				e.Path = nil
+			},
+			want: "path is empty"},
+		{
+			name: "path without SWAN ID",
+			evidence: func(e *Evidence) {
+				e.Path = e.Path[1:]
+			},
+			want: "path does not start with the SWAN ID"},
+		{
+			name: "path to another party",
+			evidence: func(e *Evidence) {
+				e.Accused = "ssp.example"
+			},
+			want: "path does not end with the accused party 'ssp.example'"},
+		{
+			name: "path domain changed",
+			evidence: func(e *Evidence) {
+				e.Path[1].Domain = "ssp.example"
+				e.Accused = "ssp.example"
+			},
+			want: "path 1: domain or date differs from the OWID"},
+		{
+			name: "path date changed",
+			evidence: func(e *Evidence) {
+				e.Path[1].Date = evidenceTestDate.Add(time.Hour)
+			},
+			want: "path 1: domain or date differs from the OWID"},
+		{
+			name: "path OWID not valid",
+			evidence: func(e *Evidence) {
+				e.Path[1].OWID = "not an OWID"
+			},
+			want: "path 1: not a valid OWID"},
+	}
+	for _, v := range tests {
+		t.Run(v.name, func(t *testing.T) {
+			e := newTestEvidence()
+			if v.evidence != nil {
+				v.evidence(e)
+			}
+			b := newTestBundle(t, e, "cmp.example")
+			if v.bundle != nil {
+				v.bundle(b)
+			}
+			j, err := json.Marshal(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			k := evidenceTestKeys
+			if v.keys != nil {
+				k = v.keys
+			}
+			r, err := VerifyEvidence(j, func(d string) string { return k[d] })
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v.want == "" {
+				if r.Integrity == false {
+					t.Errorf("integrity failed: %v", r.Errors)
+				}
+				if r.Authenticated == false {
+					t.Errorf("not authenticated: %v", r.Unauthenticated)
+				}
+				return
+			}
+			if r.Valid {
+				t.Error("valid")
+			}
+			found := false
+			for _, m := range r.Errors {
+				found = found || strings.HasPrefix(m, v.want)
+			}
+			if found == false {
+				t.Errorf("'%s' not in %v", v.want, r.Errors)
+			}
+		})
+	}
+}
+
+func TestVerifyEvidenceNotJSON(t *testing.T) {
+	tests := []string{
+		``,
+		`not json`,
+		`{"evidence": "not an object"}`,
+		`{"evidence": [1, 2]}`,
+	}
+	for _, v := range tests {
+		_, err := VerifyEvidence([]byte(v), nil)
+		if err == nil {
+			t.Errorf("'%s' accepted", v)
+		}
+	}
+}
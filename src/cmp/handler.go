@@ -28,6 +28,14 @@ func Handler(d *common.Domain, w http.ResponseWriter, r *http.Request) {
 		handlerDialog(d, w, r)
 		return
 	}
+	if strings.HasPrefix(r.URL.Path, "/stopped") {
+		handlerStopped(d, w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/api/v1/stopped") {
+		handlerStoppedAPI(d, w, r)
+		return
+	}
 	if strings.HasPrefix(r.URL.Path, "/stop") {
 		handlerStop(d, w, r)
 		return
@@ -36,10 +44,34 @@ func Handler(d *common.Domain, w http.ResponseWriter, r *http.Request) {
 		handlerInfo(d, w, r)
 		return
 	}
+	if strings.HasPrefix(r.URL.Path, "/complaints") {
+		handlerComplaints(d, w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/complaint/") {
+		handlerComplaint(d, w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/complaint-evidence/") {
+		handlerCaseEvidence(d, w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/complain/evidence") {
+		handlerEvidence(d, w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/complain/verify") {
+		handlerVerify(d, w, r)
+		return
+	}
 	if strings.HasPrefix(r.URL.Path, "/complain") {
 		handlerComplain(d, w, r)
 		return
 	}
+	if strings.HasPrefix(r.URL.Path, "/email/") {
+		handlerEmail(d, w, r)
+		return
+	}
 	if strings.HasPrefix(r.URL.Path, "/update") {
 		handlerUpdate(d, w, r)
 		return
@@ -31,43 +31,59 @@ import (
 
 var complaintSubjectTemplate = newComplaintTemplate(
 	"subject",
-	"SWAN Complaint: {{ .Organization }}")
+	`{{ .T "SWAN Complaint: %s" .Organization }}`)
 var complaintBodyTemplate = newComplaintTemplate("body", `
- To whom it may concern,
+ {{ .T "To whom it may concern," }}
  
- I believe that {{ .Organization }} used my personal information without a 
- legal basis on {{ .Date }}. 
+ {{ .T "I believe that %s used my personal information without a legal basis on %s." .Organization .Date }}
  
- I provided you the following permissions for use of this data.
+ {{ .T "I provided you the following permissions for use of this data." }}
+ {{ range .Permissions }}
+	 {{ . }}{{ end }}
  
-	 Personalize Marketing: {{ .Preferences }}
+ {{ .T "You cryptographically signed this information. We therefore agree that you were in possession of the information." }}
  
- You cryptographically signed this information. We therefore agree that you were
- in posession of the information.
+ {{ .T "As an organization operating in %s you are bound by the %s." .CountryName .Law }}
  
- As an organization operating in '{{ .Country }}' you are bound by the following 
- rules.
+	 {{ .LawURL }}
  
-	 {{ .DPRURL }}
+ {{ .T "If I do not receive a satisfactory response I will refer this matter to the %s." .Regulator }}
  
- I would be grateful if you can respond by email to this address within 7 
- working days.
+	 {{ .RegulatorURL }}
  
- Regards,
+ {{ .T "The signed evidence for this complaint can be downloaded and verified here." }}
  
- [INSERT YOU NAME]
+	 {{ .EvidenceURL }}
  
- --- DO NOT CHANGE THE TEXT BELOW THIS LINE ---
+ {{ .T "I would be grateful if you can respond by email to this address within 7 working days." }}
+ 
+ {{ .T "Regards," }}
+ 
+ {{ .T "[INSERT YOUR NAME]" }}
+ 
+ --- {{ .T "DO NOT CHANGE THE TEXT BELOW THIS LINE" }} ---
  {{ .IDAsString }}
- --- DO NOT CHANGE THE TEXT ABOVE THIS LINE ---`)
+ --- {{ .T "DO NOT CHANGE THE TEXT ABOVE THIS LINE" }} ---`)
 
 // Complaint used to format an email template.
 type Complaint struct {
-	ID           *swan.ID // The swan.ID that the complaint relates to
-	DPRURL       string
-	Organization string
-	Country      string
-	idOWID       *owid.OWID // The ID as an OWID
+	ID           *swan.ID             // The swan.ID that the complaint relates to
+	Organization string               // Legal name of the organization
+	Country      string               // Country code of the organization
+	CountryName  string               // Name of the country
+	Law          string               // Data protection law that applies
+	LawURL       string               // URL for the text of the law
+	Regulator    string               // Data protection authority
+	RegulatorURL string               // URL to complain to the authority
+	Email        string               // Privacy contact for the organization
+	EvidenceURL  string               // URL for the signed evidence bundle
+	org          *common.Organization // The organization complained about
+	idOWID       *owid.OWID           // The ID as an OWID
+	swanOWID     *owid.OWID           // The SWAN ID as an OWID
+	path         []*owid.OWID         // OWIDs from the winning bid to the root
+	purposes     []*common.Purpose    // Purposes offered to the user
+	// Translations for the user's language
+	*common.Messages
 }
 
 // Date to use in the email template.
@@ -90,6 +106,27 @@ func (c *Complaint) Preferences() string {
 	return c.ID.PreferencesAsString()
 }
 
+// Permissions returns a line for each purpose with the user's choice followed
+// by the choice for the accused party if it is a vendor the user has denied.
+func (c *Complaint) Permissions() []string {
+	var l []string
+	p := common.PreferencesFromID(c.ID)
+	if p.IsSet() == false {
+		return []string{c.T("No preferences set")}
+	}
+	for _, u := range c.purposes {
+		v := c.T("Denied")
+		if p.Purpose(u.ID) {
+			v = c.T("Allowed")
+		}
+		l = append(l, fmt.Sprintf("%s: %s", c.T(u.Name), v))
+	}
+	if p.Vendor(c.idOWID.Domain) == false {
+		l = append(l, c.T("%s: Denied for all purposes", c.idOWID.Domain))
+	}
+	return l
+}
+
 // ID as a string
 func (c *Complaint) IDAsString() (string, error) {
 	return c.ID.AsString()
@@ -110,17 +147,18 @@ func newComplaintTemplate(n string, b string) *template.Template {
 
 func newComplaint(
 	cfg *common.Configuration,
+	m *common.Messages,
 	swanOWID *owid.OWID,
 	partyOWID *owid.OWID) (*Complaint, error) {
 	var err error
 
-	// Set the static information associated with the complaint. These are
 	var c Complaint
-	c.DPRURL = "URL of the DPR"
-	c.Country = "Region of the CMP"
+	c.Messages = m
+	c.purposes = cfg.GetPurposes()
 
 	// Set the ID as an OWID.
 	c.idOWID = partyOWID
+	c.swanOWID = swanOWID
 
 	// Work out the swan.ID from the ID OWID provided.
 	c.ID, err = swan.IDFromOWID(swanOWID)
@@ -128,23 +166,147 @@ func newComplaint(
 		return nil, err
 	}
 
-	// Set the organization as the domain for the moment.
-	c.Organization = partyOWID.Domain
+	// Set the organization and the jurisdiction information from the
+	// registry of organizations behind OWID creators.
+	c.org, err = cfg.GetOrganization(partyOWID.Domain)
+	if err != nil {
+		return nil, err
+	}
+	c.Organization = c.org.LegalName
+	c.Country = c.org.Country
+	c.Email = c.org.PrivacyEmail
+	if c.org.Regulator != nil {
+		c.CountryName = c.org.Regulator.CountryName
+		c.Law = c.org.Regulator.Law
+		c.LawURL = c.org.Regulator.LawURL
+		c.Regulator = c.org.Regulator.Name
+		c.RegulatorURL = c.org.Regulator.ContactURL
+	} else {
+		c.CountryName = m.T("your jurisdiction")
+		if c.Country != "" {
+			c.CountryName = "'" + c.Country + "'"
+		}
+		c.Law = m.T("applicable data protection laws")
+		c.Regulator = m.T("relevant data protection authority")
+	}
 
 	// Return the complain data structure ready for the template email.
 	return &c, nil
 }
 
+// mailtoURL returns the URL for the user to send the complaint email.
+func mailtoURL(email, subject, body string) string {
+	return fmt.Sprintf("mailto:%s?subject=%s&body=%s",
+		email,
+		url.PathEscape(subject),
+		url.PathEscape(body))
+}
+
 func handlerComplain(
 	d *common.Domain,
 	w http.ResponseWriter,
 	r *http.Request) {
 
+	// Create the complaint object from the form values.
+	c, ok := getComplaint(d, w, r)
+	if ok == false {
+		return
+	}
+
+	// Get the strings for the subject and the body.
+	var subject bytes.Buffer
+	err := complaintSubjectTemplate.Execute(&subject, c)
+	if err != nil {
+		common.ReturnServerError(d.Config, w, r, err)
+		return
+	}
+	var body bytes.Buffer
+	err = complaintBodyTemplate.Execute(&body, c)
+	if err != nil {
+		common.ReturnServerError(d.Config, w, r, err)
+		return
+	}
+
+	// If the CMP has been asked to submit the complaint then create a case and
+	// return the URL of the case status page. Otherwise return the URL for the
+	// user to send the email.
+	var u string
+	if r.Form.Get("submit") != "" {
+		if r.Method != "POST" {
+			common.ReturnStatusCodeError(
+				d.Config,
+				w,
+				r,
+				fmt.Errorf("Complaints must be posted to submit"),
+				http.StatusMethodNotAllowed)
+			return
+		}
+		err = d.VerifyCSRF(r)
+		if err != nil {
+			common.ReturnStatusCodeError(d.Config, w, r, err, http.StatusForbidden)
+			return
+		}
+		if c.Email == "" {
+			common.ReturnStatusCodeError(
+				d.Config,
+				w,
+				r,
+				fmt.Errorf("No privacy email is registered for '%s'",
+					c.Organization),
+				http.StatusBadRequest)
+			return
+		}
+		err = checkEmail(d, r, c.Email)
+		switch err {
+		case nil:
+			break
+		case errEmailLimit:
+			common.ReturnStatusCodeError(
+				d.Config,
+				w,
+				r,
+				err,
+				http.StatusTooManyRequests)
+			return
+		default:
+			common.ReturnStatusCodeError(d.Config, w, r, err, http.StatusForbidden)
+			return
+		}
+		u, err = submitComplaint(d, r, c, subject.String(), body.String())
+		if err != nil {
+			common.ReturnServerError(d.Config, w, r, err)
+			return
+		}
+	} else {
+		u = mailtoURL(c.Email, subject.String(), body.String())
+	}
+
+	// Return the URL as a text string.
+	g := gzip.NewWriter(w)
+	defer g.Close()
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	_, err = g.Write([]byte(u))
+	if err != nil {
+		common.ReturnServerError(d.Config, w, r, err)
+		return
+	}
+}
+
+// getComplaint returns the complaint for the swanid and partyid form values
+// along with any owid values that form the path to the party. If the values
+// are not valid then an error is returned to the caller and false is returned.
+func getComplaint(
+	d *common.Domain,
+	w http.ResponseWriter,
+	r *http.Request) (*Complaint, bool) {
+
 	// Get the form values from the input request.
 	err := r.ParseForm()
 	if err != nil {
-		common.ReturnServerError(d.Config, w, err)
-		return
+		common.ReturnServerError(d.Config, w, r, err)
+		return nil, false
 	}
 
 	// Check that the SWAN ID and the Party ID are present.
@@ -152,17 +314,19 @@ func handlerComplain(
 		common.ReturnStatusCodeError(
 			d.Config,
 			w,
+			r,
 			fmt.Errorf("'swanid' missing"),
 			http.StatusBadRequest)
-		return
+		return nil, false
 	}
 	if r.Form.Get("partyid") == "" {
 		common.ReturnStatusCodeError(
 			d.Config,
 			w,
+			r,
 			fmt.Errorf("'partyid' missing"),
 			http.StatusBadRequest)
-		return
+		return nil, false
 	}
 
 	swanOWID, err := owid.FromBase64(r.Form.Get("swanid"))
@@ -170,57 +334,77 @@ func handlerComplain(
 		common.ReturnStatusCodeError(
 			d.Config,
 			w,
+			r,
 			fmt.Errorf("'swanid' not a valid OWID"),
 			http.StatusBadRequest)
-		return
+		return nil, false
 	}
 	partyOWID, err := owid.FromBase64(r.Form.Get("partyid"))
 	if err != nil {
 		common.ReturnStatusCodeError(
 			d.Config,
 			w,
+			r,
 			fmt.Errorf("'partyid' not a valid OWID"),
 			http.StatusBadRequest)
-		return
-	}
-
-	// Create the complaint object.
-	c, err := newComplaint(d.Config, swanOWID, partyOWID)
-	if err != nil {
-		common.ReturnServerError(d.Config, w, err)
-		return
+		return nil, false
 	}
 
-	// Get the strings for the subject and the body.
-	var subject bytes.Buffer
-	err = complaintSubjectTemplate.Execute(&subject, c)
-	if err != nil {
-		common.ReturnServerError(d.Config, w, err)
-		return
+	// The party must be one of the demo domains and must have signed the
+	// OWID. This stops complaints, and the emails sent for them, being raised
+	// against arbitrary domains.
+	if d.Config.VerifyOWID(partyOWID) == false {
+		common.ReturnStatusCodeError(
+			d.Config,
+			w,
+			r,
+			fmt.Errorf("'partyid' not signed by a known organization"),
+			http.StatusBadRequest)
+		return nil, false
 	}
-	var body bytes.Buffer
-	err = complaintBodyTemplate.Execute(&body, c)
-	if err != nil {
-		common.ReturnServerError(d.Config, w, err)
-		return
+	if d.Config.VerifyOWID(swanOWID) == false {
+		common.ReturnStatusCodeError(
+			d.Config,
+			w,
+			r,
+			fmt.Errorf("'swanid' not signed by a known organization"),
+			http.StatusBadRequest)
+		return nil, false
 	}
 
-	// Create the URL for the email.
-	u := fmt.Sprintf("mailto:info@%s?subject=%s&body=%s",
-		c.idOWID.Domain,
-		url.PathEscape(subject.String()),
-		url.PathEscape(body.String()))
+	// Only OWIDs that verify are included in the path as the CMP signs the
+	// evidence that contains them.
+	var path []*owid.OWID
+	for _, v := range r.Form["owid"] {
+		o, err := owid.FromBase64(v)
+		if err != nil {
+			common.ReturnStatusCodeError(
+				d.Config,
+				w,
+				r,
+				fmt.Errorf("'owid' not a valid OWID"),
+				http.StatusBadRequest)
+			return nil, false
+		}
+		if d.Config.VerifyOWID(o) == false {
+			common.ReturnStatusCodeError(
+				d.Config,
+				w,
+				r,
+				fmt.Errorf("'owid' from '%s' not verified", o.Domain),
+				http.StatusBadRequest)
+			return nil, false
+		}
+		path = append(path, o)
+	}
 
-	// Return the URL as a text string.
-	g := gzip.NewWriter(w)
-	defer g.Close()
-	w.Header().Set("Content-Encoding", "gzip")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	w.Header().Set("Cache-Control", "no-cache")
-	_, err = g.Write([]byte(u))
+	// Create the complaint object.
+	c, err := newComplaint(d.Config, d.Messages(r), swanOWID, partyOWID)
 	if err != nil {
-		common.ReturnServerError(d.Config, w, err)
-		return
+		common.ReturnServerError(d.Config, w, r, err)
+		return nil, false
 	}
+	c.path = path
+	c.EvidenceURL = evidenceURL(d, r, swanOWID, partyOWID)
+	return c, true
 }
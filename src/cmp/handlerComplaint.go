@@ -0,0 +1,392 @@
+/* ****************************************************************************
+ * Copyright 2020 51 Degrees Mobile Experts Limited (51degrees.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations
+ * under the License.
+ * ***************************************************************************/
+
+package cmp
+
+import (
+	"common"
+	"compress/gzip"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// defaultComplaintEmail is used to deliver complaints if the CMP does not have
+// a complaint-email.html template.
+var defaultComplaintEmail = template.Must(template.New("complaint").Parse(
+	`<pre>{{ .Case.Body }}</pre>` +
+		`<p>Case: {{ .Case.ID }}</p>` +
+		`<p>Signed evidence: <a href="{{ .EvidenceURL }}">{{ .EvidenceURL }}</a></p>` +
+		`<p>Submitted by {{ .Case.CMP }} on behalf of the user. Respond at ` +
+		`<a href="{{ .OperatorURL }}">{{ .OperatorURL }}</a></p>`))
+
+// caseModel data needed for the complaint case status page.
+type caseModel struct {
+	Case        *ComplaintCase
+	StatusURL   string // URL of this page for the user to keep
+	EvidenceURL string // URL of the signed evidence for the case
+	CSRF        string // Token needed to post follow up messages
+}
+
+// Mailto returns the URL for the user to send the complaint email themselves
+// if the CMP could not deliver it.
+func (m *caseModel) Mailto() template.URL {
+	return template.URL(mailtoURL(m.Case.Email, m.Case.Subject, m.Case.Body))
+}
+
+// caseEmailModel data needed for the complaint email sent to organizations.
+type caseEmailModel struct {
+	Case        *ComplaintCase
+	OperatorURL string // URL the organization uses to respond
+	EvidenceURL string // URL of the signed evidence for the case
+}
+
+// casesModel data needed for the operator view of complaint cases.
+type casesModel struct {
+	Cases     []*ComplaintCase
+	Domain    string   // OWID creator domain used to filter the cases
+	AccessKey string   // Access key needed to post responses
+	Statuses  []string // Status values the organization can choose from
+	CSRF      string   // Token needed to post responses
+}
+
+// submitComplaint stores the complaint as a new case, tries to email it to the
+// organization, and returns the URL of the case status page. If the email
+// can't be sent the case remains open and the reason is recorded.
+func submitComplaint(
+	d *common.Domain,
+	r *http.Request,
+	c *Complaint,
+	subject string,
+	body string) (string, error) {
+	e, err := newEvidenceBundle(d, c)
+	if err != nil {
+		return "", err
+	}
+	k := &ComplaintCase{
+		Status:       caseOpen,
+		CMP:          d.Host,
+		Domain:       c.idOWID.Domain,
+		Organization: c.Organization,
+		Email:        c.Email,
+		Regulator:    c.Regulator,
+		RegulatorURL: c.RegulatorURL,
+		Subject:      subject,
+		Body:         body,
+		SWANID:       c.swanOWID.AsString(),
+		PartyID:      c.idOWID.AsString(),
+		Evidence:     e}
+	s := getCaseStore(d.Config)
+	err = s.add(k)
+	if err != nil {
+		return "", err
+	}
+	se := d.Config.Outbox().Send(
+		k.Email,
+		k.Subject,
+		d.LookupHTMLWithDefault(defaultComplaintEmail, "complaint-email.html"),
+		&caseEmailModel{
+			Case:        k,
+			OperatorURL: operatorURL(d, r, k.Domain),
+			EvidenceURL: caseEvidenceURL(d, r, k.EvidenceToken)})
+	if se != nil {
+		err = s.update(k.ID, func(c *ComplaintCase) error {
+			c.DeliveryError = se.Error()
+			return nil
+		})
+	} else {
+		err = s.update(k.ID, func(c *ComplaintCase) error {
+			c.Status = caseDelivered
+			return nil
+		})
+	}
+	if err != nil {
+		return "", err
+	}
+	return caseURL(d, r, k.Token), nil
+}
+
+// caseURL returns the URL of the status page for the case with the user's
+// token. Only the user is given this URL.
+func caseURL(d *common.Domain, r *http.Request, token string) string {
+	u := url.URL{
+		Scheme: d.Config.Scheme,
+		Host:   common.RequestHost(d, r),
+		Path:   "/complaint/" + token}
+	return u.String()
+}
+
+// caseEvidenceURL returns the URL of the evidence for the case with the
+// organization's evidence token, which can't be used for the status page.
+func caseEvidenceURL(
+	d *common.Domain,
+	r *http.Request,
+	token string) string {
+	u := url.URL{
+		Scheme: d.Config.Scheme,
+		Host:   common.RequestHost(d, r),
+		Path:   "/complaint-evidence/" + token}
+	return u.String()
+}
+
+// operatorURL returns the URL of the operator view for the domain.
+func operatorURL(
+	d *common.Domain,
+	r *http.Request,
+	domain string) string {
+	u := url.URL{
+		Scheme: d.Config.Scheme,
+		Host:   common.RequestHost(d, r),
+		Path:   "/complaints"}
+	q := url.Values{}
+	q.Set("org", domain)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// handlerComplaint displays the status of a complaint case to the user and
+// lets them add follow up messages or close the case. The user's token for the
+// case is the last segment of the path. The case ID is not accepted as it is
+// sent to the organization.
+func handlerComplaint(d *common.Domain, w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		common.ReturnServerError(d.Config, w, r, err)
+		return
+	}
+	if r.Method == "POST" {
+		err = d.VerifyCSRF(r)
+		if err != nil {
+			common.ReturnStatusCodeError(d.Config, w, r, err, http.StatusForbidden)
+			return
+		}
+	}
+	t := strings.TrimPrefix(r.URL.Path, "/complaint/")
+	evidence := strings.HasSuffix(t, "/evidence")
+	t = strings.TrimSuffix(t, "/evidence")
+	s := getCaseStore(d.Config)
+	k := s.getByToken(t)
+	if k == nil || k.CMP != d.Host {
+		common.ReturnStatusCodeError(
+			d.Config,
+			w,
+			r,
+			fmt.Errorf("Complaint case not found"),
+			http.StatusNotFound)
+		return
+	}
+
+	// Return the evidence bundle stored with the case.
+	if evidence {
+		sendCaseEvidence(d, w, r, k)
+		return
+	}
+
+	// Add any follow up from the user and then display the case again.
+	if r.Method == "POST" {
+		status := ""
+		if r.Form.Get("close") != "" {
+			status = caseClosed
+		}
+		err = s.addMessage(k.ID, "You", r.Form.Get("message"), status)
+		if err == errCaseClosed {
+			common.ReturnStatusCodeError(d.Config, w, r, err, http.StatusConflict)
+			return
+		}
+		if err != nil {
+			common.ReturnServerError(d.Config, w, r, err)
+			return
+		}
+		http.Redirect(w, r, r.URL.Path, 303)
+		return
+	}
+
+	c, err := d.CSRFToken(w, r)
+	if err != nil {
+		common.ReturnServerError(d.Config, w, r, err)
+		return
+	}
+	g := gzip.NewWriter(w)
+	defer g.Close()
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	err = d.LookupHTML("complaint.html").Execute(g, &caseModel{
+		Case:        k,
+		StatusURL:   caseURL(d, r, k.Token),
+		EvidenceURL: caseURL(d, r, k.Token) + "/evidence",
+		CSRF:        c})
+	if err != nil {
+		common.ReturnServerError(d.Config, w, r, err)
+		return
+	}
+}
+
+// handlerCaseEvidence returns the evidence for a complaint case to the
+// organization. The organization's evidence token for the case is the last
+// segment of the path.
+func handlerCaseEvidence(
+	d *common.Domain,
+	w http.ResponseWriter,
+	r *http.Request) {
+	t := strings.TrimPrefix(r.URL.Path, "/complaint-evidence/")
+	k := getCaseStore(d.Config).getByEvidenceToken(t)
+	if k == nil || k.CMP != d.Host {
+		common.ReturnStatusCodeError(
+			d.Config,
+			w,
+			r,
+			fmt.Errorf("Complaint case not found"),
+			http.StatusNotFound)
+		return
+	}
+	sendCaseEvidence(d, w, r, k)
+}
+
+// sendCaseEvidence returns the evidence bundle stored with the case.
+func sendCaseEvidence(
+	d *common.Domain,
+	w http.ResponseWriter,
+	r *http.Request,
+	k *ComplaintCase) {
+	if k.Evidence == nil {
+		common.ReturnStatusCodeError(
+			d.Config,
+			w,
+			r,
+			fmt.Errorf("Complaint case '%s' has no evidence", k.ID),
+			http.StatusNotFound)
+		return
+	}
+	sendJSON(d, w, r, k.Evidence, "evidence-"+k.ID+".json")
+}
+
+// handlerComplaints is the operator view where the organizations in the demo
+// respond to the complaint cases submitted by the CMP. An access key is
+// needed to view and respond to the cases.
+func handlerComplaints(
+	d *common.Domain,
+	w http.ResponseWriter,
+	r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		common.ReturnServerError(d.Config, w, r, err)
+		return
+	}
+	k := r.Form.Get("accessKey")
+	if validAccessKey(d.Config, k) == false {
+		common.ReturnStatusCodeError(
+			d.Config,
+			w,
+			r,
+			fmt.Errorf("Valid 'accessKey' needed to view complaint cases"),
+			http.StatusUnauthorized)
+		return
+	}
+	s := getCaseStore(d.Config)
+
+	// Record the response from the organization.
+	if r.Method == "POST" && r.Form.Get("id") != "" {
+		err = d.VerifyCSRF(r)
+		if err != nil {
+			common.ReturnStatusCodeError(d.Config, w, r, err, http.StatusForbidden)
+			return
+		}
+		c := s.get(r.Form.Get("id"))
+		if c == nil || c.CMP != d.Host {
+			common.ReturnStatusCodeError(
+				d.Config,
+				w,
+				r,
+				fmt.Errorf("Complaint case '%s' not found", r.Form.Get("id")),
+				http.StatusNotFound)
+			return
+		}
+		status := r.Form.Get("status")
+		if status != "" && validCaseStatus(status) == false {
+			common.ReturnStatusCodeError(
+				d.Config,
+				w,
+				r,
+				fmt.Errorf("Status '%s' not valid", status),
+				http.StatusBadRequest)
+			return
+		}
+		if status == "" && r.Form.Get("response") != "" {
+			status = caseResponded
+		}
+		err = s.addMessage(
+			c.ID,
+			c.Organization,
+			r.Form.Get("response"),
+			status)
+		if err == errCaseClosed {
+			common.ReturnStatusCodeError(d.Config, w, r, err, http.StatusConflict)
+			return
+		}
+		if err != nil {
+			common.ReturnServerError(d.Config, w, r, err)
+			return
+		}
+	}
+
+	t, err := d.CSRFToken(w, r)
+	if err != nil {
+		common.ReturnServerError(d.Config, w, r, err)
+		return
+	}
+	g := gzip.NewWriter(w)
+	defer g.Close()
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	err = d.LookupHTML("complaints.html").Execute(g, &casesModel{
+		Cases:     s.list(d.Host, r.Form.Get("org")),
+		Domain:    r.Form.Get("org"),
+		AccessKey: k,
+		Statuses:  caseStatuses,
+		CSRF:      t})
+	if err != nil {
+		common.ReturnServerError(d.Config, w, r, err)
+		return
+	}
+}
+
+// validCaseStatus returns true if the status is one of the case statuses.
+func validCaseStatus(s string) bool {
+	for _, c := range caseStatuses {
+		if c == s {
+			return true
+		}
+	}
+	return false
+}
+
+// validAccessKey returns true if the key is one of the access keys in the
+// configuration.
+func validAccessKey(c *common.Configuration, k string) bool {
+	if k == "" {
+		return false
+	}
+	for _, a := range c.AccessKeys {
+		if a == k {
+			return true
+		}
+	}
+	return false
+}
@@ -21,12 +21,12 @@ import (
 	"compress/gzip"
 	"fmt"
 	"html/template"
-	"log"
 	"net/http"
 	"net/url"
 	"owid"
 	"reflect"
 	"salt"
+	"sort"
 	"strconv"
 	"strings"
 	"swan"
@@ -37,8 +37,24 @@ import (
 // dialogModel key value pairs with functions to interpret them.
 type dialogModel struct {
 	url.Values
+	*common.Messages                       // Translations for the user's language
+	config           *common.Configuration // Used for the purposes and vendors
+	csrf             string                // Token added to the hidden fields
+	notice           string                // Message to display to the user
 }
 
+// hiddenField is a name and value that is posted back with the dialog.
+type hiddenField struct {
+	Name  string
+	Value string
+}
+
+// hiddenFieldsTemplate renders the hidden fields so that the names and values
+// provided by the caller are escaped.
+var hiddenFieldsTemplate = template.Must(template.New("hidden").Parse(
+	`{{ range . }}<input type="hidden" id="{{ .Name }}" name="{{ .Name }}" ` +
+		`value="{{ .Value }}"/>{{ end }}`))
+
 // Title for the SWAN storage operation.
 func (m *dialogModel) Title() string { return m.Get("title") }
 
@@ -54,6 +70,22 @@ func (m *dialogModel) Salt() string { return m.Get("salt") }
 // Pref as a string.
 func (m *dialogModel) Pref() string { return m.Get("pref") }
 
+// Preferences chosen by the user for each purpose and vendor.
+func (m *dialogModel) Preferences() *common.Preferences {
+	return preferencesFromForm(m.config, &m.Values)
+}
+
+// Purposes the user can allow or deny.
+func (m *dialogModel) Purposes() []*common.Purpose {
+	return m.config.GetPurposes()
+}
+
+// Vendors the user can allow or deny.
+func (m *dialogModel) Vendors() []*common.Domain { return m.config.Vendors() }
+
+// Notice to display at the top of the dialog, or empty if none.
+func (m *dialogModel) Notice() string { return m.notice }
+
 // BackgroundColor for the SWAN storage operation.
 func (m *dialogModel) BackgroundColor() string {
 	return m.Get("backgroundColor")
@@ -69,17 +101,26 @@ func (m *dialogModel) PublisherHost() string {
 }
 
 // HiddenFields turns the parameters from the storage operation into hidden
-// fields so they are available when the form is posted.
-func (m *dialogModel) HiddenFields() template.HTML {
-	b := strings.Builder{}
+// fields so they are available when the form is posted. The CSRF token is
+// also added.
+func (m *dialogModel) HiddenFields() (template.HTML, error) {
+	var f []*hiddenField
 	for k, v := range m.Values {
-		if k != "salt" && k != "swid" && k != "email" && k != "pref" {
-			b.WriteString(fmt.Sprintf(
-				"<input type=\"hidden\" id=\"%s\" name=\"%s\" value=\"%s\"/>",
-				k, k, v[0]))
+		if k != "salt" && k != "swid" && k != "email" && k != "pref" &&
+			k != "purposes" && k != common.CSRFField &&
+			strings.HasPrefix(k, "purpose-") == false &&
+			strings.HasPrefix(k, "vendor-") == false {
+			f = append(f, &hiddenField{k, v[0]})
 		}
 	}
-	return template.HTML(b.String())
+	sort.Slice(f, func(i, j int) bool { return f[i].Name < f[j].Name })
+	f = append(f, &hiddenField{common.CSRFField, m.csrf})
+	var b strings.Builder
+	err := hiddenFieldsTemplate.Execute(&b, f)
+	if err != nil {
+		return "", err
+	}
+	return template.HTML(b.String()), nil
 }
 
 // SWIDAsString returns the SWID as a readable string without the OWID data.
@@ -100,10 +141,19 @@ func handlerDialog(d *common.Domain, w http.ResponseWriter, r *http.Request) {
 	// Parse the form variables.
 	err := r.ParseForm()
 	if err != nil {
-		common.ReturnServerError(d.Config, w, err)
+		common.ReturnServerError(d.Config, w, r, err)
 		return
 	}
 
+	// All POST requests must come from a form created by the CMP.
+	if r.Method == "POST" {
+		err = d.VerifyCSRF(r)
+		if err != nil {
+			common.ReturnStatusCodeError(d.Config, w, r, err, http.StatusForbidden)
+			return
+		}
+	}
+
 	// All GET requests are find encrypted data from the URL and redirect to get
 	// data if none is found.
 	if r.Method == "GET" {
@@ -130,6 +180,7 @@ func handlerDialog(d *common.Domain, w http.ResponseWriter, r *http.Request) {
 			common.ReturnStatusCodeError(
 				d.Config,
 				w,
+				r,
 				e.Err,
 				http.StatusBadRequest)
 			return
@@ -140,7 +191,7 @@ func handlerDialog(d *common.Domain, w http.ResponseWriter, r *http.Request) {
 	if len(r.Form["swid"]) == 0 {
 		se := setNewSWID(d, &r.Form)
 		if se != nil {
-			common.ReturnProxyError(d.Config, w, se)
+			common.ReturnProxyError(d.Config, w, r, se)
 			return
 		}
 	}
@@ -148,7 +199,17 @@ func handlerDialog(d *common.Domain, w http.ResponseWriter, r *http.Request) {
 	// If this is a close request then don't update the values and just return
 	// to the return URL.
 	if r.Form.Get("close") != "" {
-		http.Redirect(w, r, r.Form.Get("returnUrl"), 303)
+		u, err := publisherReturnURL(d, r, r.Form.Get("returnUrl"))
+		if err != nil {
+			common.ReturnStatusCodeError(
+				d.Config,
+				w,
+				r,
+				err,
+				http.StatusBadRequest)
+			return
+		}
+		http.Redirect(w, r, u.String(), 303)
 		return
 	}
 
@@ -156,59 +217,60 @@ func handlerDialog(d *common.Domain, w http.ResponseWriter, r *http.Request) {
 	if r.Method == "POST" {
 		se := dialogReset(d, &r.Form)
 		if se != nil {
-			common.ReturnProxyError(d.Config, w, se)
+			common.ReturnProxyError(d.Config, w, r, se)
 			return
 		}
 	}
 
-	// If the update action is requested them start that process.
-	if len(r.Form["update"]) != 0 {
-
-		// The user has request that the data be updated in the SWAN network.
-
-		// Get the OWID creator which is needed to sign the data just captured.
-		c, err := d.GetOWIDCreator()
-		if err != nil {
-			common.ReturnServerError(d.Config, w, err)
-			return
-		}
-
-		// Prepare the SWAN update operation.
-		o, err := getUpdate(d, r, &r.Form)
-
-		// Set the parameters for the update.
-		err = o.SetPref(c, r.Form.Get("pref") == "on")
+	// If a new reminder link is requested then email it and display the
+	// dialog again with a notice.
+	notice := ""
+	if r.Method == "POST" && r.Form.Get("resend-link") != "" {
+		r.Form.Del("resend-link")
+		notice, err = resendReminderEmail(d, r)
 		if err != nil {
 			common.ReturnStatusCodeError(
 				d.Config,
 				w,
+				r,
 				err,
 				http.StatusBadRequest)
 			return
 		}
-		err = o.SetEmail(c, r.Form.Get("email"))
+	}
+
+	// If the update action is requested them start that process. Only forms
+	// posted from the dialog can update the data.
+	if r.Method == "POST" && len(r.Form["update"]) != 0 {
+
+		// The user has request that the data be updated in the SWAN network.
+
+		// Get the OWID creator which is needed to sign the data just captured.
+		c, err := d.GetOWIDCreator()
 		if err != nil {
-			common.ReturnStatusCodeError(
-				d.Config,
-				w,
-				err,
-				http.StatusBadRequest)
+			common.ReturnServerError(d.Config, w, r, err)
 			return
 		}
-		err = o.SetSalt(c, r.Form.Get("salt"))
+
+		// Prepare the SWAN update operation.
+		o, err := getUpdate(d, r, &r.Form)
 		if err != nil {
 			common.ReturnStatusCodeError(
 				d.Config,
 				w,
+				r,
 				err,
 				http.StatusBadRequest)
 			return
 		}
-		err = o.SetSWID(r.Form.Get("swid"))
+
+		// Set the parameters for the update.
+		err = setUpdateValues(d, c, o, &r.Form)
 		if err != nil {
 			common.ReturnStatusCodeError(
 				d.Config,
 				w,
+				r,
 				err,
 				http.StatusBadRequest)
 			return
@@ -217,18 +279,20 @@ func handlerDialog(d *common.Domain, w http.ResponseWriter, r *http.Request) {
 		// Set the redirection URL for the operation to store the data. Web
 		// browser will then be redirected to that URL, the data saved and the
 		// return URL for the publisher returned to.
-		u, se := o.GetURL()
+		u, se := common.TraceSWANURL(w, r, d, "swan update", o.GetURL)
 		if se != nil {
-			common.ReturnProxyError(d.Config, w, se)
+			common.ReturnProxyError(d.Config, w, r, se)
 			return
 		}
 
 		// Send the email if the SMTP server is setup.
 		if o.Email().PayloadAsString() != "" &&
 			strings.Contains(o.Email().PayloadAsString(), "@") {
-			err = sendReminderEmail(d, o)
+			err = sendReminderEmail(d, r, o, d.Messages(r))
 			if err != nil {
-				log.Println(err)
+				common.LoggerFrom(r.Context()).Warn(
+					"reminder email not sent",
+					"error", err)
 			}
 		}
 
@@ -239,20 +303,41 @@ func handlerDialog(d *common.Domain, w http.ResponseWriter, r *http.Request) {
 
 		// The dialog needs to be displayed. Use the cmp.html template for the
 		// user interface.
+		t, err := d.CSRFToken(w, r)
+		if err != nil {
+			common.ReturnServerError(d.Config, w, r, err)
+			return
+		}
 		g := gzip.NewWriter(w)
 		defer g.Close()
 		w.Header().Set("Content-Encoding", "gzip")
-		err := d.LookupHTML("cmp.html").Execute(g, &dialogModel{Values: r.Form})
+		err = d.LookupHTML("cmp.html").Execute(g, &dialogModel{
+			Values:   r.Form,
+			Messages: d.Messages(r),
+			config:   d.Config,
+			csrf:     t,
+			notice:   notice})
 		if err != nil {
-			common.ReturnServerError(d.Config, w, err)
+			common.ReturnServerError(d.Config, w, r, err)
 			return
 		}
 	}
 }
 
 // sendReminderEmail sends the reminder email with a link to setup other
-// browsers.
-func sendReminderEmail(d *common.Domain, o *swan.Update) error {
+// browsers. m provides the translations for the user's language. The email is
+// not sent if the address has unsubscribed, too many emails have been
+// requested, or the address has not been confirmed.
+func sendReminderEmail(
+	d *common.Domain,
+	r *http.Request,
+	o *swan.Update,
+	m *common.Messages) error {
+	e := o.Email().PayloadAsString()
+	err := checkReminder(d, r, e, m)
+	if err != nil {
+		return err
+	}
 
 	// Get the salt to display the grid in the email.
 	s, err := salt.FromBase64(string(o.Salt().Payload))
@@ -260,23 +345,37 @@ func sendReminderEmail(d *common.Domain, o *swan.Update) error {
 		return err
 	}
 
+	// Get the link to unsubscribe.
+	n, err := emailURL(d, r, emailUnsubscribe, e)
+	if err != nil {
+		return err
+	}
+
 	// Set the URL using the parameters contained in the update operation.
 	u := url.URL{
 		Scheme: d.Config.Scheme,
-		Host:   d.Host,
+		Host:   common.RequestHost(d, r),
 		Path:   "/update"}
 	q, err := o.GetValues()
 	if err != nil {
 		return err
 	}
+	err = signMagicLink(d, q)
+	if err != nil {
+		return err
+	}
 	u.RawQuery = q.Encode()
 
 	// Set the email with the model populated.
-	err = common.NewSMTP().Send(
-		o.Email().PayloadAsString(),
-		"SWAN Demo: Email Reminder",
+	err = d.Config.Outbox().Send(
+		e,
+		m.T("SWAN Demo: Email Reminder"),
 		d.LookupHTML("email-template.html"),
-		ModelEmail{Salt: s, PreferencesUrl: u.String()})
+		ModelEmail{
+			Salt:           s,
+			PreferencesUrl: u.String(),
+			UnsubscribeUrl: n,
+			Messages:       m})
 	if err != nil {
 		return err
 	}
@@ -284,6 +383,91 @@ func sendReminderEmail(d *common.Domain, o *swan.Update) error {
 	return nil
 }
 
+// resendReminderEmail sends a new reminder email with a link for the values in
+// the dialog. Returns the notice to display to the user.
+func resendReminderEmail(d *common.Domain, r *http.Request) (string, error) {
+	m := d.Messages(r)
+	e := r.Form.Get("email")
+	if strings.Contains(e, "@") == false || r.Form.Get("salt") == "" {
+		return m.T("Enter your email and choose four icons to get a link."), nil
+	}
+	c, err := d.GetOWIDCreator()
+	if err != nil {
+		return "", err
+	}
+	o, err := getUpdate(d, r, &r.Form)
+	if err != nil {
+		return "", err
+	}
+	err = setUpdateValues(d, c, o, &r.Form)
+	if err != nil {
+		return "", err
+	}
+	err = sendReminderEmail(d, r, o, m)
+	switch err {
+	case nil:
+		return m.T("We've sent a new link to %s.", e), nil
+	case errEmailUnconfirmed:
+		return m.T("We've sent an email to %s. Confirm your address and then ask for a new link.", e), nil
+	case errEmailSuppressed, errEmailLimit:
+		return m.T(err.Error()), nil
+	}
+	common.LoggerFrom(r.Context()).Error("reminder email not sent", "error", err)
+	return m.T("We couldn't send the email. Please try again later."), nil
+}
+
+// setUpdateValues sets the preferences, email, salt and SWID from the form
+// values captured by the dialog in the update operation. c is the OWID creator
+// used to sign the values.
+func setUpdateValues(
+	d *common.Domain,
+	c *owid.Creator,
+	o *swan.Update,
+	m *url.Values) error {
+	p, err := preferencesFromForm(d.Config, m).AsString()
+	if err != nil {
+		return err
+	}
+	t, err := c.CreateOWIDandSign([]byte(p))
+	if err != nil {
+		return err
+	}
+	err = o.SetPrefFromOWID(t.AsString())
+	if err != nil {
+		return err
+	}
+	err = o.SetEmail(c, m.Get("email"))
+	if err != nil {
+		return err
+	}
+	err = o.SetSalt(c, m.Get("salt"))
+	if err != nil {
+		return err
+	}
+	return o.SetSWID(m.Get("swid"))
+}
+
+// preferencesFromForm returns the preferences chosen in the dialog. The dialog
+// posts the purposes field along with a purpose-[id] field for each allowed
+// purpose and a vendor-[host] field for each allowed vendor. If the purposes
+// field is not present then the existing pref value is used which may be the
+// original "on" or "off" value.
+func preferencesFromForm(
+	c *common.Configuration,
+	m *url.Values) *common.Preferences {
+	if m.Get("purposes") == "" {
+		return common.ParsePreferences(m.Get("pref"))
+	}
+	p := common.NewPreferences()
+	for _, u := range c.GetPurposes() {
+		p.Purposes[u.ID] = m.Get("purpose-"+u.ID) == "on"
+	}
+	for _, v := range c.Vendors() {
+		p.SetVendor(v.Host, m.Get("vendor-"+v.Host) == "on")
+	}
+	return p
+}
+
 // dialogReset checks for any reset keys and removes other keys if present. If
 // these keys are present they are removed from the collection to avoid being
 // added as hidden fields.
@@ -333,7 +517,7 @@ func getUpdate(
 	m *url.Values) (*swan.Update, error) {
 
 	// Configure the update operation from this demo domain's configuration.
-	returnUrl, err := url.Parse(m.Get("returnUrl"))
+	returnUrl, err := publisherReturnURL(d, r, m.Get("returnUrl"))
 	if err != nil {
 		return nil, err
 	}
@@ -374,6 +558,28 @@ func getUpdate(
 	return u, nil
 }
 
+// publisherReturnURL parses the return URL and checks that it is allowed by the
+// configuration. If the URL is for one of the demo domains then it must be a
+// publisher as the CMP must not send the user anywhere else.
+func publisherReturnURL(
+	d *common.Domain,
+	r *http.Request,
+	s string) (*url.URL, error) {
+	l := common.LoggerFrom(r.Context())
+	u, err := d.Config.ParseReturnURL(l, s)
+	if err != nil {
+		return nil, err
+	}
+	p := d.Config.DomainByHost(u.Hostname())
+	if p != nil && p.Category != "Publisher" {
+		common.LogRefusedReturnURL(l, s, "not a publisher")
+		return nil, fmt.Errorf(
+			"Return URL host '%s' is not a publisher",
+			u.Host)
+	}
+	return u, nil
+}
+
 // decryptAndDecode the encrypted data returned from SWAN.
 func decryptAndDecode(
 	d *common.Domain,
@@ -416,7 +622,7 @@ func decryptAndDecode(
 func redirectToSWAN(d *common.Domain, w http.ResponseWriter, r *http.Request) {
 
 	// Create the fetch function returning to this URL.
-	f := d.SWAN().NewFetch(r, common.GetCleanURL(d.Config, r).String(), nil)
+	f := d.SWAN().NewFetch(r, common.GetCleanURL(d, r).String(), nil)
 
 	// User Interface Provider fetch operations only need to consider
 	// one node if the caller will have already recently accessed SWAN.
@@ -430,6 +636,7 @@ func redirectToSWAN(d *common.Domain, w http.ResponseWriter, r *http.Request) {
 			common.ReturnStatusCodeError(
 				d.Config,
 				w,
+				r,
 				err,
 				http.StatusBadRequest)
 			return
@@ -444,9 +651,17 @@ func redirectToSWAN(d *common.Domain, w http.ResponseWriter, r *http.Request) {
 	// Use the return URL provided in the request to this URL as the
 	// final return URL after the update has occurred. Store in the
 	// state for use when the CMP dialogue updates.
-	returnUrl, err := common.GetReturnURL(r)
+	returnUrl, err := common.GetReturnURL(d.Config, r)
+	if err == nil {
+		returnUrl, err = publisherReturnURL(d, r, returnUrl.String())
+	}
 	if err != nil {
-		common.ReturnServerError(d.Config, w, err)
+		common.ReturnStatusCodeError(
+			d.Config,
+			w,
+			r,
+			err,
+			http.StatusBadRequest)
 		return
 	}
 	f.State[0] = returnUrl.String()
@@ -457,6 +672,7 @@ func redirectToSWAN(d *common.Domain, w http.ResponseWriter, r *http.Request) {
 		common.ReturnStatusCodeError(
 			d.Config,
 			w,
+			r,
 			fmt.Errorf("SWAN accessNode parameter required for CMP operation"),
 			http.StatusBadRequest)
 		return
@@ -467,9 +683,9 @@ func redirectToSWAN(d *common.Domain, w http.ResponseWriter, r *http.Request) {
 	f.State[3] = r.Form.Get("postMessageOnComplete")
 
 	// Get the URL.
-	u, se := f.GetURL()
+	u, se := common.TraceSWANURL(w, r, d, "swan fetch", f.GetURL)
 	if se != nil {
-		common.ReturnProxyError(d.Config, w, se)
+		common.ReturnProxyError(d.Config, w, r, se)
 		return
 	}
 	http.Redirect(w, r, u, 303)
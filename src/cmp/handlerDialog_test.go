@@ -0,0 +1,64 @@
+/* ****************************************************************************
+ * Copyright 2020 51 Degrees Mobile Experts Limited (51degrees.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations
+ * under the License.
+ * ***************************************************************************/
+
+package cmp
+
+import (
+	"common"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPublisherReturnURL(t *testing.T) {
+	var c common.Configuration
+	c.ReturnURLHosts = []string{"partner.example"}
+	d := &common.Domain{Host: "cmp.example", Category: "CMP", Config: &c}
+	err := c.SetDomains([]*common.Domain{
+		{Host: "pub.example", Category: "Publisher", Config: &c},
+		{Host: "ssp.example", Category: "SSP", Config: &c},
+		d})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		url     string
+		allowed bool
+	}{
+		{"https://pub.example/page", true},
+		{"HTTPS://Pub.Example/page", true},
+		{"https://partner.example/", true},
+		{"https://cmp.example/", false},
+		{"https://ssp.example/", false},
+		{"https://SSP.example/", false},
+		{"//pub.example/", false},
+		{"/\\evil.com", false},
+		{"https:pub.example", false},
+		{"https://pub.example@evil.com/", false},
+		{"https://ssp.example@pub.example/", false},
+		{"javascript:alert(1)", false},
+		{"https://evil.com/", false},
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	for _, v := range tests {
+		u, err := publisherReturnURL(d, r, v.url)
+		if v.allowed && err != nil {
+			t.Errorf("'%s' refused: %s", v.url, err)
+		}
+		if v.allowed == false && err == nil {
+			t.Errorf("'%s' allowed as '%s'", v.url, u)
+		}
+	}
+}
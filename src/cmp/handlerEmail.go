@@ -0,0 +1,141 @@
+/* ****************************************************************************
+ * Copyright 2020 51 Degrees Mobile Experts Limited (51degrees.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations
+ * under the License.
+ * ***************************************************************************/
+
+package cmp
+
+import (
+	"common"
+	"compress/gzip"
+	"html/template"
+	"net/http"
+	"strings"
+)
+
+// defaultConfirmEmail is used to ask the user to confirm their address if the
+// CMP does not have a confirm-email.html template.
+var defaultConfirmEmail = template.Must(template.New("confirm").Parse(
+	`<p>{{ .T "Please confirm you would like reminder emails from %s." .CMP }}</p>` +
+		`<p><a href="{{ .ConfirmURL }}">{{ .T "Confirm my email" }}</a></p>` +
+		`<p>{{ .T "If you did not ask for this email you can ignore it or" }} ` +
+		`<a href="{{ .UnsubscribeURL }}">{{ .T "stop all emails to this address" }}</a>.</p>`))
+
+// confirmEmailModel data needed for the email asking the user to confirm their
+// address.
+type confirmEmailModel struct {
+	*common.Messages
+	CMP            string // Name of the CMP sending the email
+	ConfirmURL     string // Link to confirm the address
+	UnsubscribeURL string // Link to stop all emails to the address
+}
+
+// emailPageModel data needed for the page that confirms an address or
+// unsubscribes it.
+type emailPageModel struct {
+	*common.Messages
+	Title   string // Heading for the page
+	Message string // Explanation of the action or the result
+	Token   string // The signed token to post if the action is not done
+	Button  string // Label of the button that does the action
+	Done    bool   // True if the action has been done
+}
+
+// sendConfirmEmail sends the email asking the user to confirm they want
+// reminders sent to the address.
+func sendConfirmEmail(
+	d *common.Domain,
+	r *http.Request,
+	e string,
+	m *common.Messages) error {
+	c, err := emailURL(d, r, emailConfirm, e)
+	if err != nil {
+		return err
+	}
+	u, err := emailURL(d, r, emailUnsubscribe, e)
+	if err != nil {
+		return err
+	}
+	return d.Config.Outbox().Send(
+		e,
+		m.T("SWAN Demo: Confirm your email"),
+		d.LookupHTMLWithDefault(defaultConfirmEmail, "confirm-email.html"),
+		&confirmEmailModel{
+			Messages:       m,
+			CMP:            d.Name,
+			ConfirmURL:     c,
+			UnsubscribeURL: u})
+}
+
+// handlerEmail handles the links in the emails sent by the CMP to confirm an
+// address or unsubscribe it. The link displays a page with a button so that
+// mail scanners that follow links don't do the action. The action is done
+// when the page is posted.
+func handlerEmail(d *common.Domain, w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		common.ReturnServerError(d.Config, w, r, err)
+		return
+	}
+	m := d.Messages(r)
+	a := strings.TrimPrefix(r.URL.Path, "/email/")
+	p := emailPageModel{Messages: m, Token: r.Form.Get("token")}
+	switch a {
+	case emailConfirm:
+		p.Title = m.T("Confirm your email")
+		p.Message = m.T("Select confirm to receive reminder emails.")
+		p.Button = m.T("Confirm")
+		break
+	case emailUnsubscribe:
+		p.Title = m.T("Stop emails")
+		p.Message = m.T("Select unsubscribe to stop all emails to this address.")
+		p.Button = m.T("Unsubscribe")
+		break
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	// Check the token and do the action if the form has been posted.
+	t, err := readEmailToken(d, a, p.Token)
+	if err != nil {
+		p.Message = m.T(err.Error())
+		p.Token = ""
+	} else if r.Method == "POST" {
+		l := getEmailList(d.Config)
+		if a == emailConfirm {
+			err = l.confirm(t.Email)
+			p.Message = m.T("Thank you. Ask for a new link from your preferences to receive a reminder.")
+		} else {
+			err = l.suppress(t.Email)
+			p.Message = m.T("No more emails will be sent to this address.")
+		}
+		if err != nil {
+			common.ReturnServerError(d.Config, w, r, err)
+			return
+		}
+		p.Done = true
+	}
+
+	g := gzip.NewWriter(w)
+	defer g.Close()
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	err = d.LookupHTML("email.html").Execute(g, &p)
+	if err != nil {
+		common.ReturnServerError(d.Config, w, r, err)
+		return
+	}
+}
@@ -0,0 +1,144 @@
+/* ****************************************************************************
+ * Copyright 2020 51 Degrees Mobile Experts Limited (51degrees.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations
+ * under the License.
+ * ***************************************************************************/
+
+package cmp
+
+import (
+	"common"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"owid"
+)
+
+// maxEvidenceBytes is the largest evidence bundle that can be posted to be
+// verified.
+const maxEvidenceBytes = 1 << 20
+
+// handlerEvidence returns the signed evidence bundle for the complaint in the
+// swanid and partyid form values. Any owid values are used to provide the
+// full path from the root to the party.
+func handlerEvidence(d *common.Domain, w http.ResponseWriter, r *http.Request) {
+	c, ok := getComplaint(d, w, r)
+	if ok == false {
+		return
+	}
+	e, err := newEvidenceBundle(d, c)
+	if err != nil {
+		common.ReturnServerError(d.Config, w, r, err)
+		return
+	}
+	sendJSON(d, w, r, e, "evidence.json")
+}
+
+// handlerVerify checks the evidence bundle in the body of the request and
+// returns the report as JSON. The keys of the demo domains' creators are
+// trusted. The same checks are performed by the verify-evidence command which
+// does not need the network. Bundles larger than maxEvidenceBytes are refused.
+func handlerVerify(d *common.Domain, w http.ResponseWriter, r *http.Request) {
+	b, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxEvidenceBytes))
+	var m *http.MaxBytesError
+	if errors.As(err, &m) {
+		common.ReturnStatusCodeError(
+			d.Config,
+			w,
+			r,
+			fmt.Errorf("Evidence bundle larger than %d bytes", m.Limit),
+			http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		common.ReturnServerError(d.Config, w, r, err)
+		return
+	}
+	v, err := VerifyEvidence(b, creatorKeys(d.Config))
+	if err != nil {
+		common.ReturnStatusCodeError(
+			d.Config,
+			w,
+			r,
+			fmt.Errorf("Evidence bundle not valid JSON: %s", err),
+			http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	sendJSON(d, w, r, v, "")
+}
+
+// creatorKeys returns the public keys of the demo domains' creators from the
+// OWID store.
+func creatorKeys(c *common.Configuration) TrustedKeys {
+	return func(domain string) string {
+		if c.DomainByHost(domain) == nil {
+			return ""
+		}
+		r, err := c.GetCreator(domain)
+		if err != nil || r == nil {
+			return ""
+		}
+		return r.PublicKey()
+	}
+}
+
+// evidenceURL returns the URL of the evidence bundle for the SWAN ID and party.
+func evidenceURL(
+	d *common.Domain,
+	r *http.Request,
+	swanOWID, partyOWID *owid.OWID) string {
+	u := url.URL{
+		Scheme: d.Config.Scheme,
+		Host:   common.RequestHost(d, r),
+		Path:   "/complain/evidence"}
+	q := url.Values{}
+	q.Set("swanid", swanOWID.AsString())
+	q.Set("partyid", partyOWID.AsString())
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// sendJSON returns v as indented JSON. If file is provided the browser is asked
+// to save the response with that name.
+func sendJSON(
+	d *common.Domain,
+	w http.ResponseWriter,
+	r *http.Request,
+	v interface{},
+	file string) {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		common.ReturnServerError(d.Config, w, r, err)
+		return
+	}
+	g := gzip.NewWriter(w)
+	defer g.Close()
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	if file != "" {
+		w.Header().Set(
+			"Content-Disposition",
+			fmt.Sprintf("attachment; filename=\"%s\"", file))
+	}
+	_, err = g.Write(b)
+	if err != nil {
+		common.ReturnServerError(d.Config, w, r, err)
+		return
+	}
+}
@@ -33,6 +33,7 @@ type infoModel struct {
 	Root       *owid.OWID
 	ReturnURL  template.HTML
 	AccessNode string
+	CSRF       string // Token needed to submit complaints
 }
 
 func (m *infoModel) findID() (*owid.OWID, *swan.ID) {
@@ -58,7 +59,7 @@ func handlerInfo(d *common.Domain, w http.ResponseWriter, r *http.Request) {
 	// Get the SWAN OWIDs from the form parameters.
 	err := r.ParseForm()
 	if err != nil {
-		common.ReturnServerError(d.Config, w, err)
+		common.ReturnServerError(d.Config, w, r, err)
 		return
 	}
 	var m infoModel
@@ -68,12 +69,12 @@ func handlerInfo(d *common.Domain, w http.ResponseWriter, r *http.Request) {
 			for _, v := range vs {
 				o, err := owid.FromBase64(v)
 				if err != nil {
-					common.ReturnServerError(d.Config, w, err)
+					common.ReturnServerError(d.Config, w, r, err)
 					return
 				}
 				m.OWIDs[o], err = swan.FromOWID(o)
 				if err != nil {
-					common.ReturnServerError(d.Config, w, err)
+					common.ReturnServerError(d.Config, w, r, err)
 					return
 				}
 			}
@@ -83,21 +84,31 @@ func handlerInfo(d *common.Domain, w http.ResponseWriter, r *http.Request) {
 	// Set the common fields.
 	m.Bid = m.findBid()
 	m.Root, m.ID = m.findID()
-	f, err := common.GetReturnURL(r)
+	f, err := common.GetReturnURL(d.Config, r)
 	if err != nil {
-		common.ReturnServerError(d.Config, w, err)
+		common.ReturnStatusCodeError(
+			d.Config,
+			w,
+			r,
+			err,
+			http.StatusBadRequest)
 		return
 	}
 	m.ReturnURL = template.HTML(f.String())
 	m.AccessNode = r.Form.Get("accessNode")
+	m.CSRF, err = d.CSRFToken(w, r)
+	if err != nil {
+		common.ReturnServerError(d.Config, w, r, err)
+		return
+	}
 
 	// Display the template form.
 	g := gzip.NewWriter(w)
 	defer g.Close()
 	w.Header().Set("Content-Encoding", "gzip")
-	err = d.LookupHTML("info.html").Execute(g, m)
+	err = d.LookupHTML("info.html").Execute(g, &m)
 	if err != nil {
-		common.ReturnServerError(d.Config, w, err)
+		common.ReturnServerError(d.Config, w, r, err)
 		return
 	}
 }
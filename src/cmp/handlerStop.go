@@ -21,7 +21,6 @@ import (
 	"compress/gzip"
 	"fmt"
 	"net/http"
-	"net/url"
 )
 
 // handlerStop matches the path /stop and redirects the response to the
@@ -30,7 +29,7 @@ import (
 func handlerStop(d *common.Domain, w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
-		common.ReturnServerError(d.Config, w, err)
+		common.ReturnServerError(d.Config, w, r, err)
 		return
 	}
 
@@ -38,6 +37,7 @@ func handlerStop(d *common.Domain, w http.ResponseWriter, r *http.Request) {
 		common.ReturnStatusCodeError(
 			d.Config,
 			w,
+			r,
 			fmt.Errorf("Host to be stopped must be provided"),
 			http.StatusBadRequest)
 		return
@@ -45,15 +45,30 @@ func handlerStop(d *common.Domain, w http.ResponseWriter, r *http.Request) {
 
 	// Configure the update operation from this demo domain's configuration with
 	// the return URL and host.
-	returnUrl, err := url.Parse(r.Form.Get("returnUrl"))
+	returnUrl, err := publisherReturnURL(d, r, r.Form.Get("returnUrl"))
 	if err != nil {
 		common.ReturnStatusCodeError(
 			d.Config,
 			w,
+			r,
 			err,
 			http.StatusBadRequest)
+		return
+	}
+
+	// The host is added to the stop list as an entry signed by the CMP so that
+	// the date it was stopped is known.
+	c, err := d.GetOWIDCreator()
+	if err != nil {
+		common.ReturnServerError(d.Config, w, r, err)
+		return
+	}
+	e, err := common.NewStopEntryOWID(c, r.Form.Get("host"))
+	if err != nil {
+		common.ReturnServerError(d.Config, w, r, err)
+		return
 	}
-	s := d.SWAN().NewStop(r, returnUrl.String(), r.Form.Get("host"))
+	s := d.SWAN().NewStop(r, returnUrl.String(), e.AsString())
 
 	// Use the access node from the form as this will be used by the publisher
 	// to decrypt the result.
@@ -63,15 +78,15 @@ func handlerStop(d *common.Domain, w http.ResponseWriter, r *http.Request) {
 
 	// Demonstrate the CMP can change the SWAN operation messages.
 	if r.Form.Get("message") == "" {
-		s.Message = fmt.Sprintf(
+		s.Message = d.Messages(r).T(
 			"Bye, bye %s. Thanks for letting us know.",
-			s.Host)
+			r.Form.Get("host"))
 	}
 
 	// Get the URL to process the stop data.
-	u, se := s.GetURL()
+	u, se := common.TraceSWANURL(w, r, d, "swan stop", s.GetURL)
 	if se != nil {
-		common.ReturnProxyError(d.Config, w, se)
+		common.ReturnProxyError(d.Config, w, r, se)
 		return
 	}
 
@@ -83,7 +98,7 @@ func handlerStop(d *common.Domain, w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Cache-Control", "no-cache")
 	_, err = g.Write([]byte(u))
 	if err != nil {
-		common.ReturnServerError(d.Config, w, err)
+		common.ReturnServerError(d.Config, w, r, err)
 		return
 	}
 }
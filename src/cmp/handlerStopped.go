@@ -0,0 +1,324 @@
+/* ****************************************************************************
+ * Copyright 2020 51 Degrees Mobile Experts Limited (51degrees.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations
+ * under the License.
+ * ***************************************************************************/
+
+package cmp
+
+import (
+	"common"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"swan"
+)
+
+// swanFields are the form fields that contain SWAN data.
+var swanFields = []string{"swid", "pref", "email", "salt", "stop"}
+
+// stoppedModel data needed for the stopped advertisers interface.
+type stoppedModel struct {
+	dialogModel
+	List *common.StopList // The advertisers that have been stopped
+}
+
+// Stopped returns the stopped advertisers with the most recent first.
+func (m *stoppedModel) Stopped() []*common.StopEntry { return m.List.Sorted() }
+
+// StoppedDate returns the date the entry was stopped for display.
+func (m *stoppedModel) StoppedDate(e *common.StopEntry) string {
+	if e.Date.IsZero() {
+		return "Unknown"
+	}
+	return e.Date.Format("2006-01-02 15:04")
+}
+
+// stoppedResponse is returned from the stopped advertisers JSON API.
+type stoppedResponse struct {
+	Stopped   []*common.StopEntry `json:"stopped"`
+	Stop      string              `json:"stop,omitempty"`
+	UpdateURL string              `json:"updateUrl,omitempty"`
+	CSRF      string              `json:"csrf"` // Token needed to unstop
+}
+
+// handlerStopped displays the advertisers that have been stopped and lets the
+// user un-stop them. The SWAN data is fetched in the same way as the dialog.
+func handlerStopped(d *common.Domain, w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		common.ReturnServerError(d.Config, w, r, err)
+		return
+	}
+
+	// POST requests must come from the form created by the CMP.
+	if r.Method == "POST" {
+		err = d.VerifyCSRF(r)
+		if err != nil {
+			common.ReturnStatusCodeError(d.Config, w, r, err, http.StatusForbidden)
+			return
+		}
+	}
+
+	// GET requests need the SWAN data from the URL path. If there isn't any
+	// then redirect to SWAN to fetch it.
+	if r.Method == "GET" {
+		s := common.GetSWANDataFromRequest(r)
+		if s == "" {
+			redirectToSWAN(d, w, r)
+			return
+		}
+		e := decryptAndDecode(d, s, &r.Form)
+		if e != nil {
+			if e.StatusCode() >= 400 && e.StatusCode() < 500 {
+				redirectToSWAN(d, w, r)
+				return
+			}
+			common.ReturnStatusCodeError(
+				d.Config,
+				w,
+				r,
+				e.Err,
+				http.StatusBadRequest)
+			return
+		}
+	}
+
+	// If this is a close request then return to the return URL.
+	if r.Form.Get("close") != "" {
+		u, err := publisherReturnURL(d, r, r.Form.Get("returnUrl"))
+		if err != nil {
+			common.ReturnStatusCodeError(
+				d.Config,
+				w,
+				r,
+				err,
+				http.StatusBadRequest)
+			return
+		}
+		http.Redirect(w, r, u.String(), 303)
+		return
+	}
+
+	// If a host is being un-stopped then update SWAN with the new list. Only
+	// forms posted from this page can do this.
+	l := common.ParseStopList(d.Config, r.Form.Get("stop"))
+	if r.Method == "POST" && r.Form.Get("unstop") != "" {
+		u, err := getUnstopURL(d, w, r, l, r.Form.Get("unstop"))
+		if err != nil {
+			common.ReturnStatusCodeError(
+				d.Config,
+				w,
+				r,
+				err,
+				http.StatusBadRequest)
+			return
+		}
+		http.Redirect(w, r, u, 303)
+		return
+	}
+
+	// Display the stopped advertisers.
+	t, err := d.CSRFToken(w, r)
+	if err != nil {
+		common.ReturnServerError(d.Config, w, r, err)
+		return
+	}
+	g := gzip.NewWriter(w)
+	defer g.Close()
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	err = d.LookupHTML("stopped.html").Execute(g, &stoppedModel{
+		dialogModel: dialogModel{
+			Values:   r.Form,
+			Messages: d.Messages(r),
+			config:   d.Config,
+			csrf:     t},
+		List: l})
+	if err != nil {
+		common.ReturnServerError(d.Config, w, r, err)
+		return
+	}
+}
+
+// handlerStoppedAPI returns the stopped advertisers as JSON. The SWAN data must
+// be provided in the encrypted parameter so that the values come from the
+// access node rather than the caller. If the unstop parameter is posted with
+// the CSRF token from an earlier response then the new signed stop list and
+// the URL to update SWAN with it are also returned.
+func handlerStoppedAPI(
+	d *common.Domain,
+	w http.ResponseWriter,
+	r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		common.ReturnServerError(d.Config, w, r, err)
+		return
+	}
+	if r.Form.Get("encrypted") == "" {
+		common.ReturnStatusCodeError(
+			d.Config,
+			w,
+			r,
+			errors.New("encrypted SWAN data required"),
+			http.StatusBadRequest)
+		return
+	}
+
+	// Remove any SWAN values provided by the caller so that only those from
+	// the access node are used.
+	for _, k := range swanFields {
+		r.Form.Del(k)
+	}
+	e := decryptAndDecode(d, r.Form.Get("encrypted"), &r.Form)
+	if e != nil {
+		common.ReturnProxyError(d.Config, w, r, e)
+		return
+	}
+
+	var v stoppedResponse
+	l := common.ParseStopList(d.Config, r.Form.Get("stop"))
+	if r.Form.Get("unstop") != "" {
+		if r.Method != "POST" {
+			common.ReturnStatusCodeError(
+				d.Config,
+				w,
+				r,
+				errors.New("unstop must be posted"),
+				http.StatusMethodNotAllowed)
+			return
+		}
+		err = d.VerifyCSRF(r)
+		if err != nil {
+			common.ReturnStatusCodeError(d.Config, w, r, err, http.StatusForbidden)
+			return
+		}
+		v.UpdateURL, err = getUnstopURL(d, w, r, l, r.Form.Get("unstop"))
+		if err != nil {
+			common.ReturnStatusCodeError(
+				d.Config,
+				w,
+				r,
+				err,
+				http.StatusBadRequest)
+			return
+		}
+		v.Stop = r.Form.Get("stop")
+	}
+	v.Stopped = l.Sorted()
+	v.CSRF, err = d.CSRFToken(w, r)
+	if err != nil {
+		common.ReturnServerError(d.Config, w, r, err)
+		return
+	}
+
+	b, err := json.Marshal(&v)
+	if err != nil {
+		common.ReturnServerError(d.Config, w, r, err)
+		return
+	}
+	g := gzip.NewWriter(w)
+	defer g.Close()
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	_, err = g.Write(b)
+	if err != nil {
+		common.ReturnServerError(d.Config, w, r, err)
+		return
+	}
+}
+
+// getUnstopURL removes the host from the stop list and returns the URL of the
+// SWAN update operation that stores the new signed list along with the other
+// SWAN values from the form. The stop form value is set to the new list.
+func getUnstopURL(
+	d *common.Domain,
+	w http.ResponseWriter,
+	r *http.Request,
+	l *common.StopList,
+	host string) (string, error) {
+	if l.Remove(host) == false {
+		return "", fmt.Errorf("Host '%s' has not been stopped", host)
+	}
+
+	// Sign the new list and the other values captured by the CMP.
+	c, err := d.GetOWIDCreator()
+	if err != nil {
+		return "", err
+	}
+	s, err := l.AsOWID(c)
+	if err != nil {
+		return "", err
+	}
+	r.Form.Set("stop", s.AsString())
+	o, err := getUpdate(d, r, &r.Form)
+	if err != nil {
+		return "", err
+	}
+	if o.Message == "" {
+		o.Message = fmt.Sprintf(
+			"Welcome back %s. Updating your stopped adverts.",
+			host)
+	}
+	err = setUpdateValues(d, c, o, &r.Form)
+	if err != nil {
+		return "", err
+	}
+	return getUpdateURLWithStop(d, w, r, o, r.Form.Get("stop"))
+}
+
+// getUpdateURLWithStop returns the URL for the update operation including the
+// stop list. The update operation does not provide a setter for the stop list
+// so the values it would post to the access node are posted with the stop list
+// added.
+func getUpdateURLWithStop(
+	d *common.Domain,
+	w http.ResponseWriter,
+	r *http.Request,
+	o *swan.Update,
+	stop string) (string, error) {
+	q, err := o.GetValues()
+	if err != nil {
+		return "", err
+	}
+	q.Set("stop", stop)
+	u, e := common.PostSWAN(w, r, d, "update", "/swan/api/v1/update", q)
+	if e != nil {
+		return "", e
+	}
+	return u, nil
+}
+
+// StoppedURL returns the URL of the page to manage the stopped advertisers.
+func (m *dialogModel) StoppedURL() string {
+	return newStoppedURL(m.Get("returnUrl"), m.Get("accessNode"))
+}
+
+// StoppedURL returns the URL of the page to manage the stopped advertisers.
+func (m *infoModel) StoppedURL() string {
+	return newStoppedURL(string(m.ReturnURL), m.AccessNode)
+}
+
+func newStoppedURL(returnURL string, accessNode string) string {
+	u := url.URL{Path: "/stopped/"}
+	q := u.Query()
+	q.Set("returnUrl", returnURL)
+	q.Set("accessNode", accessNode)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
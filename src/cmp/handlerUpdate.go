@@ -17,10 +17,24 @@
 package cmp
 
 import (
+	"bytes"
 	"common"
+	"compress/gzip"
 	"net/http"
+	"net/url"
 )
 
+// linkExpiredModel data needed for the page displayed when a reminder link
+// can't be used.
+type linkExpiredModel struct {
+	*common.Messages
+	Reason         string // Why the link can't be used
+	PreferencesURL string // URL of the dialog to request a new link
+}
+
+// handlerUpdate applies the values from the link in the reminder email to
+// SWAN. The link must have been signed by this CMP, not have expired and not
+// have been used before.
 func handlerUpdate(
 	d *common.Domain,
 	w http.ResponseWriter,
@@ -29,12 +43,31 @@ func handlerUpdate(
 	// Get the form values from the input request.
 	err := r.ParseForm()
 	if err != nil {
-		common.ReturnServerError(d.Config, w, err)
+		common.ReturnServerError(d.Config, w, r, err)
 		return
 	}
 
-	// Create the update operation.
+	// Check the link can be used. If not display a page explaining why. The
+	// link is only recorded as used once the update has been created so that
+	// a failure does not stop the user trying again.
+	l, err := checkMagicLink(d, r.Form)
+	if err != nil {
+		handlerLinkExpired(d, w, r, err)
+		return
+	}
+
+	// Create the update operation. The return URL is checked before the
+	// operation is created.
 	o, err := getUpdate(d, r, &r.Form)
+	if err != nil {
+		common.ReturnStatusCodeError(
+			d.Config,
+			w,
+			r,
+			err,
+			http.StatusBadRequest)
+		return
+	}
 
 	// Add the values from the form parameters.
 	err = o.SetPrefFromOWID(r.Form.Get("pref"))
@@ -42,6 +75,7 @@ func handlerUpdate(
 		common.ReturnStatusCodeError(
 			d.Config,
 			w,
+			r,
 			err,
 			http.StatusBadRequest)
 		return
@@ -51,6 +85,7 @@ func handlerUpdate(
 		common.ReturnStatusCodeError(
 			d.Config,
 			w,
+			r,
 			err,
 			http.StatusBadRequest)
 		return
@@ -60,6 +95,7 @@ func handlerUpdate(
 		common.ReturnStatusCodeError(
 			d.Config,
 			w,
+			r,
 			err,
 			http.StatusBadRequest)
 		return
@@ -68,12 +104,59 @@ func handlerUpdate(
 	// Set the redirection URL for the operation to store the data. Web
 	// browser will then be redirected to that URL, the data saved and the
 	// return URL for the publisher returned to.
-	u, se := o.GetURL()
+	u, se := common.TraceSWANURL(w, r, d, "swan update", o.GetURL)
 	if se != nil {
-		common.ReturnProxyError(d.Config, w, se)
+		common.ReturnProxyError(d.Config, w, r, se)
+		return
+	}
+	err = useMagicLink(l)
+	if err != nil {
+		handlerLinkExpired(d, w, r, err)
 		return
 	}
 
 	// Redirect the response to the return URL.
 	http.Redirect(w, r, u, 303)
 }
+
+// handlerLinkExpired displays a page explaining that the reminder link can't
+// be used with a link to the dialog where the user can ask for a new one.
+func handlerLinkExpired(
+	d *common.Domain,
+	w http.ResponseWriter,
+	r *http.Request,
+	reason error) {
+	m := d.Messages(r)
+	var u url.URL
+	u.Path = "/preferences"
+	q := u.Query()
+	q.Set("returnUrl", r.Form.Get("returnUrl"))
+	q.Set("accessNode", r.Form.Get("accessNode"))
+	u.RawQuery = q.Encode()
+	s := http.StatusBadRequest
+	if reason == errLinkExpired || reason == errLinkUsed {
+		s = http.StatusGone
+	}
+
+	// Render the page before the status is written so that a template error
+	// can still be returned as a server error.
+	var b bytes.Buffer
+	err := d.LookupHTML("link-expired.html").Execute(&b, &linkExpiredModel{
+		Messages:       m,
+		Reason:         m.T(reason.Error()),
+		PreferencesURL: u.String()})
+	if err != nil {
+		common.ReturnServerError(d.Config, w, r, err)
+		return
+	}
+	g := gzip.NewWriter(w)
+	defer g.Close()
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(s)
+	_, err = g.Write(b.Bytes())
+	if err != nil {
+		common.Log.Debug("link expired page not written", "error", err)
+	}
+}
@@ -0,0 +1,179 @@
+/* ****************************************************************************
+ * Copyright 2020 51 Degrees Mobile Experts Limited (51degrees.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations
+ * under the License.
+ * ***************************************************************************/
+
+package cmp
+
+import (
+	"bytes"
+	"common"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"owid"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// magicLinkField is the query string parameter that contains the signed link.
+const magicLinkField = "link"
+
+// defaultMagicLinkMinutes is used if the configuration does not set
+// magicLinkMinutes.
+const defaultMagicLinkMinutes = 24 * 60
+
+// Reasons a reminder link can't be used.
+var (
+	errLinkInvalid = errors.New("Link is not valid")
+	errLinkExpired = errors.New("Link has expired")
+	errLinkUsed    = errors.New("Link has already been used")
+)
+
+// magicLink is the payload of the OWID the CMP signs for each reminder link.
+type magicLink struct {
+	ID      string    `json:"id"`      // Unique ID used to allow the link once
+	Expires time.Time `json:"expires"` // Time after which the link can't be used
+	Hash    []byte    `json:"hash"`    // SHA-256 of the other query values
+}
+
+// linkStore records the reminder links that have been used until they expire.
+type linkStore struct {
+	mutex sync.Mutex
+	used  map[string]time.Time // Expiry times keyed on link ID
+}
+
+var usedLinks = &linkStore{used: make(map[string]time.Time)}
+
+// isUsed returns true if the link has already been used.
+func (s *linkStore) isUsed(l *magicLink) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, ok := s.used[l.ID]
+	return ok
+}
+
+// use returns true and records the link if it has not already been used.
+// Links that have expired are removed as they can no longer be used anyway.
+func (s *linkStore) use(l *magicLink) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	n := time.Now()
+	for k, v := range s.used {
+		if n.After(v) {
+			delete(s.used, k)
+		}
+	}
+	if _, ok := s.used[l.ID]; ok {
+		return false
+	}
+	s.used[l.ID] = l.Expires
+	return true
+}
+
+// signMagicLink adds a link signed by the CMP to the query values q. The link
+// covers all the values already in q and expires after the magicLinkMinutes in
+// the configuration.
+func signMagicLink(d *common.Domain, q url.Values) error {
+	c, err := d.GetOWIDCreator()
+	if err != nil {
+		return err
+	}
+	m := d.Config.MagicLinkMinutes
+	if m <= 0 {
+		m = defaultMagicLinkMinutes
+	}
+	b, err := json.Marshal(&magicLink{
+		ID:      uuid.New().String(),
+		Expires: time.Now().UTC().Add(time.Duration(m) * time.Minute),
+		Hash:    magicLinkHash(q)})
+	if err != nil {
+		return err
+	}
+	o, err := c.CreateOWIDandSign(b)
+	if err != nil {
+		return err
+	}
+	q.Set(magicLinkField, o.AsString())
+	return nil
+}
+
+// checkMagicLink checks the signed link in the query values q was created by
+// this CMP for the other values, has not expired and has not been used
+// before. The link is returned so that it can be recorded as used with
+// useMagicLink once the SWAN update URL has been created.
+func checkMagicLink(d *common.Domain, q url.Values) (*magicLink, error) {
+	o, err := verifyCMPOWID(d, q.Get(magicLinkField))
+	if err != nil {
+		return nil, err
+	}
+	var l magicLink
+	err = json.Unmarshal(o.Payload, &l)
+	if err != nil {
+		return nil, errLinkInvalid
+	}
+	v := url.Values{}
+	for k, a := range q {
+		if k != magicLinkField {
+			v[k] = a
+		}
+	}
+	if bytes.Equal(magicLinkHash(v), l.Hash) == false {
+		return nil, errLinkInvalid
+	}
+	if time.Now().After(l.Expires) {
+		return nil, errLinkExpired
+	}
+	if usedLinks.isUsed(&l) {
+		return nil, errLinkUsed
+	}
+	return &l, nil
+}
+
+// useMagicLink records the link as used. errLinkUsed is returned if another
+// request used the link after it was checked.
+func useMagicLink(l *magicLink) error {
+	if usedLinks.use(l) == false {
+		return errLinkUsed
+	}
+	return nil
+}
+
+// verifyCMPOWID returns the OWID in the base 64 string if it was signed by
+// this CMP, otherwise errLinkInvalid.
+func verifyCMPOWID(d *common.Domain, s string) (*owid.OWID, error) {
+	o, err := owid.FromBase64(s)
+	if err != nil || o == nil {
+		return nil, errLinkInvalid
+	}
+	c, err := d.GetOWIDCreator()
+	if err != nil {
+		return nil, err
+	}
+	ok, err := c.Verify(o)
+	if err != nil || ok == false {
+		return nil, errLinkInvalid
+	}
+	return o, nil
+}
+
+// magicLinkHash returns the hash of the query values. Encode sorts the values
+// by key so the same values always have the same hash.
+func magicLinkHash(q url.Values) []byte {
+	h := sha256.Sum256([]byte(q.Encode()))
+	return h[:]
+}
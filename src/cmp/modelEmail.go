@@ -17,11 +17,14 @@
 package cmp
 
 import (
+	"common"
 	"salt"
 )
 
 // ModelEmail used with the email template.
 type ModelEmail struct {
 	*salt.Salt
-	PreferencesUrl string
+	*common.Messages // Translations for the user's language
+	PreferencesUrl   string
+	UnsubscribeUrl   string // Link to stop all emails to the address
 }
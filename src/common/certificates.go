@@ -0,0 +1,361 @@
+/* ****************************************************************************
+ * Copyright 2020 51 Degrees Mobile Experts Limited (51degrees.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations
+ * under the License.
+ * ***************************************************************************/
+
+package common
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Names of the files for the local certificate authority.
+const (
+	localCACert = "ca.crt"
+	localCAKey  = "ca.key"
+)
+
+// localCertDays is how long certificates issued by the local certificate
+// authority are valid for. Browsers don't accept longer periods.
+const localCertDays = 825
+
+// Certificates chooses the TLS certificate for each host from the certificate
+// files in a folder. Each [name].crt file must have a matching [name].key
+// file. A certificate is used for every host it covers, including wildcards.
+// If the local certificate authority is enabled then certificates are issued
+// for the hosts and aliases of the domains that don't have one.
+type Certificates struct {
+	config *Configuration     // Configuration with the domains
+	folder string             // Folder containing the certificate files
+	mutex  sync.RWMutex       // Protects certs
+	certs  []*tls.Certificate // Certificates with the Leaf set
+	ca     *tls.Certificate   // The local certificate authority, or nil
+}
+
+// NewCertificates loads the certificates from the certificatesFolder in the
+// configuration, or the working directory if not set. If localCA is set then
+// the local certificate authority is loaded from the folder, or created if it
+// does not exist.
+func NewCertificates(c *Configuration) (*Certificates, error) {
+	s := Certificates{config: c, folder: c.CertificatesFolder}
+	if s.folder == "" {
+		s.folder = "."
+	}
+	if c.LocalCA {
+		err := os.MkdirAll(s.folder, 0700)
+		if err != nil {
+			return nil, err
+		}
+		s.ca, err = s.loadCA()
+		if err != nil {
+			return nil, err
+		}
+	}
+	files, err := ioutil.ReadDir(s.folder)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != ".crt" ||
+			f.Name() == localCACert {
+			continue
+		}
+		n := strings.TrimSuffix(f.Name(), ".crt")
+		t, err := loadCertificate(
+			filepath.Join(s.folder, n+".crt"),
+			filepath.Join(s.folder, n+".key"))
+		if err != nil {
+			Log.Warn("certificate not loaded", "file", f.Name(), "error", err)
+			continue
+		}
+		s.certs = append(s.certs, t)
+	}
+	return &s, nil
+}
+
+// TLSConfig returns the TLS configuration for a server that uses the
+// certificates.
+func (s *Certificates) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: s.GetCertificate}
+}
+
+// GetCertificate returns the certificate for the host the client asked for.
+// If there isn't one, the local certificate authority is enabled and the host
+// is one of the domains then a certificate is issued. Otherwise the first
+// certificate is used.
+func (s *Certificates) GetCertificate(
+	h *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	n := strings.ToLower(strings.TrimSuffix(h.ServerName, "."))
+	if t := s.find(n); t != nil {
+		return t, nil
+	}
+	if s.ca != nil && s.issuable(n) {
+		return s.issue(n)
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if len(s.certs) > 0 {
+		return s.certs[0], nil
+	}
+	return nil, fmt.Errorf("No certificate for host '%s'", n)
+}
+
+// Check returns the problems with the certificates for the domains. If the
+// local certificate authority is enabled then certificates are issued for
+// domains that don't have a current one.
+func (s *Certificates) Check(domains []*Domain) []string {
+	var p []string
+	for _, d := range domains {
+		h := strings.ToLower(d.Host)
+		if s.find(h) != nil {
+			continue
+		}
+		if s.ca != nil {
+			_, err := s.issue(h)
+			if err != nil {
+				p = append(p, fmt.Sprintf(
+					"Certificate for '%s' could not be issued: %s", h, err))
+			}
+			continue
+		}
+		if e := s.expired(h); e != nil {
+			p = append(p, fmt.Sprintf(
+				"Certificate for '%s' expired on %s",
+				h,
+				e.Leaf.NotAfter.Format(time.RFC3339)))
+		} else {
+			p = append(p, fmt.Sprintf("No certificate for '%s'", h))
+		}
+	}
+	return p
+}
+
+// issuable returns true if the local certificate authority can issue a
+// certificate for the host. Only the hosts and aliases of the domains, with or
+// without www., are allowed so that clients can't choose the names that
+// certificates are created and written to the folder for. Wildcard aliases
+// are not used as they match any number of hosts.
+func (s *Certificates) issuable(host string) bool {
+	if host == "" || strings.ContainsAny(host, "/\\") {
+		return false
+	}
+	h := strings.TrimPrefix(host, "www.")
+	for _, d := range s.config.Domains() {
+		if strings.EqualFold(d.Host, h) {
+			return true
+		}
+		for _, a := range d.Aliases {
+			if strings.HasPrefix(a, wildcardPrefix) == false &&
+				strings.EqualFold(a, h) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// find returns the current certificate for the host with the latest expiry
+// date, or nil if there isn't one.
+func (s *Certificates) find(host string) *tls.Certificate {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.current(host)
+}
+
+// current returns the current certificate for the host with the latest expiry
+// date, or nil if there isn't one. The caller must hold the mutex.
+func (s *Certificates) current(host string) *tls.Certificate {
+	n := time.Now()
+	var r *tls.Certificate
+	for _, t := range s.certs {
+		if n.Before(t.Leaf.NotBefore) || n.After(t.Leaf.NotAfter) {
+			continue
+		}
+		if t.Leaf.VerifyHostname(host) != nil {
+			continue
+		}
+		if r == nil || t.Leaf.NotAfter.After(r.Leaf.NotAfter) {
+			r = t
+		}
+	}
+	return r
+}
+
+// expired returns a certificate for the host that has expired, or nil if
+// there isn't one.
+func (s *Certificates) expired(host string) *tls.Certificate {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for _, t := range s.certs {
+		if time.Now().After(t.Leaf.NotAfter) &&
+			t.Leaf.VerifyHostname(host) == nil {
+			return t
+		}
+	}
+	return nil
+}
+
+// issue creates a certificate for the host signed by the local certificate
+// authority and writes it to the folder so it is used again after a restart.
+// If another request issued a certificate for the host while this one waited
+// for the mutex then that certificate is returned.
+func (s *Certificates) issue(host string) (*tls.Certificate, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if t := s.current(host); t != nil {
+		return t, nil
+	}
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	n := time.Now()
+	t := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: host},
+		NotBefore:   n.Add(-time.Hour),
+		NotAfter:    n.AddDate(0, 0, localCertDays),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}
+	if ip := net.ParseIP(host); ip != nil {
+		t.IPAddresses = []net.IP{ip}
+	} else {
+		t.DNSNames = []string{host}
+	}
+	c, err := createCertificate(t, s.ca.Leaf, k, s.ca.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	err = writeCertificate(s.folder, host, c)
+	if err != nil {
+		return nil, err
+	}
+	s.certs = append(s.certs, c)
+	Log.Info("local certificate issued", "host", host)
+	return c, nil
+}
+
+// loadCA loads the local certificate authority from the folder, creating it if
+// it does not exist.
+func (s *Certificates) loadCA() (*tls.Certificate, error) {
+	c := filepath.Join(s.folder, localCACert)
+	if _, err := os.Stat(c); err == nil {
+		return loadCertificate(c, filepath.Join(s.folder, localCAKey))
+	}
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	n := time.Now()
+	t := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "SWAN Demo Local CA"},
+		NotBefore:             n.Add(-time.Hour),
+		NotAfter:              n.AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true}
+	a, err := createCertificate(t, t, k, k)
+	if err != nil {
+		return nil, err
+	}
+	err = writeCertificate(
+		s.folder,
+		strings.TrimSuffix(localCACert, ".crt"),
+		a)
+	if err != nil {
+		return nil, err
+	}
+	Log.Info("local certificate authority created, add it to the trusted "+
+		"root certificates of the web browser", "file", c)
+	return a, nil
+}
+
+// createCertificate creates the certificate from the template signed by the
+// parent's key.
+func createCertificate(
+	t *x509.Certificate,
+	parent *x509.Certificate,
+	k *ecdsa.PrivateKey,
+	parentKey interface{}) (*tls.Certificate, error) {
+	var err error
+	t.SerialNumber, err = rand.Int(
+		rand.Reader,
+		new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	b, err := x509.CreateCertificate(rand.Reader, t, parent, &k.PublicKey, parentKey)
+	if err != nil {
+		return nil, err
+	}
+	l, err := x509.ParseCertificate(b)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{b},
+		PrivateKey:  k,
+		Leaf:        l}, nil
+}
+
+// writeCertificate writes the certificate and its key to [name].crt and
+// [name].key in the folder.
+func writeCertificate(folder string, name string, c *tls.Certificate) error {
+	k, err := x509.MarshalECPrivateKey(c.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(
+		filepath.Join(folder, name+".key"),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: k}),
+		0600)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(
+		filepath.Join(folder, name+".crt"),
+		pem.EncodeToMemory(&pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: c.Certificate[0]}),
+		0644)
+}
+
+// loadCertificate loads the certificate and key files and sets the Leaf.
+func loadCertificate(certFile string, keyFile string) (*tls.Certificate, error) {
+	c, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	c.Leaf, err = x509.ParseCertificate(c.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
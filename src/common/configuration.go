@@ -17,33 +17,188 @@
 package common
 
 import (
-	"encoding/json"
 	"fmt"
-	"os"
+	"fod"
 	"owid"
+	"sync/atomic"
+	"time"
 )
 
-// Configuration maps to the appsettings.json settings file.
+// Configuration maps to the effective settings from the settings files,
+// environment variables and command line flags. See Settings.
 type Configuration struct {
-	AccessKeys []string   `json:"accessKeys"` // Array of valid keys for SWAN access
-	Scheme     string     `json:"scheme"`     // The scheme to use for requests
-	Debug      bool       `json:"debug"`      // True if debug HTML output should be provided
-	Domains    []*Domain  // All the domains that form the demo
-	owid       owid.Store // The OWID store for use with domains
-}
-
-// NewConfig creates a new instance of configuration from the file provided.
-func NewConfig(settingsFile string) Configuration {
-	var c Configuration
-	configFile, err := os.Open(settingsFile)
-	defer configFile.Close()
+	AccessKeys          []string   `json:"accessKeys"`          // Array of valid keys for SWAN access
+	Scheme              string     `json:"scheme"`              // The scheme to use for requests
+	Debug               bool       `json:"debug"`               // True if debug HTML output should be provided
+	DecryptCacheSize    int        `json:"decryptCacheSize"`    // Maximum number of decrypted SWAN data items cached by publishers
+	DecryptCacheSeconds int        `json:"decryptCacheSeconds"` // Seconds before the access node is asked to decrypt the same data again
+	DecryptStaleSeconds int        `json:"decryptStaleSeconds"` // Seconds decrypted data can be used for if the access node can't be reached
+	OrganizationsFile   string     `json:"organizationsFile"`   // JSON file with the organizations behind OWID creators
+	ComplaintsFile      string     `json:"complaintsFile"`      // JSON file used to keep complaint cases submitted by CMPs
+	Purposes            []*Purpose `json:"purposes"`            // Purposes offered by CMPs, or the defaults if empty
+	CSRFSecret          string     `json:"csrfSecret"`          // Secret used to sign CSRF tokens, or random if empty
+	ReturnURLHosts      []string   `json:"returnUrlHosts"`      // Hosts outside the demo that users can be returned to
+	TrustedProxies      []string   `json:"trustedProxies"`      // IP addresses or CIDR ranges of proxies trusted to set X-Forwarded-For
+	MagicLinkMinutes    int        `json:"magicLinkMinutes"`    // Minutes before reminder email links expire
+	MailSink            string     `json:"mailSink"`            // Maildir folder to write email to instead of sending it
+	OutboxFile          string     `json:"outboxFile"`          // JSON file used to keep email waiting to be sent
+	EmailListFile       string     `json:"emailListFile"`       // JSON file used to keep confirmed and unsubscribed emails
+	ShutdownSeconds     int        `json:"shutdownSeconds"`     // Seconds to wait for requests to finish when stopping
+	CertificatesFolder  string     `json:"certificatesFolder"`  // Folder with [host].crt and [host].key files for HTTPS
+	LocalCA             bool       `json:"localCA"`             // True to issue certificates from a local CA for development
+	TraceFile           string     `json:"traceFile"`           // JSON lines file to write trace spans to
+	TraceEndpoint       string     `json:"traceEndpoint"`       // OTLP/HTTP endpoint to send trace spans to
+	MetricsFile         string     `json:"metricsFile"`         // File the metrics are written to when the server stops
+	LogLevel            string     `json:"logLevel"`            // debug, info, warn or error, or debug if not set and debug is true
+	LogFormat           string     `json:"logFormat"`           // logfmt or json
+	LogSensitive        bool       `json:"logSensitive"`        // True to log email, salt and OWID values rather than redacting them
+	ReloadSeconds       int        `json:"reloadSeconds"`       // Seconds between checks for changes to the www folder, or -1 to disable
+	HTTPPort            string     `json:"httpPort"`            // Port for HTTP requests
+	HTTPSPort           string     `json:"httpsPort"`           // Port for HTTPS requests, or empty if HTTPS is not used
+	SMTPSender          string     `json:"smtpSender"`          // Email address messages are sent from
+	SMTPHost            string     `json:"smtpHost"`            // Host name of the mail server
+	SMTPPort            string     `json:"smtpPort"`            // Port of the mail server
+	SMTPPassword        string     `json:"smtpPassword"`        // Password for the sender, or empty for no authentication
+	SMTPSecurity        string     `json:"smtpSecurity"`        // tls, starttls or none
+	FODResourceKey      string     `json:"fodResourceKey"`      // 51Degrees resource key used to detect crawlers
+	DefaultDomain       string     `json:"defaultDomain"`       // Host of the domain used for hosts that are not part of the demo
+	owid                owid.Store // The OWID store for use with domains
+	organizations       *Organizations
+	csrfKey             []byte   // Key used to sign CSRF tokens
+	unknown             []string // Settings in the file that are not known
+
+	// The domains are replaced as a whole when the www folder changes.
+	routes atomic.Value // *Routes to the domains that form the demo
+	reload atomic.Value // *ReloadStatus of the last reload of the domains
+}
+
+// NewConfig creates a new instance of configuration from the settings
+// provided. An error is returned if the settings are invalid or the logging
+// settings are invalid. Other problems with the settings are logged as
+// warnings. Use SettingsProblems to treat them as errors.
+func NewConfig(s *Settings) (*Configuration, error) {
+	c, err := s.Configuration()
 	if err != nil {
-		fmt.Println(err.Error())
+		return nil, err
+	}
+	l, err := newLogger(c.LogLevel, c.LogFormat, c.LogSensitive, c.Debug)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", s, err)
+	}
+	Log = l
+	for _, p := range c.SettingsProblems() {
+		Log.Warn("setting problem", "settings", s.String(), "problem", p)
 	}
-	jsonParser := json.NewDecoder(configFile)
-	jsonParser.Decode(&c)
+	settingsFile, err := s.File()
+	if err != nil {
+		return nil, err
+	}
+	fod.ResourceKey = c.FODResourceKey
 	c.owid = getOWIDStore(settingsFile)
-	return c
+	c.csrfKey, err = newCSRFKey(c.CSRFSecret)
+	if err != nil {
+		panic(err)
+	}
+	if c.OrganizationsFile != "" {
+		c.organizations, err = NewOrganizations(c.OrganizationsFile)
+		if err != nil {
+			Log.Error("organizations not read", "error", err)
+		}
+	}
+	return c, nil
+}
+
+// Domains returns all the domains that form the demo. The domains are replaced
+// as a whole when the www folder changes so the slice returned must not be
+// modified.
+func (c *Configuration) Domains() []*Domain {
+	return c.Routes().domains
+}
+
+// Routes returns the routes from request hosts to the domains.
+func (c *Configuration) Routes() *Routes {
+	t, _ := c.routes.Load().(*Routes)
+	if t == nil {
+		return &Routes{}
+	}
+	return t
+}
+
+// SetDomains replaces all the domains that form the demo and the routes to
+// them. Requests that have already started continue to use the previous
+// domains. An error is returned, and the previous domains kept, if the hosts
+// and aliases of the domains can't be routed.
+func (c *Configuration) SetDomains(d []*Domain) error {
+	t, err := NewRoutes(d, c.DefaultDomain)
+	if err != nil {
+		return err
+	}
+	c.routes.Store(t)
+	return nil
+}
+
+// ReloadStatus is the outcome of the last attempt to reload the domains.
+type ReloadStatus struct {
+	Time  time.Time `json:"time"`            // When the reload was attempted
+	Error string    `json:"error,omitempty"` // Why the previous domains are still used
+}
+
+// Reload returns the outcome of the last attempt to reload the domains, or nil
+// if they have not been reloaded.
+func (c *Configuration) Reload() *ReloadStatus {
+	r, _ := c.reload.Load().(*ReloadStatus)
+	return r
+}
+
+// SetReload records the outcome of an attempt to reload the domains.
+func (c *Configuration) SetReload(err error) {
+	r := ReloadStatus{Time: time.Now()}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	c.reload.Store(&r)
+}
+
+// DomainByHost returns the domain for the host or alias provided, or nil if
+// the host is not part of the demo.
+func (c *Configuration) DomainByHost(host string) *Domain {
+	return c.Routes().Find(host)
+}
+
+// DomainsByCategory returns all the domains that match the category.
+func (c *Configuration) DomainsByCategory(category string) []*Domain {
+	var domains []*Domain
+	for _, d := range c.Domains() {
+		if d.Category == category {
+			domains = append(domains, d)
+		}
+	}
+	return domains
+}
+
+// GetCreator returns the OWID creator for the domain from the OWID store, or
+// nil if the domain is not a registered creator.
+func (c *Configuration) GetCreator(domain string) (*owid.Creator, error) {
+	if c.owid == nil {
+		return nil, nil
+	}
+	return c.owid.GetCreator(domain)
+}
+
+// VerifyOWID returns true if the OWID was signed by the creator of a demo
+// domain. The creator is taken from the OWID store rather than fetched from
+// the domain in the OWID so that untrusted OWIDs can't cause requests to
+// other hosts.
+func (c *Configuration) VerifyOWID(o *owid.OWID) bool {
+	if o == nil || c.DomainByHost(o.Domain) == nil {
+		return false
+	}
+	r, err := c.GetCreator(o.Domain)
+	if err != nil || r == nil {
+		return false
+	}
+	ok, err := r.Verify(o)
+	return err == nil && ok
 }
 
 func getOWIDStore(settingsFile string) owid.Store {
@@ -0,0 +1,119 @@
+/* ****************************************************************************
+ * Copyright 2020 51 Degrees Mobile Experts Limited (51degrees.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations
+ * under the License.
+ * ***************************************************************************/
+
+package common
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CSRFField is the name of the form field that contains the CSRF token.
+const CSRFField = "csrf"
+
+// csrfCookie is the name of the cookie that binds CSRF tokens to a browser.
+const csrfCookie = "__csrf"
+
+// csrfTimeout is how long a CSRF token can be used for after it is created.
+const csrfTimeout = time.Hour
+
+// CSRFToken returns a signed CSRF token for a form that will be posted back to
+// the domain. The token contains its expiry time and is signed along with the
+// domain's host and a random value kept in a cookie. The cookie is set on the
+// response if the request does not already have one, so this must be called
+// before the response is written.
+func (d *Domain) CSRFToken(
+	w http.ResponseWriter,
+	r *http.Request) (string, error) {
+	n := ""
+	if c, err := r.Cookie(csrfCookie); err == nil {
+		n = c.Value
+	}
+	if n == "" {
+		b := make([]byte, 16)
+		_, err := rand.Read(b)
+		if err != nil {
+			return "", err
+		}
+		n = base64.RawURLEncoding.EncodeToString(b)
+		http.SetCookie(w, &http.Cookie{
+			Name:     csrfCookie,
+			Value:    n,
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   d.Config.Scheme == "https",
+			SameSite: http.SameSiteLaxMode})
+	}
+	e := strconv.FormatInt(time.Now().Add(csrfTimeout).Unix(), 10)
+	return e + "." + d.csrfSignature(n, e), nil
+}
+
+// VerifyCSRF returns an error if the request does not contain a CSRF token
+// created by CSRFToken for this domain and browser, or if the token has
+// expired.
+func (d *Domain) VerifyCSRF(r *http.Request) error {
+	c, err := r.Cookie(csrfCookie)
+	if err != nil || c.Value == "" {
+		return fmt.Errorf("CSRF cookie missing")
+	}
+	p := strings.SplitN(r.Form.Get(CSRFField), ".", 2)
+	if len(p) != 2 {
+		return fmt.Errorf("CSRF token missing")
+	}
+	e, err := strconv.ParseInt(p[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("CSRF token invalid")
+	}
+	if time.Now().Unix() > e {
+		return fmt.Errorf("CSRF token expired")
+	}
+	if hmac.Equal(
+		[]byte(p[1]),
+		[]byte(d.csrfSignature(c.Value, p[0]))) == false {
+		return fmt.Errorf("CSRF token invalid")
+	}
+	return nil
+}
+
+// csrfSignature returns the signature for the nonce from the cookie and the
+// expiry time using the CSRF key from the configuration.
+func (d *Domain) csrfSignature(nonce string, expires string) string {
+	m := hmac.New(sha256.New, d.Config.csrfKey)
+	m.Write([]byte(d.Host + "|" + nonce + "|" + expires))
+	return base64.RawURLEncoding.EncodeToString(m.Sum(nil))
+}
+
+// newCSRFKey returns the key used to sign CSRF tokens. If a secret is not
+// provided in the settings then a random key is used and tokens will not be
+// valid after the server restarts.
+func newCSRFKey(secret string) ([]byte, error) {
+	if secret != "" {
+		return []byte(secret), nil
+	}
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
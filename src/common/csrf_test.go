@@ -0,0 +1,119 @@
+/* ****************************************************************************
+ * Copyright 2020 51 Degrees Mobile Experts Limited (51degrees.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations
+ * under the License.
+ * ***************************************************************************/
+
+package common
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newCSRFRequest returns a posted form with the token and, if the cookie is
+// not empty, the CSRF cookie.
+func newCSRFRequest(t *testing.T, token string, cookie string) *http.Request {
+	f := url.Values{}
+	if token != "" {
+		f.Set(CSRFField, token)
+	}
+	r := httptest.NewRequest("POST", "/", strings.NewReader(f.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if cookie != "" {
+		r.AddCookie(&http.Cookie{Name: csrfCookie, Value: cookie})
+	}
+	err := r.ParseForm()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestVerifyCSRF(t *testing.T) {
+	c := &Configuration{csrfKey: []byte("test key")}
+	d := &Domain{Host: "cmp.example", Config: c}
+	o := &Domain{Host: "other.example", Config: c}
+
+	// Get a token and the cookie it is bound to.
+	w := httptest.NewRecorder()
+	k, err := d.CSRFToken(w, httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n string
+	for _, i := range w.Result().Cookies() {
+		if i.Name == csrfCookie {
+			n = i.Value
+		}
+	}
+	if n == "" {
+		t.Fatal("CSRF cookie not set")
+	}
+
+	// Tokens for another domain, a changed expiry time, and an expired time
+	// with a valid signature.
+	other, err := o.CSRFToken(httptest.NewRecorder(), newCSRFRequest(t, "", n))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := strings.SplitN(k, ".", 2)
+	later := strconv.FormatInt(time.Now().Add(2*csrfTimeout).Unix(), 10)
+	past := strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10)
+
+	tests := []struct {
+		name   string
+		token  string
+		cookie string
+		valid  bool
+	}{
+		{"valid", k, n, true},
+		{"no cookie", k, "", false},
+		{"other cookie", k, "other", false},
+		{"no token", "", n, false},
+		{"no signature", p[0], n, false},
+		{"not a time", "soon." + p[1], n, false},
+		{"other domain", other, n, false},
+		{"changed expiry", later + "." + p[1], n, false},
+		{"changed signature", p[0] + "." + p[1] + "x", n, false},
+		{"expired", past + "." + d.csrfSignature(n, past), n, false},
+	}
+	for _, v := range tests {
+		err := d.VerifyCSRF(newCSRFRequest(t, v.token, v.cookie))
+		if v.valid && err != nil {
+			t.Errorf("%s: refused: %s", v.name, err)
+		}
+		if v.valid == false && err == nil {
+			t.Errorf("%s: allowed", v.name)
+		}
+	}
+}
+
+func TestCSRFTokenReusesCookie(t *testing.T) {
+	d := &Domain{
+		Host:   "cmp.example",
+		Config: &Configuration{csrfKey: []byte("test key")}}
+	w := httptest.NewRecorder()
+	_, err := d.CSRFToken(w, newCSRFRequest(t, "", "existing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(w.Result().Cookies()) != 0 {
+		t.Error("CSRF cookie replaced")
+	}
+}
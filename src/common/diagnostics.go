@@ -0,0 +1,309 @@
+/* ****************************************************************************
+ * Copyright 2020 51 Degrees Mobile Experts Limited (51degrees.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations
+ * under the License.
+ * ***************************************************************************/
+
+package common
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// reachTimeout is how long to wait for a supplier, access node or CMP to
+// respond when checking it can be reached.
+const reachTimeout = 3 * time.Second
+
+// Diagnostics is the status of the server and each of its domains.
+type Diagnostics struct {
+	Ready       bool                 `json:"ready"`       // True if the server is ready to handle requests
+	Scheme      string               `json:"scheme"`      // The scheme used for requests
+	Email       *EmailDiagnostics    `json:"email"`       // How email is delivered
+	FiftyOneD   bool                 `json:"51Degrees"`   // True if 51Degrees crawler detection is enabled
+	Domains     []*DomainDiagnostics `json:"domains"`     // Status of each domain
+	Unreachable []string             `json:"unreachable"` // Hosts that could not be reached
+	Reload      *ReloadStatus        `json:"reload"`      // Last reload of the domains, or null
+}
+
+// EmailDiagnostics is the configuration of the email delivery.
+type EmailDiagnostics struct {
+	Mailer   string `json:"mailer"`             // sink, smtp or none
+	Security string `json:"security,omitempty"` // Security used with the SMTP server
+	Pending  int    `json:"pending"`            // Messages waiting in the outbox
+	Problem  string `json:"problem,omitempty"`  // Reason email can't be sent
+}
+
+// DomainDiagnostics is the status of a single domain.
+type DomainDiagnostics struct {
+	Host      string          `json:"host"`               // The host name for the domain
+	Category  string          `json:"category"`           // Category of the domain
+	Problems  []string        `json:"problems,omitempty"` // Configuration problems
+	Creator   string          `json:"creator"`            // OWID creator status
+	Templates []string        `json:"templates"`          // HTML templates found
+	Reachable map[string]bool `json:"reachable"`          // Suppliers, access node and CMP
+}
+
+// HandlerLive responds with 200 while the server process is running so that
+// container orchestration only restarts it when it stops responding.
+func HandlerLive(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write([]byte("ok"))
+}
+
+// HandlerDiagnostics returns a handler that responds with the diagnostics
+// for the server as JSON. If access keys are configured then one of them must
+// be provided in the accessKey parameter.
+func HandlerDiagnostics(c *Configuration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if c.validAccessKey(r.FormValue("accessKey")) == false {
+			ReturnStatusCodeError(
+				c,
+				w,
+				r,
+				errors.New("Access key missing or invalid"),
+				http.StatusUnauthorized)
+			return
+		}
+		b, err := json.MarshalIndent(c.Diagnostics(), "", "  ")
+		if err != nil {
+			ReturnServerError(c, w, r, err)
+			return
+		}
+		g := gzip.NewWriter(w)
+		defer g.Close()
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-cache")
+		_, err = g.Write(b)
+		if err != nil {
+			ReturnServerError(c, w, r, err)
+			return
+		}
+	}
+}
+
+// Diagnostics returns the status of the server and each of its domains. The
+// suppliers, access nodes and CMPs of the domains are checked concurrently.
+func (c *Configuration) Diagnostics() *Diagnostics {
+	var v Diagnostics
+	v.Ready = IsReady()
+	v.Scheme = c.Scheme
+	v.Email = c.emailDiagnostics()
+	v.FiftyOneD = c.FODResourceKey != ""
+	v.Reload = c.Reload()
+	r := c.reachable()
+	for h, ok := range r {
+		if ok == false {
+			v.Unreachable = append(v.Unreachable, h)
+		}
+	}
+	sort.Strings(v.Unreachable)
+	for _, d := range c.Domains() {
+		i := DomainDiagnostics{
+			Host:      d.Host,
+			Category:  d.Category,
+			Problems:  d.Problems(),
+			Templates: d.Templates(),
+			Reachable: make(map[string]bool)}
+		_, err := d.GetOWIDCreator()
+		if err != nil {
+			i.Creator = err.Error()
+		} else {
+			i.Creator = "registered"
+		}
+		for _, h := range d.dependencies() {
+			i.Reachable[h] = r[h]
+		}
+		v.Domains = append(v.Domains, &i)
+	}
+	return &v
+}
+
+// Problems returns the configuration problems with the domain, or nil if
+// there are none.
+func (d *Domain) Problems() []string {
+	return d.problems(d.Config.Routes())
+}
+
+// DomainProblems returns the problems with the domains, each starting with
+// the host, as they would be if the domains replaced the current ones. An
+// error is returned if the domains can't be routed.
+func (c *Configuration) DomainProblems(domains []*Domain) ([]string, error) {
+	t, err := NewRoutes(domains, c.DefaultDomain)
+	if err != nil {
+		return nil, err
+	}
+	var p []string
+	for _, d := range domains {
+		for _, v := range d.problems(t) {
+			p = append(p, fmt.Sprintf("%s: %s", d.Host, v))
+		}
+	}
+	return p, nil
+}
+
+// problems returns the configuration problems with the domain when the other
+// domains are found with the routes provided.
+func (d *Domain) problems(t *Routes) []string {
+	var p []string
+	if d.Name == "" {
+		p = append(p, "name is not set")
+	}
+	if d.SWANAccessKey != "" &&
+		d.Config.validAccessKey(d.SWANAccessKey) == false {
+		p = append(p, fmt.Sprintf(
+			"SWANAccessKey '%s' is not one of the accessKeys",
+			d.SWANAccessKey))
+	}
+	switch d.Category {
+	case "CMP":
+		if d.SWANAccessNode == "" {
+			p = append(p, "SWANAccessNode is not set")
+		}
+		if d.SWANAccessKey == "" {
+			p = append(p, "SWANAccessKey is not set")
+		}
+		break
+	case "Publisher":
+		if d.CMP == "" {
+			p = append(p, "CMP is not set")
+		} else if cmp := t.Find(d.CMP); cmp == nil {
+			p = append(p, fmt.Sprintf("CMP '%s' is not a domain", d.CMP))
+		} else if cmp.Category != "CMP" {
+			p = append(p, fmt.Sprintf("CMP '%s' is a %s", d.CMP, cmp.Category))
+		}
+		break
+	}
+	for _, s := range d.Suppliers {
+		if t.Find(s) == nil {
+			p = append(p, fmt.Sprintf("Supplier '%s' is not a domain", s))
+		}
+	}
+	if d.Language != "" {
+		if _, ok := d.catalogues[strings.ToLower(d.Language)]; ok == false {
+			p = append(p, fmt.Sprintf(
+				"No messages.%s.json for language '%s'",
+				strings.ToLower(d.Language),
+				d.Language))
+		}
+	}
+	if d.templates == nil {
+		p = append(p, "No HTML templates")
+	}
+	return p
+}
+
+// Templates returns the names of the HTML templates available to the domain.
+func (d *Domain) Templates() []string {
+	var n []string
+	if d.templates != nil {
+		for _, t := range d.templates.Templates() {
+			n = append(n, t.Name())
+		}
+	}
+	sort.Strings(n)
+	return n
+}
+
+// dependencies returns the hosts the domain sends requests to.
+func (d *Domain) dependencies() []string {
+	var h []string
+	h = append(h, d.Suppliers...)
+	if d.SWANAccessNode != "" {
+		h = append(h, d.SWANAccessNode)
+	}
+	if d.CMP != "" {
+		h = append(h, d.CMP)
+	}
+	return h
+}
+
+// reachable returns a map of the hosts the domains depend on to true if the
+// host responded to a request.
+func (c *Configuration) reachable() map[string]bool {
+	r := make(map[string]bool)
+	for _, d := range c.Domains() {
+		for _, h := range d.dependencies() {
+			r[h] = false
+		}
+	}
+	var m sync.Mutex
+	var w sync.WaitGroup
+	t := &http.Client{
+		Timeout: reachTimeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}}
+	for h := range r {
+		w.Add(1)
+		go func(h string) {
+			defer w.Done()
+			s, err := t.Head(c.Scheme + "://" + h + "/")
+			if err == nil {
+				s.Body.Close()
+			}
+			m.Lock()
+			r[h] = err == nil
+			m.Unlock()
+		}(h)
+	}
+	w.Wait()
+	return r
+}
+
+// emailDiagnostics returns how email is delivered.
+func (c *Configuration) emailDiagnostics() *EmailDiagnostics {
+	var e EmailDiagnostics
+	o := c.Outbox()
+	e.Pending = o.Pending()
+	switch m := o.Mailer().(type) {
+	case *MailSink:
+		e.Mailer = "sink"
+		break
+	case *SMTP:
+		e.Mailer = "smtp"
+		e.Security = m.Security
+		break
+	default:
+		e.Mailer = "none"
+		err := canSend(NewSMTP(c))
+		if err != nil {
+			e.Problem = err.Error()
+		}
+		break
+	}
+	return &e
+}
+
+// validAccessKey returns true if the key is one of the access keys, or if no
+// access keys are configured.
+func (c *Configuration) validAccessKey(key string) bool {
+	if len(c.AccessKeys) == 0 {
+		return true
+	}
+	for _, k := range c.AccessKeys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
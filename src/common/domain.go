@@ -46,14 +46,17 @@ type Domain struct {
 	SwanJavaScript           bool   // True to use JavaScript responses rather than HTML documents
 	SwanNodeCount            int    // The number of SWAN nodes to use for operations
 	CmpNodeCount             int    // The number of nodes to visit when accessing the CMP
+	Language                 string // Default language for the domain's text, e.g. es
+	LogLevel                 string // Log level for the domain if different to the server
 	// The domain of the access node used with SWAN (only set for CMPs)
 	SWANAccessNode string
 	SWANAccessKey  string // The access key to use when communicating with SWAN.
 	// The domain of the CMP that will in turn access the SWAN Network via an Operator
 	CMP       string
 	Suppliers []string           // Suppliers used by the domain operator
+	Aliases   []string           // Other hosts, or wildcards like *.example.com, for the domain
 	Adverts   []Advert           // Adverts the domain can serve
-	Config    *Configuration     // Configuration for the server
+	Config    *Configuration     `json:"-"` // Configuration for the server
 	folder    string             // Location of the directory
 	templates *template.Template // HTML templates
 	owid      *owid.Creator      // The OWID creator associated with the domain if any
@@ -61,6 +64,9 @@ type Domain struct {
 	swan      *swan.Connection   // The connection to SWAN
 	// The HTTP handler to use for this domain
 	handler func(d *Domain, w http.ResponseWriter, r *http.Request)
+	// Translations from the messages.[language].json files keyed on language
+	catalogues map[string]map[string]string
+	logger     *Logger // Logger with the domain's host and category
 }
 
 // GetConfig returns the configuration from the folder, or nil if the
@@ -82,7 +88,11 @@ func NewDomain(
 	var d Domain
 	defer configFile.Close()
 	jsonParser := json.NewDecoder(configFile)
-	jsonParser.Decode(&d)
+	jsonParser.DisallowUnknownFields()
+	err = jsonParser.Decode(&d)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", configFile.Name(), err)
+	}
 
 	// Add some additional parameters.
 	d.Config = c
@@ -92,6 +102,18 @@ func NewDomain(
 	if err != nil {
 		return nil, err
 	}
+	d.catalogues, err = d.parseMessages()
+	if err != nil {
+		return nil, err
+	}
+	d.logger = Log.With("host", d.Host, "category", d.Category)
+	if d.LogLevel != "" {
+		l, err := ParseLevel(d.LogLevel)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", d.Host, err)
+		}
+		d.logger = d.logger.WithLevel(l)
+	}
 	d.owidStore = c.owid
 	d.swan = swan.NewConnection(swan.Operation{
 		Client: swan.Client{
@@ -141,6 +163,32 @@ func (d *Domain) LookupHTML(p string) *template.Template {
 	return t
 }
 
+// LookupHTMLWithDefault returns the first of the named templates available to
+// the domain, or the default template provided if none of them are available.
+// Unlike LookupHTML the category and default.html templates are not used.
+func (d *Domain) LookupHTMLWithDefault(
+	def *template.Template,
+	names ...string) *template.Template {
+	if d.templates != nil {
+		for _, n := range names {
+			t := d.templates.Lookup(n)
+			if t != nil {
+				return t
+			}
+		}
+	}
+	return def
+}
+
+// Logger returns the logger for the domain. Use LoggerFrom with the request
+// context when handling a request to include the request ID.
+func (d *Domain) Logger() *Logger {
+	if d.logger == nil {
+		return Log
+	}
+	return d.logger
+}
+
 func (d *Domain) SWAN() *swan.Connection {
 	return d.swan
 }
@@ -165,7 +213,9 @@ func (d *Domain) GetOWIDCreator() (*owid.Creator, error) {
 	return d.owid, nil
 }
 
-func infoRole(s interface{}) string {
+// Role returns Bid, Empty, Failed or ID for the SWAN data structure provided, or
+// an empty string if the structure is not known.
+func Role(s interface{}) string {
 	_, fok := s.(*swan.Failed)
 	_, bok := s.(*swan.Bid)
 	_, eok := s.(*swan.Empty)
@@ -199,14 +249,14 @@ func (d *Domain) parseHTML() (*template.Template, error) {
 			}
 			if t == nil {
 				t, err = template.New(file.Name()).Funcs(
-					template.FuncMap{"role": infoRole}).Parse(
+					TemplateFuncs(d.Config)).Parse(
 					string(s))
 				if err != nil {
 					return nil, err
 				}
 			} else {
 				t, err = t.New(file.Name()).Funcs(
-					template.FuncMap{"role": infoRole}).Parse(
+					TemplateFuncs(d.Config)).Parse(
 					string(s))
 				if err != nil {
 					return nil, err
@@ -29,25 +29,25 @@ func handlerCreateOWID(
 	r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
-		ReturnServerError(d.Config, w, err)
+		ReturnServerError(d.Config, w, r, err)
 		return
 	}
 
 	// Get the OWID creator for this domain.
 	oc, err := d.GetOWIDCreator()
 	if err != nil {
-		ReturnServerError(d.Config, w, err)
+		ReturnServerError(d.Config, w, r, err)
 	}
 
 	ot, err := decodeOthers(r.Form["others"])
 	if err != nil {
-		ReturnServerError(d.Config, w, err)
+		ReturnServerError(d.Config, w, r, err)
 	}
 
 	// Create and sign the OWID for this domain.
 	o, err := oc.CreateOWIDandSign([]byte(r.Form.Get("payload")), ot...)
 	if err != nil {
-		ReturnServerError(d.Config, w, err)
+		ReturnServerError(d.Config, w, r, err)
 	}
 
 	// Return the OWID as a base 64 string.
@@ -59,7 +59,7 @@ func handlerCreateOWID(
 	w.Header().Set("Cache-Control", "no-cache")
 	_, err = g.Write([]byte(o.AsString()))
 	if err != nil {
-		ReturnServerError(d.Config, w, err)
+		ReturnServerError(d.Config, w, r, err)
 		return
 	}
 }
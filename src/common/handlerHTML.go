@@ -23,7 +23,8 @@ import (
 	"swan"
 )
 
-// HandlerHTML returns HTML that does not require a model for the template.
+// HandlerHTML returns HTML that only requires the common page model for the
+// template.
 func HandlerHTML(d *Domain, w http.ResponseWriter, r *http.Request) {
 
 	// If the request is for the OWID creator then direct to that handler.
@@ -45,14 +46,15 @@ func HandlerHTML(d *Domain, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Execute the template without a model.
+	// Execute the template with the page model. Templates use the functions
+	// from TemplateFuncs for anything else they need.
 	g := gzip.NewWriter(w)
 	defer g.Close()
 	w.Header().Set("Content-Encoding", "gzip")
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	w.Header().Set("Cache-Control", "no-cache")
-	err := t.Execute(g, nil)
+	err := t.Execute(g, &PageModel{Domain: d, Request: r})
 	if err != nil {
-		ReturnServerError(d.Config, w, &swan.Error{err, nil})
+		ReturnServerError(d.Config, w, r, &swan.Error{err, nil})
 	}
 }
@@ -22,9 +22,18 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"swan"
 	"swift"
+	"time"
 )
 
+// swanTimeout is how long to wait for the SWAN access node to respond.
+const swanTimeout = 30 * time.Second
+
+// swanClient is used for requests to the SWAN access nodes so that a node that
+// can't be reached doesn't hold up the request indefinitely.
+var swanClient = &http.Client{Timeout: swanTimeout}
+
 // handlerProxy takes an incoming request, adds the access key to the parameters
 // and then passes on the result to the SWAN access node.
 func handlerSWANProxy(
@@ -34,7 +43,7 @@ func handlerSWANProxy(
 
 	err := r.ParseForm()
 	if err != nil {
-		ReturnServerError(d.Config, w, err)
+		ReturnServerError(d.Config, w, r, err)
 		return
 	}
 
@@ -50,17 +59,35 @@ func handlerSWANProxy(
 	// Add any additional parameters that might be important from HTTP headers.
 	swift.SetHomeNodeHeaders(r, &r.Form)
 
-	// Post the data to the SWAN endpoint.
-	res, err := http.PostForm(u.String(), r.Form)
+	// Post the data to the SWAN endpoint continuing the trace.
+	ctx, sp := StartSpan(r.Context(), d, "swan proxy", SpanClient)
+	defer sp.End()
+	sp.SetAttribute("peer.host", d.SWANAccessNode)
+	q, err := http.NewRequest(
+		"POST",
+		u.String(),
+		strings.NewReader(r.Form.Encode()))
+	if err != nil {
+		ReturnServerError(d.Config, w, r, err)
+		return
+	}
+	q.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	InjectTrace(ctx, q)
+	s := time.Now()
+	res, err := swanClient.Do(q)
 	if err != nil {
-		ReturnServerError(d.Config, w, err)
+		SWANDuration.ObserveSince(s, d.Host, "proxy", "error")
+		sp.SetError(err)
+		ReturnServerError(d.Config, w, r, err)
+		return
 	}
+	SWANDuration.ObserveSince(s, d.Host, "proxy", "ok")
 
 	// Get the body.
 	defer res.Body.Close()
 	b, err := ioutil.ReadAll(res.Body)
 	if err != nil {
-		ReturnServerError(d.Config, w, err)
+		ReturnServerError(d.Config, w, r, err)
 	}
 
 	// Return the OWID as a base 64 string.
@@ -72,7 +99,59 @@ func handlerSWANProxy(
 	w.Header().Set("Cache-Control", "no-cache")
 	_, err = g.Write(b)
 	if err != nil {
-		ReturnServerError(d.Config, w, err)
+		ReturnServerError(d.Config, w, r, err)
 		return
 	}
 }
+
+// PostSWAN posts the values with the access key added to the path of the
+// domain's SWAN access node and returns the response body. Used for operations
+// the SWAN package does not provide. The call is traced in the same way as
+// TraceSWANURL and the duration recorded against the operation.
+func PostSWAN(
+	w http.ResponseWriter,
+	r *http.Request,
+	d *Domain,
+	operation string,
+	path string,
+	q url.Values) (string, *swan.Error) {
+	ctx, sp := StartSpan(r.Context(), d, "swan "+operation, SpanClient)
+	defer sp.End()
+	sp.SetAttribute("peer.host", d.SWANAccessNode)
+
+	var u url.URL
+	u.Scheme = d.Config.Scheme
+	u.Host = d.SWANAccessNode
+	u.Path = path
+	q.Set("accessKey", d.SWANAccessKey)
+	p, err := http.NewRequest("POST", u.String(), strings.NewReader(q.Encode()))
+	if err != nil {
+		sp.SetError(err)
+		return "", &swan.Error{Err: err}
+	}
+	p.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	InjectTrace(ctx, p)
+	s := time.Now()
+	res, err := swanClient.Do(p)
+	if err != nil {
+		SWANDuration.ObserveSince(s, d.Host, operation, "error")
+		sp.SetError(err)
+		return "", &swan.Error{Err: err}
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		SWANDuration.ObserveSince(s, d.Host, operation, "status")
+		e := NewError(d.Config, res)
+		sp.SetError(e)
+		return "", e
+	}
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		SWANDuration.ObserveSince(s, d.Host, operation, "error")
+		sp.SetError(err)
+		return "", &swan.Error{Err: err}
+	}
+	SWANDuration.ObserveSince(s, d.Host, operation, "ok")
+	setTraceCookie(w, d, sp)
+	return string(b), nil
+}
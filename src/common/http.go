@@ -19,52 +19,90 @@ package common
 import (
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"swan"
+	"time"
 )
 
-// Handler for all HTTP requests to domains controlled by the demo.
-func Handler(d []*Domain) http.HandlerFunc {
+// Handler for all HTTP requests to domains controlled by the demo. The routes
+// are read from the configuration for each request so that changes to the www
+// folder take effect without restarting.
+func Handler(c *Configuration) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		routes := c.Routes()
+
+		// r.Host may include the port number, www prefix or a trailing dot
+		// dependent on the environment. The routes ignore these.
+		domain := routes.Route(r.Host)
+		if domain == nil {
+			handlerUnknownHost(c, routes, w, r)
+			return
+		}
 
-		// Set to true if a domain is found and handled.
-		found := false
-
-		// r.Host may include the port number or www prefixes or other
-		// characters dependent on the environment. Using strings.Contains
-		// rather than testing for equality eliminates these issues for a demo
-		// where the domain names are not sub strings of one another.
-		for _, domain := range d {
-			if strings.EqualFold(r.Host, domain.Host) {
-
-				// Try static resources first.
-				f, err := handlerStatic(domain, w, r)
-				if err != nil {
-					ReturnServerError(domain.Config, w, err)
-					return
-				}
-
-				// If not found then use the domain handler.
-				if f == false {
-					domain.handler(domain, w, r)
-				}
-
-				// Mark as the domain being found and then break.
-				found = true
-				break
-			}
+		// Record the status code for the request metrics and trace.
+		s := time.Now()
+		m := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+
+		// Try static resources first.
+		f, err := handlerStatic(domain, m, r)
+		if err != nil {
+			ReturnServerError(domain.Config, m, r, err)
+			observeRequest(domain, "static", m.status, s)
+			return
 		}
 
-		// All handlers have been tried and nothing has been found. Return not
-		// found.
-		if found == false {
-			http.NotFound(w, r)
+		// If not found then use the domain handler with a span and a logger
+		// for the request.
+		if f == false {
+			n := handlerName(r.URL.Path)
+			t, p := startServerSpan(m, r, domain, domain.Host+" "+n)
+			l := domain.Logger().With(
+				"request_id", requestID(m, r),
+				"operation", n,
+				"trace_id", p.TraceID)
+			t = t.WithContext(WithLogger(t.Context(), l))
+			domain.handler(domain, m, t)
+			endServerSpan(p, m)
+			observeRequest(domain, n, m.status, s)
+			logRequest(l, r, m.status, s)
+		} else {
+			observeRequest(domain, "static", m.status, s)
 		}
 	}
 }
 
+// requestID returns the X-Request-Id header from the request if it has one, or
+// a new random ID, and adds it to the response.
+func requestID(w http.ResponseWriter, r *http.Request) string {
+	id := r.Header.Get("X-Request-Id")
+	if id == "" || len(id) > 64 {
+		id = newTraceID(8)
+	}
+	w.Header().Set("X-Request-Id", id)
+	return id
+}
+
+// logRequest writes a line for the completed request at the info level, or
+// warn or error if the status code indicates a failure.
+func logRequest(l *Logger, r *http.Request, status int, s time.Time) {
+	kv := []interface{}{
+		"method", r.Method,
+		"path", cleanPath(r.URL.Path),
+		"status", status,
+		"duration_ms", time.Since(s).Milliseconds()}
+	if status >= 500 {
+		l.Error("request", kv...)
+	} else if status >= 400 {
+		l.Warn("request", kv...)
+	} else {
+		l.Info("request", kv...)
+	}
+}
+
 // NewError creates an error instance that includes the details of the
 // response returned. This is needed to pass the correct status codes and
 // context back to the caller.
@@ -89,37 +127,60 @@ func NewError(c *Configuration, r *http.Response) *swan.Error {
 
 // ReturnProxyError returns an error where the request is related to a proxy
 // request being passed to another end point.
-func ReturnProxyError(c *Configuration, w http.ResponseWriter, e *swan.Error) {
+func ReturnProxyError(
+	c *Configuration,
+	w http.ResponseWriter,
+	r *http.Request,
+	e *swan.Error) {
 	s := http.StatusInternalServerError
 	if e.Response != nil {
 		s = e.Response.StatusCode
 	}
-	ReturnStatusCodeError(c, w, e.Err, s)
+	ReturnStatusCodeError(c, w, r, e.Err, s)
 }
 
 // ReturnServerError returns an internal server error.
-func ReturnServerError(c *Configuration, w http.ResponseWriter, err error) {
-	ReturnStatusCodeError(c, w, err, http.StatusInternalServerError)
+func ReturnServerError(
+	c *Configuration,
+	w http.ResponseWriter,
+	r *http.Request,
+	err error) {
+	ReturnStatusCodeError(c, w, r, err, http.StatusInternalServerError)
 }
 
-// ReturnStatusCodeError returns the HTTP status code specified.
+// ReturnStatusCodeError returns the HTTP status code specified. The error is
+// logged with the request's logger so that it has the request ID.
 func ReturnStatusCodeError(
 	c *Configuration,
 	w http.ResponseWriter,
+	r *http.Request,
 	e error,
 	code int) {
 	http.Error(w, e.Error(), code)
-	if c.Debug {
-		println(e.Error())
+	LoggerFrom(r.Context()).Debug("error returned", "status", code, "error", e)
+}
+
+// RequestHost returns the host of the domain the request was routed to with
+// the port from the Host header if it has a valid one. The host name is not
+// taken from the header as it could be any value if there is a default domain,
+// but the routes ignore the port so the server can listen on any port.
+func RequestHost(d *Domain, r *http.Request) string {
+	_, p, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		return d.Host
 	}
+	if n, err := strconv.Atoi(p); err != nil || n <= 0 || n > 65535 {
+		return d.Host
+	}
+	return net.JoinHostPort(d.Host, p)
 }
 
 // GetCleanURL returns a URL with the SWAN data removed and no query string
-// parameters.
-func GetCleanURL(c *Configuration, r *http.Request) *url.URL {
+// parameters. The host is from RequestHost.
+func GetCleanURL(d *Domain, r *http.Request) *url.URL {
 	var u url.URL
-	u.Scheme = c.Scheme
-	u.Host = r.Host
+	u.Scheme = d.Config.Scheme
+	u.Host = RequestHost(d, r)
 	u.Path = strings.ReplaceAll(
 		r.URL.Path,
 		GetSWANDataFromRequest(r),
@@ -128,28 +189,58 @@ func GetCleanURL(c *Configuration, r *http.Request) *url.URL {
 	return &u
 }
 
-// GetReturnURL returns a parsed URL from the query string, or if not present
-// from the referer HTTP header.
-func GetReturnURL(r *http.Request) (*url.URL, error) {
-	u, err := url.Parse(r.Form.Get("returnUrl"))
+// ClientIP returns the IP address of the web browser. The X-Forwarded-For
+// header is only used if the request came from one of the trustedProxies in
+// the configuration as anyone else could have set it. The addresses in the
+// header are then read from the last, skipping other trusted proxies, as
+// earlier addresses could have been set by the browser.
+func ClientIP(c *Configuration, r *http.Request) string {
+	h, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
-		return nil, err
+		h = r.RemoteAddr
 	}
-	if u == nil || u.String() == "" {
-		u, err = url.Parse(r.Header.Get("Referer"))
-		if err != nil {
-			return nil, err
+	if c.isTrustedProxy(h) == false {
+		return h
+	}
+	f := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(f) - 1; i >= 0; i-- {
+		a := strings.TrimSpace(f[i])
+		if a == "" {
+			break
+		}
+		h = a
+		if c.isTrustedProxy(a) == false {
+			break
 		}
 	}
-	u.RawQuery = ""
-	return u, nil
+	return h
+}
+
+// isTrustedProxy returns true if the IP address is one of the trustedProxies
+// in the configuration.
+func (c *Configuration) isTrustedProxy(ip string) bool {
+	a := net.ParseIP(ip)
+	if a == nil {
+		return false
+	}
+	for _, p := range c.TrustedProxies {
+		if _, n, err := net.ParseCIDR(p); err == nil {
+			if n.Contains(a) {
+				return true
+			}
+		} else if t := net.ParseIP(p); t != nil && t.Equal(a) {
+			return true
+		}
+	}
+	return false
 }
 
-// GetCurrentPage returns the current request URL.
-func GetCurrentPage(c *Configuration, r *http.Request) *url.URL {
+// GetCurrentPage returns the current request URL with the host from
+// RequestHost.
+func GetCurrentPage(d *Domain, r *http.Request) *url.URL {
 	var u url.URL
-	u.Scheme = c.Scheme
-	u.Host = r.Host
+	u.Scheme = d.Config.Scheme
+	u.Host = RequestHost(d, r)
 	u.Path = r.URL.Path
 	return &u
 }
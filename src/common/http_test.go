@@ -0,0 +1,62 @@
+/* ****************************************************************************
+ * Copyright 2020 51 Degrees Mobile Experts Limited (51degrees.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations
+ * under the License.
+ * ***************************************************************************/
+
+package common
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestHost(t *testing.T) {
+	d := &Domain{Host: "swan-demo.uk", Config: &Configuration{Scheme: "http"}}
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"swan-demo.uk", "swan-demo.uk"},
+		{"WWW.Swan-Demo.uk:5000", "swan-demo.uk:5000"},
+		{"swan-demo.uk:443", "swan-demo.uk:443"},
+		{"evil.com", "swan-demo.uk"},
+		{"evil.com:8080", "swan-demo.uk:8080"},
+		{"swan-demo.uk:0", "swan-demo.uk"},
+		{"swan-demo.uk:70000", "swan-demo.uk"},
+		{"swan-demo.uk:80@evil.com", "swan-demo.uk"},
+		{"swan-demo.uk:", "swan-demo.uk"},
+		{"[::1]:5000", "swan-demo.uk:5000"},
+	}
+	for _, v := range tests {
+		r := httptest.NewRequest("GET", "/page", nil)
+		r.Host = v.host
+		if g := RequestHost(d, r); g != v.want {
+			t.Errorf("'%s' gave '%s' not '%s'", v.host, g, v.want)
+		}
+	}
+}
+
+func TestGetCleanURL(t *testing.T) {
+	d := &Domain{Host: "swan-demo.uk", Config: &Configuration{Scheme: "https"}}
+	r := httptest.NewRequest("GET", "/news/?a=1", nil)
+	r.Host = "evil.com:5000"
+	g := GetCleanURL(d, r).String()
+	if g != "https://swan-demo.uk:5000/news/" {
+		t.Errorf("clean URL '%s'", g)
+	}
+	g = GetCurrentPage(d, r).String()
+	if g != "https://swan-demo.uk:5000/news/" {
+		t.Errorf("current page '%s'", g)
+	}
+}
@@ -0,0 +1,88 @@
+/* ****************************************************************************
+ * Copyright 2020 51 Degrees Mobile Experts Limited (51degrees.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations
+ * under the License.
+ * ***************************************************************************/
+
+package common
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// ready is 1 once the server is ready to handle requests and 0 before then or
+// when the server is shutting down.
+var ready int32
+
+// shutdownHooks are called in reverse order when the server shuts down.
+var shutdownHooks []func(ctx context.Context) error
+var shutdownMutex sync.Mutex
+
+func init() {
+	NewGaugeFunc(
+		"swan_demo_ready",
+		"1 if the server is ready to handle requests, otherwise 0.",
+		func() float64 { return float64(atomic.LoadInt32(&ready)) })
+}
+
+// SetReady sets whether the server is ready to handle requests.
+func SetReady(r bool) {
+	var v int32
+	if r {
+		v = 1
+	}
+	atomic.StoreInt32(&ready, v)
+}
+
+// IsReady returns true if the server is ready to handle requests.
+func IsReady() bool { return atomic.LoadInt32(&ready) == 1 }
+
+// OnShutdown adds a function to call when the server shuts down. The function
+// should return when its work is done or the context is done.
+func OnShutdown(f func(ctx context.Context) error) {
+	shutdownMutex.Lock()
+	defer shutdownMutex.Unlock()
+	shutdownHooks = append(shutdownHooks, f)
+}
+
+// Shutdown calls the functions added with OnShutdown with the most recently
+// added first. Errors are logged and the remaining functions are still
+// called.
+func Shutdown(ctx context.Context) {
+	shutdownMutex.Lock()
+	h := shutdownHooks
+	shutdownHooks = nil
+	shutdownMutex.Unlock()
+	for i := len(h) - 1; i >= 0; i-- {
+		err := h[i](ctx)
+		if err != nil {
+			Log.Error("shutdown hook failed", "error", err)
+		}
+	}
+}
+
+// HandlerReady responds with 200 if the server is ready to handle requests,
+// otherwise 503 so that load balancers stop sending requests.
+func HandlerReady(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	if IsReady() {
+		w.Write([]byte("ready"))
+		return
+	}
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write([]byte("not ready"))
+}
@@ -0,0 +1,258 @@
+/* ****************************************************************************
+ * Copyright 2020 51 Degrees Mobile Experts Limited (51degrees.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations
+ * under the License.
+ * ***************************************************************************/
+
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level of a log line. Lines below the level of the logger are not written.
+type Level int
+
+// The log levels from the most to the least detailed.
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l >= LevelDebug && l <= LevelError {
+		return levelNames[l]
+	}
+	return fmt.Sprintf("%d", l)
+}
+
+// ParseLevel returns the level for the name which must be one of debug, info,
+// warn or error.
+func ParseLevel(s string) (Level, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(s, n) {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf(
+		"Log level '%s' invalid, use one of %s",
+		s,
+		strings.Join(levelNames, ", "))
+}
+
+// Formats for the log lines.
+const (
+	logFmt  = "logfmt" // key=value pairs separated by spaces
+	logJSON = "json"   // A JSON object on each line
+)
+
+// sensitiveKeys are the fields whose values are redacted unless the
+// logSensitive setting is true.
+var sensitiveKeys = map[string]bool{
+	"email":    true,
+	"salt":     true,
+	"owid":     true,
+	"swid":     true,
+	"body":     true,
+	"password": true}
+
+// redacted replaces the value of sensitive fields.
+const redacted = "[redacted]"
+
+// logOutput is where the log lines are written. The mutex stops lines from
+// different goroutines being interleaved.
+var logOutput io.Writer = os.Stderr
+var logMutex sync.Mutex
+
+// Logger writes structured log lines with the fields added to it.
+type Logger struct {
+	level     Level
+	format    string
+	sensitive bool          // True to log the values of sensitive fields
+	fields    []interface{} // Key value pairs added to each line
+}
+
+// Log is the logger for the server that is not specific to a domain or
+// request. It is configured from the application settings by NewConfig.
+var Log = &Logger{level: LevelInfo, format: logFmt}
+
+// newLogger returns a logger for the level, format and sensitive settings.
+// If debug is true and no level is provided then the debug level is used.
+func newLogger(
+	level string,
+	format string,
+	sensitive bool,
+	debug bool) (*Logger, error) {
+	l := Logger{level: LevelInfo, format: logFmt, sensitive: sensitive}
+	var err error
+	if level != "" {
+		l.level, err = ParseLevel(level)
+		if err != nil {
+			return nil, err
+		}
+	} else if debug {
+		l.level = LevelDebug
+	}
+	switch strings.ToLower(format) {
+	case "", logFmt:
+		break
+	case logJSON:
+		l.format = logJSON
+		break
+	default:
+		return nil, fmt.Errorf(
+			"Log format '%s' invalid, use %s or %s",
+			format,
+			logFmt,
+			logJSON)
+	}
+	return &l, nil
+}
+
+// With returns a logger that adds the key value pairs to each line.
+func (l *Logger) With(kv ...interface{}) *Logger {
+	n := *l
+	n.fields = append(append([]interface{}(nil), l.fields...), kv...)
+	return &n
+}
+
+// WithLevel returns a logger that writes lines at or above the level.
+func (l *Logger) WithLevel(level Level) *Logger {
+	n := *l
+	n.level = level
+	return &n
+}
+
+// Enabled returns true if lines at the level are written.
+func (l *Logger) Enabled(level Level) bool { return level >= l.level }
+
+// Debug writes the message and key value pairs at the debug level.
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.write(LevelDebug, msg, kv) }
+
+// Info writes the message and key value pairs at the info level.
+func (l *Logger) Info(msg string, kv ...interface{}) { l.write(LevelInfo, msg, kv) }
+
+// Warn writes the message and key value pairs at the warn level.
+func (l *Logger) Warn(msg string, kv ...interface{}) { l.write(LevelWarn, msg, kv) }
+
+// Error writes the message and key value pairs at the error level.
+func (l *Logger) Error(msg string, kv ...interface{}) { l.write(LevelError, msg, kv) }
+
+// loggerKey is used to store the logger for a request in its context.
+type loggerKey struct{}
+
+// WithLogger returns a context that contains the logger.
+func WithLogger(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// LoggerFrom returns the logger for the request from the context, or Log if
+// there isn't one.
+func LoggerFrom(ctx context.Context) *Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*Logger); ok {
+		return l
+	}
+	return Log
+}
+
+func (l *Logger) write(level Level, msg string, kv []interface{}) {
+	if l.Enabled(level) == false {
+		return
+	}
+	f := []interface{}{
+		"time", time.Now().UTC().Format(time.RFC3339Nano),
+		"level", level.String(),
+		"msg", msg}
+	f = append(f, l.fields...)
+	f = append(f, kv...)
+	var b bytes.Buffer
+	if l.format == logJSON {
+		b.WriteByte('{')
+	}
+	for i := 0; i < len(f); i += 2 {
+		k := fmt.Sprint(f[i])
+		var v interface{} = "(missing)"
+		if i+1 < len(f) {
+			v = l.value(k, f[i+1])
+		}
+		if l.format == logJSON {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			writeJSONField(&b, k, v)
+		} else {
+			if i > 0 {
+				b.WriteByte(' ')
+			}
+			writeLogfmtField(&b, k, v)
+		}
+	}
+	if l.format == logJSON {
+		b.WriteByte('}')
+	}
+	b.WriteByte('\n')
+	logMutex.Lock()
+	defer logMutex.Unlock()
+	logOutput.Write(b.Bytes())
+}
+
+// value returns the value to log for the key.
+func (l *Logger) value(k string, v interface{}) interface{} {
+	if l.sensitive == false && sensitiveKeys[k] {
+		return redacted
+	}
+	switch t := v.(type) {
+	case error:
+		return t.Error()
+	case time.Duration:
+		return t.String()
+	case fmt.Stringer:
+		return t.String()
+	}
+	return v
+}
+
+func writeJSONField(b *bytes.Buffer, k string, v interface{}) {
+	j, err := json.Marshal(k)
+	if err == nil {
+		b.Write(j)
+	}
+	b.WriteByte(':')
+	j, err = json.Marshal(v)
+	if err != nil {
+		j, _ = json.Marshal(fmt.Sprint(v))
+	}
+	b.Write(j)
+}
+
+func writeLogfmtField(b *bytes.Buffer, k string, v interface{}) {
+	b.WriteString(k)
+	b.WriteByte('=')
+	s := fmt.Sprint(v)
+	if s == "" || strings.ContainsAny(s, " =\"\t\r\n") {
+		s = fmt.Sprintf("%q", s)
+	}
+	b.WriteString(s)
+}
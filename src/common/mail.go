@@ -0,0 +1,151 @@
+/* ****************************************************************************
+ * Copyright 2020 51 Degrees Mobile Experts Limited (51degrees.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations
+ * under the License.
+ * ***************************************************************************/
+
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"html/template"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Mailer delivers email messages. SMTP sends them to a mail server and
+// MailSink keeps them in a folder for local development.
+type Mailer interface {
+	Deliver(m *MailMessage) error
+}
+
+// MailMessage is an email with text and HTML versions of the body.
+type MailMessage struct {
+	ID      string    `json:"id"`      // Unique ID also used for the Message-ID
+	Created time.Time `json:"created"` // When the message was created
+	From    string    `json:"from"`    // Sender set by the mailer if empty
+	To      string    `json:"to"`      // Recipient email address
+	Subject string    `json:"subject"` // Subject line
+	Text    string    `json:"text"`    // Plain text body
+	HTML    string    `json:"html"`    // HTML body
+}
+
+// Regular expressions used to turn the HTML body into text.
+var (
+	mailBlockTags = regexp.MustCompile(`(?i)<(br|/p|/div|/h[1-6]|/li|/tr)[^>]*>`)
+	mailTags      = regexp.MustCompile(`(?s)<(style|script)[^>]*>.*?</(style|script)>|<[^>]*>`)
+	mailSpaces    = regexp.MustCompile(`[ \t]+`)
+	mailLines     = regexp.MustCompile(`\n\s*\n\s*\n+`)
+)
+
+// NewMailMessage creates a message for the recipient where the HTML body is
+// the template executed with the data. The text body is created from the
+// HTML.
+func NewMailMessage(
+	to string,
+	subject string,
+	t *template.Template,
+	data interface{}) (*MailMessage, error) {
+	var b bytes.Buffer
+	err := t.Execute(&b, data)
+	if err != nil {
+		return nil, err
+	}
+	return &MailMessage{
+		ID:      uuid.New().String(),
+		Created: time.Now().UTC(),
+		To:      to,
+		Subject: subject,
+		Text:    htmlToText(b.String()),
+		HTML:    b.String()}, nil
+}
+
+// Bytes returns the message in the format sent to mail servers with the text
+// and HTML bodies as alternative parts. An error is returned if the addresses
+// contain line breaks that would add headers to the message.
+func (m *MailMessage) Bytes() ([]byte, error) {
+	if strings.ContainsAny(m.To, "\r\n") ||
+		strings.ContainsAny(m.From, "\r\n") {
+		return nil, fmt.Errorf("email address contains a line break")
+	}
+	var b bytes.Buffer
+	w := multipart.NewWriter(&b)
+	h := []string{
+		"From: " + m.From,
+		"To: " + m.To,
+		"Subject: " + mime.QEncoding.Encode("utf-8", m.Subject),
+		"Date: " + m.Created.Format(time.RFC1123Z),
+		fmt.Sprintf("Message-ID: <%s@%s>", m.ID, mailDomain(m.From)),
+		"MIME-Version: 1.0",
+		"Content-Type: multipart/alternative; boundary=" + w.Boundary()}
+	b.WriteString(strings.Join(h, "\r\n") + "\r\n\r\n")
+	err := writeMailPart(w, "text/plain", m.Text)
+	if err != nil {
+		return nil, err
+	}
+	err = writeMailPart(w, "text/html", m.HTML)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// writeMailPart adds a quoted printable part with the content type to the
+// multipart message.
+func writeMailPart(w *multipart.Writer, contentType string, s string) error {
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Type", contentType+"; charset=\"UTF-8\"")
+	h.Set("Content-Transfer-Encoding", "quoted-printable")
+	p, err := w.CreatePart(h)
+	if err != nil {
+		return err
+	}
+	q := quotedprintable.NewWriter(p)
+	_, err = q.Write([]byte(s))
+	if err != nil {
+		return err
+	}
+	return q.Close()
+}
+
+// mailDomain returns the domain of the email address or localhost.
+func mailDomain(a string) string {
+	i := strings.LastIndex(a, "@")
+	if i < 0 {
+		return "localhost"
+	}
+	return strings.Trim(a[i+1:], "> ")
+}
+
+// htmlToText returns a readable plain text version of the HTML.
+func htmlToText(s string) string {
+	s = mailBlockTags.ReplaceAllString(s, "$0\n")
+	s = mailTags.ReplaceAllString(s, "")
+	s = html.UnescapeString(s)
+	s = mailSpaces.ReplaceAllString(s, " ")
+	s = mailLines.ReplaceAllString(s, "\n\n")
+	return strings.TrimSpace(s)
+}
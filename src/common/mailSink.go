@@ -0,0 +1,145 @@
+/* ****************************************************************************
+ * Copyright 2020 51 Degrees Mobile Experts Limited (51degrees.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations
+ * under the License.
+ * ***************************************************************************/
+
+package common
+
+import (
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// mailSinkSender is used as the sender for messages written to the sink.
+const mailSinkSender = "swan-demo@localhost"
+
+// MailSink keeps messages in a maildir folder rather than sending them. Used
+// for local development where there is no mail server. Messages are written
+// to the tmp folder and then moved to the new folder so that mail clients
+// reading the folder never see part of a message.
+type MailSink struct {
+	Folder string // The maildir folder containing tmp, new and cur
+}
+
+// NewMailSink returns a sink for the folder creating the maildir folders if
+// they don't exist.
+func NewMailSink(folder string) (*MailSink, error) {
+	for _, f := range []string{"tmp", "new", "cur"} {
+		err := os.MkdirAll(filepath.Join(folder, f), 0700)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &MailSink{Folder: folder}, nil
+}
+
+// Deliver writes the message to the new folder.
+func (s *MailSink) Deliver(m *MailMessage) error {
+	if m.From == "" {
+		m.From = mailSinkSender
+	}
+	b, err := m.Bytes()
+	if err != nil {
+		return err
+	}
+	n := fmt.Sprintf("%d.%s.swan", m.Created.UnixNano(), m.ID)
+	t := filepath.Join(s.Folder, "tmp", n)
+	err = ioutil.WriteFile(t, b, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(t, filepath.Join(s.Folder, "new", n))
+}
+
+// Messages returns the messages in the new and cur folders with the most
+// recent first.
+func (s *MailSink) Messages() ([]*MailMessage, error) {
+	var l []*MailMessage
+	for _, f := range []string{"new", "cur"} {
+		files, err := ioutil.ReadDir(filepath.Join(s.Folder, f))
+		if err != nil {
+			return nil, err
+		}
+		for _, i := range files {
+			if i.IsDir() {
+				continue
+			}
+			m, err := readMailMessage(filepath.Join(s.Folder, f, i.Name()))
+			if err != nil {
+				return nil, err
+			}
+			l = append(l, m)
+		}
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].Created.After(l[j].Created) })
+	return l, nil
+}
+
+// readMailMessage reads the message from the file written by Deliver.
+func readMailMessage(file string) (*MailMessage, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, err := mail.ReadMessage(f)
+	if err != nil {
+		return nil, err
+	}
+	var m MailMessage
+	var d mime.WordDecoder
+	m.From = r.Header.Get("From")
+	m.To = r.Header.Get("To")
+	m.Subject, err = d.DecodeHeader(r.Header.Get("Subject"))
+	if err != nil {
+		return nil, err
+	}
+	m.ID = strings.Trim(r.Header.Get("Message-ID"), "<>")
+	m.Created, err = r.Header.Date()
+	if err != nil {
+		m.Created = time.Time{}
+	}
+
+	// Read the text and HTML parts. The multipart reader decodes the quoted
+	// printable content.
+	_, p, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	}
+	mr := multipart.NewReader(r.Body, p["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		b, err := ioutil.ReadAll(part)
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(part.Header.Get("Content-Type"), "text/html") {
+			m.HTML = string(b)
+		} else {
+			m.Text = string(b)
+		}
+	}
+	return &m, nil
+}
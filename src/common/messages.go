@@ -0,0 +1,171 @@
+/* ****************************************************************************
+ * Copyright 2020 51 Degrees Mobile Experts Limited (51degrees.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations
+ * under the License.
+ * ***************************************************************************/
+
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// defaultLanguage is used if the domain does not set a language.
+const defaultLanguage = "en"
+
+// Messages translates text into the language negotiated for a request. The
+// text in English is used as the key so that missing translations fall back to
+// English.
+type Messages struct {
+	Language  string            // The language the text is translated into
+	catalogue map[string]string // Translations keyed on the English text
+}
+
+// T returns the text translated into the language. If arguments are provided
+// then the translated text is used as the format for fmt.Sprintf.
+func (m *Messages) T(text string, args ...interface{}) string {
+	if m != nil {
+		if t, ok := m.catalogue[text]; ok && t != "" {
+			text = t
+		}
+	}
+	if len(args) > 0 {
+		return fmt.Sprintf(text, args...)
+	}
+	return text
+}
+
+// HTML returns the text translated into the language as HTML. The text and the
+// translations come from the domain folder and are trusted. Any arguments are
+// escaped before they are formatted into the text.
+func (m *Messages) HTML(text string, args ...interface{}) template.HTML {
+	e := make([]interface{}, len(args))
+	for i, a := range args {
+		e[i] = template.HTMLEscapeString(fmt.Sprint(a))
+	}
+	return template.HTML(m.T(text, e...))
+}
+
+// Messages returns the messages for the language that best matches the
+// Accept-Language header of the request. If the request is nil or no language
+// matches then the domain's default language is used.
+func (d *Domain) Messages(r *http.Request) *Messages {
+	l := d.defaultLanguage()
+	if r != nil {
+		l = d.negotiateLanguage(r.Header.Get("Accept-Language"), l)
+	}
+	return d.MessagesFor(l)
+}
+
+// MessagesFor returns the messages for the language provided.
+func (d *Domain) MessagesFor(language string) *Messages {
+	return &Messages{Language: language, catalogue: d.catalogues[language]}
+}
+
+func (d *Domain) defaultLanguage() string {
+	if d.Language != "" {
+		return strings.ToLower(d.Language)
+	}
+	return defaultLanguage
+}
+
+// negotiateLanguage returns the first language in the Accept-Language header,
+// in order of quality, that the domain has messages for. A language with a
+// region such as es-ES matches es if there are no messages for the region.
+func (d *Domain) negotiateLanguage(header string, def string) string {
+	for _, l := range parseAcceptLanguage(header) {
+		if l == def || d.catalogues[l] != nil {
+			return l
+		}
+		if i := strings.Index(l, "-"); i > 0 {
+			b := l[:i]
+			if b == def || d.catalogues[b] != nil {
+				return b
+			}
+		}
+	}
+	return def
+}
+
+// parseAcceptLanguage returns the languages in the header in lower case with
+// the highest quality first. Languages with a quality of zero are excluded.
+func parseAcceptLanguage(header string) []string {
+	type language struct {
+		tag     string
+		quality float64
+	}
+	var ls []language
+	for _, p := range strings.Split(header, ",") {
+		f := strings.Split(strings.TrimSpace(p), ";")
+		t := strings.ToLower(strings.TrimSpace(f[0]))
+		if t == "" || t == "*" {
+			continue
+		}
+		q := 1.0
+		for _, a := range f[1:] {
+			a = strings.TrimSpace(a)
+			if strings.HasPrefix(a, "q=") {
+				v, err := strconv.ParseFloat(a[2:], 64)
+				if err == nil {
+					q = v
+				}
+			}
+		}
+		if q > 0 {
+			ls = append(ls, language{t, q})
+		}
+	}
+	sort.SliceStable(ls, func(i, j int) bool {
+		return ls[i].quality > ls[j].quality
+	})
+	r := make([]string, len(ls))
+	for i, l := range ls {
+		r[i] = l.tag
+	}
+	return r
+}
+
+// parseMessages reads the messages.[language].json files in the domain folder.
+// Each file is a JSON object where the keys are the English text and the
+// values are the translations.
+func (d *Domain) parseMessages() (map[string]map[string]string, error) {
+	c := make(map[string]map[string]string)
+	files, err := filepath.Glob(filepath.Join(d.folder, "messages.*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		l := strings.TrimSuffix(
+			strings.TrimPrefix(filepath.Base(f), "messages."),
+			".json")
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		var m map[string]string
+		err = json.Unmarshal(b, &m)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", f, err)
+		}
+		c[strings.ToLower(l)] = m
+	}
+	return c, nil
+}
@@ -0,0 +1,395 @@
+/* ****************************************************************************
+ * Copyright 2020 51 Degrees Mobile Experts Limited (51degrees.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations
+ * under the License.
+ * ***************************************************************************/
+
+package common
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxSeries is the most label combinations a metric records. Any others are
+// recorded with all labels set to "other" so that unexpected values, such as
+// random URL paths, can't use up all the memory.
+const maxSeries = 1000
+
+// Buckets used for latencies in seconds.
+var DurationBuckets = []float64{
+	.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Buckets used for counts such as the number of suppliers in an auction.
+var CountBuckets = []float64{0, 1, 2, 3, 5, 8, 13, 21}
+
+// metric is written to the /metrics response.
+type metric interface {
+	write(b *bytes.Buffer)
+}
+
+// metrics are all the registered metrics in the order they were registered.
+var metrics []metric
+var metricsMutex sync.Mutex
+
+// register adds the metric to those returned by /metrics.
+func register(m metric) {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+	metrics = append(metrics, m)
+}
+
+// CounterVec is a counter with values for each combination of labels.
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+	mutex  sync.Mutex
+	series map[string]float64
+}
+
+// NewCounterVec creates and registers a counter with the labels.
+func NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		series: make(map[string]float64)}
+	register(c)
+	return c
+}
+
+// Inc adds one to the counter for the label values.
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add adds v to the counter for the label values.
+func (c *CounterVec) Add(v float64, values ...string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	k := seriesKeyOf(values)
+	if _, ok := c.series[k]; ok == false && len(c.series) >= maxSeries {
+		k = otherKey(len(values))
+	}
+	c.series[k] += v
+}
+
+func (c *CounterVec) write(b *bytes.Buffer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	writeHeader(b, c.name, c.help, "counter")
+	for _, k := range sortedKeys(c.series) {
+		writeSample(b, c.name, c.labels, k, "", "", c.series[k])
+	}
+}
+
+// HistogramVec counts observations in buckets for each combination of labels.
+type HistogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mutex   sync.Mutex
+	series  map[string]*histogram
+}
+
+// histogram is the counts for one combination of labels. counts has one more
+// entry than the buckets for the +Inf bucket.
+type histogram struct {
+	counts []uint64
+	sum    float64
+}
+
+// NewHistogramVec creates and registers a histogram with the buckets and
+// labels.
+func NewHistogramVec(
+	name string,
+	help string,
+	buckets []float64,
+	labels ...string) *HistogramVec {
+	h := &HistogramVec{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*histogram)}
+	register(h)
+	return h
+}
+
+// Observe adds the value to the histogram for the label values.
+func (h *HistogramVec) Observe(v float64, values ...string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	k := seriesKeyOf(values)
+	s := h.series[k]
+	if s == nil && len(h.series) >= maxSeries {
+		k = otherKey(len(values))
+		s = h.series[k]
+	}
+	if s == nil {
+		s = &histogram{counts: make([]uint64, len(h.buckets)+1)}
+		h.series[k] = s
+	}
+	i := sort.SearchFloat64s(h.buckets, v)
+	s.counts[i]++
+	s.sum += v
+}
+
+// ObserveSince adds the seconds since the start time to the histogram for the
+// label values.
+func (h *HistogramVec) ObserveSince(start time.Time, values ...string) {
+	h.Observe(time.Since(start).Seconds(), values...)
+}
+
+func (h *HistogramVec) write(b *bytes.Buffer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	writeHeader(b, h.name, h.help, "histogram")
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := h.series[k]
+		var n uint64
+		for i, c := range s.counts {
+			n += c
+			le := "+Inf"
+			if i < len(h.buckets) {
+				le = formatFloat(h.buckets[i])
+			}
+			writeSample(b, h.name+"_bucket", h.labels, k, "le", le, float64(n))
+		}
+		writeSample(b, h.name+"_sum", h.labels, k, "", "", s.sum)
+		writeSample(b, h.name+"_count", h.labels, k, "", "", float64(n))
+	}
+}
+
+// funcMetric gets its value from a function when the metrics are written.
+type funcMetric struct {
+	name string
+	help string
+	kind string
+	f    func() float64
+}
+
+// NewCounterFunc registers a counter whose value is returned by the function.
+func NewCounterFunc(name string, help string, f func() float64) {
+	register(&funcMetric{name: name, help: help, kind: "counter", f: f})
+}
+
+// NewGaugeFunc registers a gauge whose value is returned by the function.
+func NewGaugeFunc(name string, help string, f func() float64) {
+	register(&funcMetric{name: name, help: help, kind: "gauge", f: f})
+}
+
+func (m *funcMetric) write(b *bytes.Buffer) {
+	writeHeader(b, m.name, m.help, m.kind)
+	writeSample(b, m.name, nil, "", "", "", m.f())
+}
+
+// metricsText returns all the registered metrics in the Prometheus text
+// format.
+func metricsText() []byte {
+	metricsMutex.Lock()
+	l := metrics
+	metricsMutex.Unlock()
+	var b bytes.Buffer
+	for _, m := range l {
+		m.write(&b)
+	}
+	return b.Bytes()
+}
+
+// WriteMetricsOnShutdown writes the metrics to the metricsFile in the
+// configuration when the server shuts down. The final values would otherwise
+// be lost as /metrics can't be scraped once the server has stopped.
+func (c *Configuration) WriteMetricsOnShutdown() {
+	if c.MetricsFile == "" {
+		return
+	}
+	f := c.MetricsFile
+	OnShutdown(func(ctx context.Context) error {
+		t := f + ".tmp"
+		err := ioutil.WriteFile(t, metricsText(), 0644)
+		if err != nil {
+			return err
+		}
+		return os.Rename(t, f)
+	})
+}
+
+// HandlerMetrics responds with all the registered metrics in the Prometheus
+// text format.
+func HandlerMetrics(w http.ResponseWriter, r *http.Request) {
+	b := metricsText()
+	g := gzip.NewWriter(w)
+	defer g.Close()
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	g.Write(b)
+}
+
+// Metrics for the requests handled by the domains.
+var (
+	requestsTotal = NewCounterVec(
+		"swan_demo_requests_total",
+		"Requests handled by each domain and handler.",
+		"host", "category", "handler", "code")
+	requestDuration = NewHistogramVec(
+		"swan_demo_request_duration_seconds",
+		"Time taken to handle requests by each domain and handler.",
+		DurationBuckets,
+		"host", "category", "handler")
+)
+
+// SWANDuration is the time taken for SWAN access node operations.
+var SWANDuration = NewHistogramVec(
+	"swan_demo_swan_duration_seconds",
+	"Time taken for SWAN access node operations by operation and result.",
+	DurationBuckets,
+	"host", "operation", "result")
+
+// statusWriter records the status code written to the response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusWriter) WriteHeader(code int) {
+	s.status = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+// observeRequest records a request handled by the domain that started at s.
+func observeRequest(d *Domain, handler string, code int, s time.Time) {
+	requestsTotal.Inc(d.Host, d.Category, handler, strconv.Itoa(code))
+	requestDuration.ObserveSince(s, d.Host, d.Category, handler)
+}
+
+// handlerName returns the name used in metrics for the handler of the path.
+// This is the first segment of the path without any extension, root for the
+// home page, or data if the segment is SWAN data.
+func handlerName(p string) string {
+	n := strings.SplitN(strings.TrimPrefix(p, "/"), "/", 2)[0]
+	n = strings.TrimSuffix(n, filepath.Ext(n))
+	if n == "" {
+		return "root"
+	}
+	if len(n) > maxSegment {
+		return "data"
+	}
+	return n
+}
+
+// maxSegment is the longest path segment that is not treated as SWAN data.
+const maxSegment = 64
+
+// cleanPath returns the path with any segments that are SWAN data replaced so
+// that the data is not logged.
+func cleanPath(p string) string {
+	s := strings.Split(p, "/")
+	for i, v := range s {
+		if len(v) > maxSegment {
+			s[i] = "[data]"
+		}
+	}
+	return strings.Join(s, "/")
+}
+
+// seriesKeyOf returns the key used to store the values for the label values.
+func seriesKeyOf(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+// otherKey returns the key with all n labels set to "other". Used once a
+// metric has the maximum number of series.
+func otherKey(n int) string {
+	o := make([]string, n)
+	for i := range o {
+		o[i] = "other"
+	}
+	return seriesKeyOf(o)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func writeHeader(b *bytes.Buffer, name string, help string, kind string) {
+	fmt.Fprintf(b, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(b, "# TYPE %s %s\n", name, kind)
+}
+
+// writeSample writes a line for the sample. The label values are in the key.
+// An extra label, such as le for histogram buckets, is added if provided.
+func writeSample(
+	b *bytes.Buffer,
+	name string,
+	labels []string,
+	key string,
+	extra string,
+	extraValue string,
+	v float64) {
+	b.WriteString(name)
+	var p []string
+	if len(labels) > 0 {
+		for i, l := range strings.Split(key, "\xff") {
+			if i < len(labels) {
+				p = append(p, labels[i]+"=\""+escapeLabel(l)+"\"")
+			}
+		}
+	}
+	if extra != "" {
+		p = append(p, extra+"=\""+extraValue+"\"")
+	}
+	if len(p) > 0 {
+		b.WriteString("{" + strings.Join(p, ",") + "}")
+	}
+	b.WriteString(" " + formatFloat(v) + "\n")
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(
+		"\\", "\\\\",
+		"\"", "\\\"",
+		"\n", "\\n").Replace(s)
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -64,6 +64,42 @@ func (m PageModel) IsCrawler() (bool, error) {
 	return fod.GetCrawlerFrom51Degrees(m.Request)
 }
 
+// MailVisible returns true if the captured email can be shown. The email
+// contains reminder links and addresses so it is only shown in debug mode or
+// if the request has one of the access keys.
+func (m PageModel) MailVisible() bool {
+	c := m.Domain.Config
+	if c.Debug {
+		return true
+	}
+	k := m.Request.FormValue("accessKey")
+	return k != "" && len(c.AccessKeys) > 0 && c.validAccessKey(k)
+}
+
+// SinkMessages returns the email written to the mail sink with the most recent
+// first, or nil if the mailSink setting is not used or the email can't be
+// shown.
+func (m PageModel) SinkMessages() ([]*MailMessage, error) {
+	if m.MailVisible() == false {
+		return nil, nil
+	}
+	if s, ok := m.Domain.Config.Outbox().Mailer().(*MailSink); ok {
+		return s.Messages()
+	}
+	return nil, nil
+}
+
+// PublisherTraces returns the first span of the recent traces that started with
+// a publisher request with the most recent first.
+func (m PageModel) PublisherTraces() []*Span {
+	return m.Domain.Config.Tracer().Roots("Publisher")
+}
+
+// Waterfall returns the spans of the trace in the trace parameter.
+func (m PageModel) Waterfall() []*WaterfallSpan {
+	return m.Domain.Config.Tracer().Waterfall(m.Request.FormValue("trace"))
+}
+
 // Config returns the domain configuration.
 func (m PageModel) Config() *Configuration { return m.Domain.Config }
 
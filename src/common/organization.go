@@ -0,0 +1,145 @@
+/* ****************************************************************************
+ * Copyright 2020 51 Degrees Mobile Experts Limited (51degrees.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations
+ * under the License.
+ * ***************************************************************************/
+
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Regulator is the data protection authority responsible for organizations
+// operating in a country.
+type Regulator struct {
+	Country     string `json:"country"`     // ISO 3166-1 alpha-2 country code
+	CountryName string `json:"countryName"` // Name of the country
+	Name        string `json:"name"`        // Name of the authority
+	ContactURL  string `json:"contactUrl"`  // URL used to raise a complaint
+	Law         string `json:"law"`         // The data protection law applied
+	LawURL      string `json:"lawUrl"`      // URL for the text of the law
+}
+
+// Organization is the legal entity behind an OWID creator domain.
+type Organization struct {
+	Domain       string     `json:"domain"`       // The OWID creator domain
+	LegalName    string     `json:"legalName"`    // Registered legal name
+	Country      string     `json:"country"`      // ISO 3166-1 alpha-2 country code
+	DPA          string     `json:"dpa"`          // Optional override for the regulator name
+	DPAURL       string     `json:"dpaUrl"`       // Optional override for the regulator URL
+	PrivacyEmail string     `json:"privacyEmail"` // Contact for data protection matters
+	Regulator    *Regulator `json:"-"`            // Regulator for the organization
+}
+
+// Organizations is the registry of organizations and regulators loaded from
+// the organizations data file.
+type Organizations struct {
+	Regulators    []*Regulator    `json:"regulators"`
+	Organizations []*Organization `json:"organizations"`
+}
+
+// NewOrganizations reads the registry from the JSON file provided.
+func NewOrganizations(file string) (*Organizations, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var o Organizations
+	err = json.NewDecoder(f).Decode(&o)
+	if err != nil {
+		return nil, fmt.Errorf("organizations file '%s': %s", file, err)
+	}
+	for _, g := range o.Organizations {
+		g.Regulator = o.regulator(g)
+	}
+	return &o, nil
+}
+
+// RegulatorByCountry returns the regulator for the country code, or nil if
+// the country is not known.
+func (o *Organizations) RegulatorByCountry(country string) *Regulator {
+	if o == nil {
+		return nil
+	}
+	for _, r := range o.Regulators {
+		if strings.EqualFold(r.Country, country) {
+			return r
+		}
+	}
+	return nil
+}
+
+// regulator returns the regulator for the organization's country with any
+// authority provided by the organization taking precedence.
+func (o *Organizations) regulator(g *Organization) *Regulator {
+	r := o.RegulatorByCountry(g.Country)
+	if g.DPA == "" && g.DPAURL == "" {
+		return r
+	}
+	var c Regulator
+	if r != nil {
+		c = *r
+	}
+	c.Country = g.Country
+	if g.DPA != "" {
+		c.Name = g.DPA
+	}
+	if g.DPAURL != "" {
+		c.ContactURL = g.DPAURL
+	}
+	return &c
+}
+
+// byDomain returns the organization registered for the domain, or nil.
+func (o *Organizations) byDomain(domain string) *Organization {
+	if o == nil {
+		return nil
+	}
+	for _, g := range o.Organizations {
+		if strings.EqualFold(g.Domain, domain) {
+			return g
+		}
+	}
+	return nil
+}
+
+// GetOrganization returns the organization behind the OWID creator domain.
+// Information in the registry is used where present. Otherwise the domain must
+// be one of the demo domains and the name held by the OWID store for the
+// creator is used. The regulator and privacy email are left empty as they
+// can't be known for organizations that are not in the registry.
+func (c *Configuration) GetOrganization(domain string) (*Organization, error) {
+	g := c.organizations.byDomain(domain)
+	if g != nil {
+		return g, nil
+	}
+	if c.DomainByHost(domain) == nil {
+		return nil, fmt.Errorf("'%s' is not a known organization", domain)
+	}
+	var o Organization
+	o.Domain = domain
+	o.LegalName = domain
+	r, err := c.GetCreator(domain)
+	if err != nil {
+		return nil, err
+	}
+	if r != nil && r.Name() != "" {
+		o.LegalName = r.Name()
+	}
+	return &o, nil
+}
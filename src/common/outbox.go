@@ -0,0 +1,293 @@
+/* ****************************************************************************
+ * Copyright 2020 51 Degrees Mobile Experts Limited (51degrees.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations
+ * under the License.
+ * ***************************************************************************/
+
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// outboxInterval is how often the outbox retries messages that are due.
+const outboxInterval = 30 * time.Second
+
+// outboxMaxAttempts is the number of times a message is tried before it is
+// given up on.
+const outboxMaxAttempts = 8
+
+// outboxMaxBackoff is the longest time between attempts.
+const outboxMaxBackoff = time.Hour
+
+// outboxEntry is a message waiting to be delivered.
+type outboxEntry struct {
+	Message     *MailMessage `json:"message"`
+	Attempts    int          `json:"attempts"`    // Number of failed attempts
+	NextAttempt time.Time    `json:"nextAttempt"` // When to try again
+	LastError   string       `json:"lastError"`   // Reason the last attempt failed
+}
+
+// Outbox sends messages with a mailer. Messages that can't be delivered are
+// kept and retried with a backoff. If a file is configured the messages
+// waiting to be delivered are written to it so they survive a restart.
+type Outbox struct {
+	mailer  Mailer
+	file    string
+	mutex   sync.Mutex // Guards pending
+	sending sync.Mutex // Held while messages are delivered
+	pending []*outboxEntry
+}
+
+var outbox atomic.Value  // The single *Outbox used by all domains
+var outboxOnce sync.Once // Used to create the outbox from the configuration
+
+// emailResults counts the attempts to send email by result of delivered,
+// failed, abandoned after the last attempt, or refused as email can't be sent.
+var emailResults = NewCounterVec(
+	"swan_demo_email_total",
+	"Email send attempts by result.",
+	"result")
+
+func init() {
+	NewGaugeFunc(
+		"swan_demo_email_pending",
+		"Email waiting in the outbox to be delivered.",
+		func() float64 {
+			o, ok := outbox.Load().(*Outbox)
+			if ok == false {
+				return 0
+			}
+			return float64(o.Pending())
+		})
+}
+
+// Outbox returns the outbox creating it from the configuration the first time
+// it is needed. If the mailSink setting is provided then messages are written
+// to that folder. Otherwise they are sent with SMTP if the smtp settings are
+// set.
+func (c *Configuration) Outbox() *Outbox {
+	outboxOnce.Do(func() {
+		o := &Outbox{file: c.OutboxFile}
+		if c.MailSink != "" {
+			s, err := NewMailSink(c.MailSink)
+			if err != nil {
+				Log.Error("mail sink not available", "error", err)
+			} else {
+				o.mailer = s
+			}
+		} else if s := NewSMTP(c); canSend(s) == nil {
+			o.mailer = s
+		}
+		err := o.load()
+		if err != nil {
+			Log.Error("outbox not loaded", "error", err)
+		}
+		go o.run()
+		OnShutdown(o.flush)
+		outbox.Store(o)
+	})
+	return outbox.Load().(*Outbox)
+}
+
+// Send creates a message from the template and data and adds it to the outbox.
+// It is delivered in the background so that the request is not held up by the
+// mail server, and retried later if it can't be delivered. An error is only
+// returned if there is no way to send email or the message can't be created
+// or saved.
+func (o *Outbox) Send(
+	email string,
+	subject string,
+	emailTemplate *template.Template,
+	data interface{}) error {
+	if o.mailer == nil {
+		emailResults.Inc("refused")
+		return errors.New(
+			"cannot send email, set mailSink in the application settings or " +
+				"configure the following settings: smtpSender, smtpHost, " +
+				"smtpPort, smtpPassword")
+	}
+	m, err := NewMailMessage(email, subject, emailTemplate, data)
+	if err != nil {
+		return err
+	}
+	o.mutex.Lock()
+	o.pending = append(o.pending, &outboxEntry{Message: m})
+	err = o.save()
+	o.mutex.Unlock()
+	go o.retry()
+	return err
+}
+
+// Pending returns the number of messages waiting to be delivered.
+func (o *Outbox) Pending() int {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return len(o.pending)
+}
+
+// Mailer returns the mailer used to deliver messages, or nil if email can't be
+// sent.
+func (o *Outbox) Mailer() Mailer { return o.mailer }
+
+// attempt tries to deliver a copy of the message in the entry without holding
+// the lock. Returns nil if it was delivered.
+func (o *Outbox) attempt(e *outboxEntry) error {
+	m := *e.Message
+	err := o.mailer.Deliver(&m)
+	if err == nil {
+		emailResults.Inc("delivered")
+		return nil
+	}
+	emailResults.Inc("failed")
+	return err
+}
+
+// failed records the failed attempt and sets the time of the next attempt. The
+// caller must hold the lock.
+func (o *Outbox) failed(e *outboxEntry, err error) {
+	e.Attempts++
+	e.LastError = err.Error()
+	b := time.Minute << uint(e.Attempts-1)
+	if b > outboxMaxBackoff || b <= 0 {
+		b = outboxMaxBackoff
+	}
+	e.NextAttempt = time.Now().Add(b)
+	Log.Warn("email not delivered",
+		"subject", e.Message.Subject,
+		"email", e.Message.To,
+		"attempt", e.Attempts,
+		"error", e.LastError)
+}
+
+// run retries the messages that are due until the process ends.
+func (o *Outbox) run() {
+	for range time.Tick(outboxInterval) {
+		o.retry()
+	}
+}
+
+// retry attempts the messages that are due.
+func (o *Outbox) retry() {
+	err := o.deliver(context.Background(), false)
+	if err != nil {
+		Log.Error("outbox not saved", "error", err)
+	}
+}
+
+// flush tries to deliver all the messages waiting to be delivered before the
+// server shuts down and then saves those that are left. Stops trying when the
+// context is done.
+func (o *Outbox) flush(ctx context.Context) error {
+	return o.deliver(ctx, true)
+}
+
+// deliver attempts the messages that are due, or all of them if all is true,
+// and removes those that are delivered or have used all their attempts. The
+// messages are copied out under the lock and delivered without it so that a
+// slow mail server does not block requests sending email. Only one call
+// delivers at a time so that each message is only attempted once. Stops
+// attempting messages when the context is done.
+func (o *Outbox) deliver(ctx context.Context, all bool) error {
+	if o.mailer == nil {
+		return nil
+	}
+	o.sending.Lock()
+	defer o.sending.Unlock()
+	n := time.Now()
+	o.mutex.Lock()
+	var l []*outboxEntry
+	for _, e := range o.pending {
+		if all || n.Before(e.NextAttempt) == false {
+			l = append(l, e)
+		}
+	}
+	o.mutex.Unlock()
+	if len(l) == 0 {
+		return nil
+	}
+
+	r := make(map[*outboxEntry]error, len(l))
+	for _, e := range l {
+		if ctx.Err() != nil {
+			break
+		}
+		r[e] = o.attempt(e)
+	}
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	var p []*outboxEntry
+	for _, e := range o.pending {
+		err, ok := r[e]
+		if ok == false {
+			p = append(p, e)
+		} else if err != nil {
+			o.failed(e, err)
+			if e.Attempts < outboxMaxAttempts {
+				p = append(p, e)
+			} else {
+				emailResults.Inc("abandoned")
+				Log.Error("email abandoned",
+					"subject", e.Message.Subject,
+					"email", e.Message.To,
+					"attempts", e.Attempts)
+			}
+		}
+	}
+	o.pending = p
+	return o.save()
+}
+
+// load reads the messages waiting to be delivered from the file if one is
+// configured and exists.
+func (o *Outbox) load() error {
+	if o.file == "" {
+		return nil
+	}
+	b, err := ioutil.ReadFile(o.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, &o.pending)
+}
+
+// save writes the messages waiting to be delivered to the file if one is
+// configured. The file is written to a temporary file first and then renamed
+// so that a failure part way through does not lose the messages.
+func (o *Outbox) save() error {
+	if o.file == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(o.pending, "", "  ")
+	if err != nil {
+		return err
+	}
+	t := o.file + ".tmp"
+	err = ioutil.WriteFile(t, b, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(t, o.file)
+}
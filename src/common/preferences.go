@@ -0,0 +1,220 @@
+/* ****************************************************************************
+ * Copyright 2020 51 Degrees Mobile Experts Limited (51degrees.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations
+ * under the License.
+ * ***************************************************************************/
+
+package common
+
+import (
+	"encoding/json"
+	"owid"
+	"sort"
+	"strings"
+	"swan"
+)
+
+// Identifiers for the purposes offered by the CMP if the configuration does
+// not provide any.
+const (
+	PurposePersonalizedAds     = "personalizedAds"
+	PurposeMeasurement         = "measurement"
+	PurposePersonalizedContent = "personalizedContent"
+	PurposeProductImprovement  = "productImprovement"
+)
+
+// Purpose is a use of personal data that the user can allow or deny.
+type Purpose struct {
+	ID          string `json:"id"`          // Identifier stored in the preferences
+	Name        string `json:"name"`        // Name shown to the user
+	Description string `json:"description"` // Explanation shown to the user
+}
+
+var defaultPurposes = []*Purpose{
+	{
+		PurposePersonalizedAds,
+		"Personalized advertising",
+		"Adverts chosen using your browsing activity and interactions."},
+	{
+		PurposeMeasurement,
+		"Measurement",
+		"Measuring how adverts and content perform."},
+	{
+		PurposePersonalizedContent,
+		"Personalized content",
+		"Content chosen using your browsing activity and interactions."},
+	{
+		PurposeProductImprovement,
+		"Product improvement",
+		"Using your activity to develop and improve products."}}
+
+// GetPurposes returns the purposes from the configuration or the default
+// purposes if none are configured.
+func (c *Configuration) GetPurposes() []*Purpose {
+	if len(c.Purposes) > 0 {
+		return c.Purposes
+	}
+	return defaultPurposes
+}
+
+// Vendors returns the domains that take part in the advertising transaction and
+// can be allowed or denied individually by the user.
+func (c *Configuration) Vendors() []*Domain {
+	var v []*Domain
+	for _, d := range c.Domains() {
+		switch d.Category {
+		case "DSP", "SSP", "DMP", "Exchange":
+			v = append(v, d)
+			break
+		}
+	}
+	sort.Slice(v, func(i, j int) bool { return v[i].Name < v[j].Name })
+	return v
+}
+
+// Preferences are the user's choices for each purpose and any vendors that
+// they have denied. They are stored as JSON in the payload of the preferences
+// OWID signed by the CMP.
+type Preferences struct {
+	Purposes map[string]bool `json:"purposes"`          // Keyed on purpose ID
+	Vendors  map[string]bool `json:"vendors,omitempty"` // Keyed on host
+	set      bool            // True if the user has made a choice
+}
+
+// NewPreferences returns empty preferences that the user has made a choice
+// for. All purposes and vendors are denied until set.
+func NewPreferences() *Preferences {
+	return &Preferences{
+		Purposes: make(map[string]bool),
+		Vendors:  make(map[string]bool),
+		set:      true}
+}
+
+// ParsePreferences returns the preferences from the payload of a preferences
+// OWID. The original single preference values "on" and "off" are treated as
+// the choice for personalized advertising. An empty or invalid payload results
+// in preferences that are not set.
+func ParsePreferences(v string) *Preferences {
+	p := NewPreferences()
+	switch strings.TrimSpace(v) {
+	case "on":
+		p.Purposes[PurposePersonalizedAds] = true
+		return p
+	case "off":
+		p.Purposes[PurposePersonalizedAds] = false
+		return p
+	case "":
+		p.set = false
+		return p
+	}
+	err := json.Unmarshal([]byte(v), p)
+	if err != nil || p.Purposes == nil {
+		p = NewPreferences()
+		p.set = false
+	}
+	if p.Vendors == nil {
+		p.Vendors = make(map[string]bool)
+	}
+	return p
+}
+
+// PreferencesFromID returns the preferences contained in the SWAN ID.
+func PreferencesFromID(id *swan.ID) *Preferences {
+	if id == nil || id.Preferences == nil {
+		return ParsePreferences("")
+	}
+	return ParsePreferences(string(id.Preferences.Payload))
+}
+
+// PreferencesFromOWID returns the preferences in the OWID's payload.
+func PreferencesFromOWID(o *owid.OWID) *Preferences {
+	if o == nil {
+		return ParsePreferences("")
+	}
+	return ParsePreferences(string(o.Payload))
+}
+
+// IsSet returns true if the user has made a choice.
+func (p *Preferences) IsSet() bool { return p.set }
+
+// Purpose returns true if the purpose is allowed.
+func (p *Preferences) Purpose(id string) bool { return p.Purposes[id] }
+
+// Vendor returns true if the vendor has not been denied by the user.
+func (p *Preferences) Vendor(host string) bool {
+	a, ok := p.Vendors[host]
+	return ok == false || a
+}
+
+// Allowed returns true if the vendor can use personal data for the purpose.
+func (p *Preferences) Allowed(purpose string, vendor string) bool {
+	return p.Purpose(purpose) && p.Vendor(vendor)
+}
+
+// Personalized returns true if personalized advertising is allowed.
+func (p *Preferences) Personalized() bool {
+	return p.Purpose(PurposePersonalizedAds)
+}
+
+// SetVendor records the user's choice for the vendor. Only denied vendors are
+// kept to keep the payload small.
+func (p *Preferences) SetVendor(host string, allowed bool) {
+	if allowed {
+		delete(p.Vendors, host)
+	} else {
+		p.Vendors[host] = false
+	}
+}
+
+// DeniedVendors returns the hosts of the vendors the user has denied in
+// alphabetical order.
+func (p *Preferences) DeniedVendors() []string {
+	var v []string
+	for h, a := range p.Vendors {
+		if a == false {
+			v = append(v, h)
+		}
+	}
+	sort.Strings(v)
+	return v
+}
+
+// Summary returns the user's choice for each of the purposes followed by any
+// denied vendors in a form that can be displayed to the user.
+func (p *Preferences) Summary(purposes []*Purpose) string {
+	if p.IsSet() == false {
+		return "Not set"
+	}
+	var l []string
+	for _, u := range purposes {
+		v := "Denied"
+		if p.Purpose(u.ID) {
+			v = "Allowed"
+		}
+		l = append(l, u.Name+": "+v)
+	}
+	d := p.DeniedVendors()
+	if len(d) > 0 {
+		l = append(l, "Denied vendors: "+strings.Join(d, ", "))
+	}
+	return strings.Join(l, "; ")
+}
+
+// AsString returns the preferences as JSON for the payload of an OWID.
+func (p *Preferences) AsString() (string, error) {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
@@ -0,0 +1,91 @@
+/* ****************************************************************************
+ * Copyright 2020 51 Degrees Mobile Experts Limited (51degrees.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations
+ * under the License.
+ * ***************************************************************************/
+
+package common
+
+import (
+	"sync"
+	"time"
+)
+
+// rateMutex protects the events of all the rate limiters so that several
+// limiters can be checked and updated together.
+var rateMutex sync.Mutex
+
+// RateLimiter allows a limited number of events for each key within a time
+// window. Keys with no events in the window are removed so the memory used
+// stays small.
+type RateLimiter struct {
+	limit  int                    // Events allowed in the window
+	window time.Duration          // Length of the window
+	events map[string][]time.Time // Times of the events in the window by key
+}
+
+// RateKey is a key to check with a rate limiter.
+type RateKey struct {
+	Limiter *RateLimiter
+	Key     string
+}
+
+// NewRateLimiter returns a rate limiter allowing limit events in the window.
+func NewRateLimiter(limit int, window time.Duration) *RateLimiter {
+	return &RateLimiter{
+		limit:  limit,
+		window: window,
+		events: make(map[string][]time.Time)}
+}
+
+// Allow returns true and records the event if the key has had fewer than the
+// limit of events in the window.
+func (l *RateLimiter) Allow(key string) bool {
+	return AllowAll(RateKey{Limiter: l, Key: key})
+}
+
+// AllowAll returns true and records an event for every key if all the rate
+// limiters allow their key. Otherwise no events are recorded so that an event
+// refused by one limit does not use up the others.
+func AllowAll(keys ...RateKey) bool {
+	rateMutex.Lock()
+	defer rateMutex.Unlock()
+	n := time.Now()
+	for _, k := range keys {
+		if k.Limiter.full(k.Key, n) {
+			return false
+		}
+	}
+	for _, k := range keys {
+		k.Limiter.events[k.Key] = append(k.Limiter.events[k.Key], n)
+	}
+	return true
+}
+
+// full removes the events outside the window and returns true if the key has
+// reached the limit. The caller must hold rateMutex.
+func (l *RateLimiter) full(key string, n time.Time) bool {
+	s := n.Add(-l.window)
+	for k, v := range l.events {
+		i := 0
+		for i < len(v) && v[i].Before(s) {
+			i++
+		}
+		if i == len(v) {
+			delete(l.events, k)
+		} else {
+			l.events[k] = v[i:]
+		}
+	}
+	return len(l.events[key]) >= l.limit
+}
@@ -0,0 +1,92 @@
+/* ****************************************************************************
+ * Copyright 2020 51 Degrees Mobile Experts Limited (51degrees.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations
+ * under the License.
+ * ***************************************************************************/
+
+package common
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ParseReturnURL parses the return URL provided by the caller and checks it is
+// allowed by the configuration. An error is returned and the refusal logged
+// with the logger provided if it is not allowed.
+func (c *Configuration) ParseReturnURL(l *Logger, s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err == nil {
+		err = c.CheckReturnURL(u)
+	}
+	if err != nil {
+		LogRefusedReturnURL(l, s, err)
+		return nil, err
+	}
+	return u, nil
+}
+
+// LogRefusedReturnURL logs that the return URL was refused with only the host
+// and path. The query string and fragment are not logged as they can contain
+// SWAN data and other values about the user.
+func LogRefusedReturnURL(l *Logger, s string, reason interface{}) {
+	var h, p string
+	if u, err := url.Parse(s); err == nil {
+		h = u.Host
+		p = cleanPath(u.Path)
+	}
+	l.Info("return URL refused", "host", h, "path", p, "error", reason)
+}
+
+// CheckReturnURL returns an error if the URL is not an absolute http or https
+// URL for one of the demo domains or a host in the returnUrlHosts setting. The
+// user name and password are not allowed as they are often used to disguise
+// the real host.
+func (c *Configuration) CheckReturnURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("scheme '%s' not allowed", u.Scheme)
+	}
+	if u.User != nil {
+		return fmt.Errorf("user information not allowed")
+	}
+	h := u.Hostname()
+	if h == "" {
+		return fmt.Errorf("host missing")
+	}
+	if c.DomainByHost(h) != nil {
+		return nil
+	}
+	for _, a := range c.ReturnURLHosts {
+		if strings.EqualFold(a, h) {
+			return nil
+		}
+	}
+	return fmt.Errorf("host '%s' not allowed", h)
+}
+
+// GetReturnURL returns a parsed URL from the query string, or if not present
+// from the referer HTTP header. The URL must be allowed by the configuration.
+func GetReturnURL(c *Configuration, r *http.Request) (*url.URL, error) {
+	s := r.Form.Get("returnUrl")
+	if s == "" {
+		s = r.Header.Get("Referer")
+	}
+	u, err := c.ParseReturnURL(LoggerFrom(r.Context()), s)
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = ""
+	return u, nil
+}
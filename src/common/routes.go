@@ -0,0 +1,197 @@
+/* ****************************************************************************
+ * Copyright 2020 51 Degrees Mobile Experts Limited (51degrees.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations
+ * under the License.
+ * ***************************************************************************/
+
+package common
+
+import (
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// wildcardPrefix starts an alias that matches all the sub domains of a host.
+const wildcardPrefix = "*."
+
+// Routes maps the host of a request to the domain that handles it. Hosts are
+// normalised so that ports, www. prefixes, trailing dots and case do not
+// matter.
+type Routes struct {
+	domains   []*Domain          // All the domains in the order provided
+	hosts     map[string]*Domain // Domains keyed on the host or an alias
+	wildcards map[string]*Domain // Domains keyed on the parent of a wildcard
+	fallback  *Domain            // Domain used for other hosts, or nil
+}
+
+// NewRoutes returns the routes for the domains. The host of each domain and
+// its aliases must only be used once. If the default host is provided then
+// the domain with that host is used for requests to other hosts. An error is
+// returned if the routes are not valid.
+func NewRoutes(domains []*Domain, defaultHost string) (*Routes, error) {
+	t := Routes{
+		domains:   domains,
+		hosts:     make(map[string]*Domain),
+		wildcards: make(map[string]*Domain)}
+	for _, d := range domains {
+		err := t.add(d, d.Host)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range d.Aliases {
+			err = t.add(d, a)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if defaultHost != "" {
+		t.fallback = t.hosts[NormaliseHost(defaultHost)]
+		if t.fallback == nil {
+			return nil, fmt.Errorf(
+				"defaultDomain '%s' is not a domain",
+				defaultHost)
+		}
+	}
+	return &t, nil
+}
+
+// Find returns the domain for the host, or nil if the host is not routed to a
+// domain. The default domain is not used.
+func (t *Routes) Find(host string) *Domain {
+	h := NormaliseHost(host)
+	if d := t.hosts[h]; d != nil {
+		return d
+	}
+
+	// Try the parents of the host starting with the longest so that the most
+	// specific wildcard is used.
+	for i := strings.IndexByte(h, '.'); i >= 0; {
+		h = h[i+1:]
+		if d := t.wildcards[h]; d != nil {
+			return d
+		}
+		i = strings.IndexByte(h, '.')
+	}
+	return nil
+}
+
+// Route returns the domain that handles requests for the host, or the default
+// domain if the host is not routed to a domain. Nil is returned if there is no
+// default domain.
+func (t *Routes) Route(host string) *Domain {
+	if d := t.Find(host); d != nil {
+		return d
+	}
+	return t.fallback
+}
+
+// Default returns the domain used for hosts that are not routed to a domain,
+// or nil if there isn't one.
+func (t *Routes) Default() *Domain {
+	return t.fallback
+}
+
+// Hosts returns the normalised hosts and aliases in alphabetical order.
+// Wildcards start with *.
+func (t *Routes) Hosts() []string {
+	var a []string
+	for h := range t.hosts {
+		a = append(a, h)
+	}
+	for h := range t.wildcards {
+		a = append(a, wildcardPrefix+h)
+	}
+	sort.Strings(a)
+	return a
+}
+
+// add routes the host, which can be a wildcard, to the domain.
+func (t *Routes) add(d *Domain, host string) error {
+	m := t.hosts
+	h := host
+	if strings.HasPrefix(h, wildcardPrefix) {
+		m = t.wildcards
+		h = h[len(wildcardPrefix):]
+	}
+	h = NormaliseHost(h)
+	if h == "" || strings.ContainsAny(h, "*/ ") {
+		return fmt.Errorf(
+			"alias '%s' for domain '%s' is not a host or wildcard",
+			host,
+			d.Host)
+	}
+	if e := m[h]; e != nil {
+		return fmt.Errorf(
+			"host '%s' is used by domains '%s' and '%s'",
+			host,
+			e.Host,
+			d.Host)
+	}
+	m[h] = d
+	return nil
+}
+
+// NormaliseHost returns the host in lower case without the port, www. prefix
+// or trailing dot. For example WWW.Example.com.:5000 becomes example.com.
+func NormaliseHost(host string) string {
+	h := strings.ToLower(strings.TrimSpace(host))
+	if s, _, err := net.SplitHostPort(h); err == nil {
+		h = s
+	} else if strings.HasPrefix(h, "[") && strings.HasSuffix(h, "]") {
+		h = h[1 : len(h)-1]
+	}
+	h = strings.TrimSuffix(h, ".")
+	h = strings.TrimPrefix(h, "www.")
+	return h
+}
+
+// unknownHostTemplate is returned for requests to hosts that are not part of
+// the demo. The configured hosts are only listed in debug mode.
+var unknownHostTemplate = template.Must(template.New("unknown").Parse(
+	`<!DOCTYPE html>` +
+		`<html><head><meta charset="utf-8"><title>Unknown host</title></head>` +
+		`<body><h1>Unknown host</h1>` +
+		`<p>The host '{{ .Host }}' is not part of the demo.</p>` +
+		`{{ if .Hosts }}<p>Configured hosts:</p><ul>` +
+		`{{ range .Hosts }}<li>{{ . }}</li>{{ end }}</ul>{{ end }}` +
+		`</body></html>`))
+
+// handlerUnknownHost returns not found with a page explaining that the host
+// is not part of the demo.
+func handlerUnknownHost(
+	c *Configuration,
+	t *Routes,
+	w http.ResponseWriter,
+	r *http.Request) {
+	var m struct {
+		Host  string
+		Hosts []string
+	}
+	m.Host = r.Host
+	if c.Debug {
+		m.Hosts = t.Hosts()
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusNotFound)
+	err := unknownHostTemplate.Execute(w, &m)
+	if err != nil {
+		Log.Error("unknown host page not written", "error", err)
+	}
+	Log.Debug("unknown host", "host", r.Host)
+}
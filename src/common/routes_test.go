@@ -0,0 +1,121 @@
+/* ****************************************************************************
+ * Copyright 2020 51 Degrees Mobile Experts Limited (51degrees.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations
+ * under the License.
+ * ***************************************************************************/
+
+package common
+
+import "testing"
+
+func TestNormaliseHost(t *testing.T) {
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"example.com", "example.com"},
+		{"WWW.Swan-Demo.uk:5000", "swan-demo.uk"},
+		{"www.example.com.", "example.com"},
+		{"example.com.:443", "example.com"},
+		{" Example.COM ", "example.com"},
+		{"wwwexample.com", "wwwexample.com"},
+		{"sub.www.example.com", "sub.www.example.com"},
+		{"127.0.0.1:8080", "127.0.0.1"},
+		{"[::1]:5000", "::1"},
+		{"[::1]", "::1"},
+		{"", ""},
+	}
+	for _, v := range tests {
+		if g := NormaliseHost(v.host); g != v.want {
+			t.Errorf("'%s' normalised to '%s' not '%s'", v.host, g, v.want)
+		}
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	p := &Domain{Host: "swan-demo.uk", Aliases: []string{"alias.example"}}
+	c := &Domain{Host: "cmp.swan-demo.uk"}
+	a := &Domain{Host: "ads.example", Aliases: []string{"*.ads.example"}}
+	r, err := NewRoutes([]*Domain{p, c, a}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewRoutes([]*Domain{p, c, a}, "WWW.swan-demo.uk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host     string
+		want     *Domain // Without a default domain
+		fallback *Domain // With swan-demo.uk as the default domain
+	}{
+		{"swan-demo.uk", p, p},
+		{"WWW.Swan-Demo.uk:5000", p, p},
+		{"swan-demo.uk.", p, p},
+		{"alias.example:8443", p, p},
+		{"cmp.swan-demo.uk:5000", c, c},
+		{"www.cmp.swan-demo.uk", c, c},
+		{"ads.example", a, a},
+		{"one.ads.example:80", a, a},
+		{"two.one.ads.example", a, a},
+		{"evil.com", nil, p},
+		{"evil.com:5000", nil, p},
+		{"swan-demo.uk.evil.com", nil, p},
+		{"evilswan-demo.uk", nil, p},
+		{"", nil, p},
+	}
+	for _, v := range tests {
+		if g := r.Route(v.host); g != v.want {
+			t.Errorf("'%s' routed to %v not %v", v.host, g, v.want)
+		}
+		if g := f.Route(v.host); g != v.fallback {
+			t.Errorf("'%s' routed to %v not %v with default domain",
+				v.host,
+				g,
+				v.fallback)
+		}
+	}
+	if f.Find("evil.com") != nil {
+		t.Error("Find used the default domain")
+	}
+}
+
+func TestNewRoutesInvalid(t *testing.T) {
+	tests := []struct {
+		name        string
+		domains     []*Domain
+		defaultHost string
+	}{
+		{"same host", []*Domain{
+			{Host: "example.com"},
+			{Host: "www.Example.com"}}, ""},
+		{"alias used", []*Domain{
+			{Host: "example.com"},
+			{Host: "other.com", Aliases: []string{"example.com:5000"}}}, ""},
+		{"same wildcard", []*Domain{
+			{Host: "a.com", Aliases: []string{"*.example.com"}},
+			{Host: "b.com", Aliases: []string{"*.EXAMPLE.com"}}}, ""},
+		{"not a host", []*Domain{
+			{Host: "a.com", Aliases: []string{"example.com/path"}}}, ""},
+		{"nested wildcard", []*Domain{
+			{Host: "a.com", Aliases: []string{"*.*.example.com"}}}, ""},
+		{"unknown default", []*Domain{
+			{Host: "a.com"}}, "b.com"},
+	}
+	for _, v := range tests {
+		_, err := NewRoutes(v.domains, v.defaultHost)
+		if err == nil {
+			t.Errorf("%s: no error", v.name)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+/* ****************************************************************************
+ * Copyright 2020 51 Degrees Mobile Experts Limited (51degrees.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations
+ * under the License.
+ * ***************************************************************************/
+
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// sharedSettings are read from the settings file by the SWAN, SWIFT and OWID
+// packages. Most are only used by those packages and are not reported as
+// unknown. scheme and debug are also used by the demo. The value is an example
+// of the type of the setting.
+var sharedSettings = map[string]interface{}{
+	"scheme":                  "",
+	"debug":                   false,
+	"title":                   "",
+	"message":                 "",
+	"backgroundColor":         "",
+	"messageColor":            "",
+	"progressColor":           "",
+	"storageOperationTimeout": 0,
+	"homeNodeTimeout":         0,
+	"revalidateSeconds":       0,
+	"deleteDays":              0,
+	"nodeCount":               0,
+	"swanNetwork":             ""}
+
+// parseSettings returns the configuration from the JSON settings without
+// connecting to any stores. An error is returned if a value has the wrong
+// type. Settings that are not known are available from SettingsProblems.
+func parseSettings(name string, b []byte) (*Configuration, error) {
+	var c Configuration
+	err := json.Unmarshal(b, &c)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+	var m map[string]json.RawMessage
+	err = json.Unmarshal(b, &m)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+	k := settingNames()
+	for n := range m {
+		if _, ok := k[strings.ToLower(n)]; ok == false {
+			c.unknown = append(c.unknown, n)
+		}
+	}
+	sort.Strings(c.unknown)
+	return &c, nil
+}
+
+// SettingsProblems returns the problems with the settings, or nil if there
+// are none.
+func (c *Configuration) SettingsProblems() []string {
+	var p []string
+	for _, n := range c.unknown {
+		p = append(p, fmt.Sprintf("'%s' is not a known setting", n))
+	}
+	if c.Scheme != "http" && c.Scheme != "https" {
+		p = append(p, fmt.Sprintf(
+			"scheme '%s' must be http or https",
+			c.Scheme))
+	}
+	switch c.SMTPSecurity {
+	case "", smtpTLS, smtpSTARTTLS, smtpNone:
+		break
+	default:
+		p = append(p, fmt.Sprintf(
+			"smtpSecurity '%s' must be tls, starttls or none",
+			c.SMTPSecurity))
+		break
+	}
+	_, err := newLogger(c.LogLevel, c.LogFormat, c.LogSensitive, c.Debug)
+	if err != nil {
+		p = append(p, err.Error())
+	}
+	for n, v := range map[string]int{
+		"decryptCacheSize":    c.DecryptCacheSize,
+		"decryptCacheSeconds": c.DecryptCacheSeconds,
+		"decryptStaleSeconds": c.DecryptStaleSeconds,
+		"magicLinkMinutes":    c.MagicLinkMinutes,
+		"shutdownSeconds":     c.ShutdownSeconds} {
+		if v < 0 {
+			p = append(p, fmt.Sprintf("%s must not be negative", n))
+		}
+	}
+	if c.ReloadSeconds < -1 {
+		p = append(p, "reloadSeconds must be -1 or more")
+	}
+	for _, h := range c.ReturnURLHosts {
+		if u, err := url.Parse("//" + h); err != nil || u.Host != h {
+			p = append(p, fmt.Sprintf(
+				"returnUrlHosts '%s' must be a host name only",
+				h))
+		}
+	}
+	for _, a := range c.TrustedProxies {
+		if _, _, err := net.ParseCIDR(a); err != nil && net.ParseIP(a) == nil {
+			p = append(p, fmt.Sprintf(
+				"trustedProxies '%s' must be an IP address or CIDR range",
+				a))
+		}
+	}
+	for _, a := range c.AccessKeys {
+		if a == "" {
+			p = append(p, "accessKeys contains an empty key")
+		}
+	}
+	sort.Strings(p)
+	return p
+}
+
+// settingNames returns the names of all the settings that are known keyed on
+// the lower case name.
+func settingNames() map[string]string {
+	k := make(map[string]string)
+	for n := range settingTypes() {
+		k[strings.ToLower(n)] = n
+	}
+	return k
+}
+
+// settingTypes returns the type of all the settings that are known keyed on
+// the name.
+func settingTypes() map[string]reflect.Type {
+	k := make(map[string]reflect.Type)
+	t := reflect.TypeOf((*Configuration)(nil)).Elem()
+	for i := 0; i < t.NumField(); i++ {
+		n := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if n != "" && n != "-" {
+			k[n] = t.Field(i).Type
+		}
+	}
+	for n, v := range sharedSettings {
+		k[n] = reflect.TypeOf(v)
+	}
+	return k
+}
@@ -0,0 +1,448 @@
+/* ****************************************************************************
+ * Copyright 2020 51 Degrees Mobile Experts Limited (51degrees.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations
+ * under the License.
+ * ***************************************************************************/
+
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// SettingsEnvPrefix is added to the setting name in upper case with words
+// separated by underscores to form the environment variable that overrides the
+// setting. For example SWAN_DEMO_DECRYPT_CACHE_SIZE for decryptCacheSize.
+const SettingsEnvPrefix = "SWAN_DEMO_"
+
+// defaultSettingsFile is used if no settings files are provided.
+const defaultSettingsFile = "appsettings.json"
+
+// maskedSetting replaces the value of secret settings when they are dumped.
+const maskedSetting = "********"
+
+// settingDefaults are the lowest layer of the settings. They are the same as
+// the values used when the setting is not provided so that the effective
+// configuration shows them.
+var settingDefaults = map[string]interface{}{
+	"scheme":              "https",
+	"logFormat":           "logfmt",
+	"decryptCacheSize":    10000,
+	"decryptCacheSeconds": 300,
+	"decryptStaleSeconds": 86400,
+	"magicLinkMinutes":    24 * 60,
+	"shutdownSeconds":     30,
+	"reloadSeconds":       2,
+	"smtpSecurity":        smtpTLS}
+
+// legacyEnvironment are the environment variables used before the settings
+// could be set with SettingsEnvPrefix, and those set by hosting platforms.
+// They override the settings files. Later entries override earlier ones.
+var legacyEnvironment = []struct {
+	env  string // Name of the environment variable
+	name string // Name of the setting
+}{
+	{"PORT", "httpPort"},                 // Amazon Web Services
+	{"HTTP_PLATFORM_PORT", "httpPort"},   // Azure App Services
+	{"HTTPS_PLATFORM_PORT", "httpsPort"}, // Azure App Services
+	{"SMTP_SENDER", "smtpSender"},
+	{"SMTP_HOST", "smtpHost"},
+	{"SMTP_PORT", "smtpPort"},
+	{"SMTP_PASSWORD", "smtpPassword"},
+	{"SMTP_SECURITY", "smtpSecurity"},
+	{"51D_RESOURCE_KEY", "fodResourceKey"}}
+
+// secretSettings are masked when the settings are dumped.
+var secretSettings = map[string]bool{
+	"accessKeys":     true,
+	"csrfSecret":     true,
+	"smtpPassword":   true,
+	"fodResourceKey": true}
+
+// Settings are the effective application settings formed from layers. Each
+// layer overrides the settings in the layers before it.
+//
+// 1. Defaults.
+// 2. JSON or YAML settings files in the order provided.
+// 3. Environment variables used by hosting platforms and earlier versions.
+// 4. Environment variables starting with SettingsEnvPrefix.
+// 5. Command line flags named after the setting, e.g. -debug=true.
+type Settings struct {
+	Files  []string                // Settings files in the order applied
+	values map[string]interface{}  // Effective settings keyed on name
+	names  map[string]string       // Known setting names keyed on lower case
+	types  map[string]reflect.Type // Known setting types keyed on name
+	file   string                  // Temporary file with the shared settings
+}
+
+// LoadSettings returns the effective settings for the command line arguments
+// provided. Flags named after settings come first followed by the settings
+// files. appsettings.json is used if no files are provided. An error is
+// returned if a file can't be read or a value is the wrong type.
+func LoadSettings(args []string) (*Settings, error) {
+	s := &Settings{
+		values: make(map[string]interface{}),
+		names:  settingNames(),
+		types:  settingTypes()}
+	for n, v := range settingDefaults {
+		s.values[n] = v
+	}
+
+	// Parse the flags before reading the files so that the file names are
+	// known.
+	flags := make(map[string]string)
+	f := flag.NewFlagSet("settings", flag.ContinueOnError)
+	for n, t := range s.types {
+		f.Var(
+			&settingFlag{n, flags, t.Kind() == reflect.Bool},
+			n,
+			s.usage(n))
+	}
+	err := f.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	s.Files = f.Args()
+	if len(s.Files) == 0 {
+		s.Files = []string{defaultSettingsFile}
+	}
+
+	for _, file := range s.Files {
+		err = s.readFile(file)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, e := range legacyEnvironment {
+		if v, ok := os.LookupEnv(e.env); ok {
+			err = s.set(e.name, v, e.env)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	for n := range s.types {
+		e := SettingsEnvPrefix + envName(n)
+		if v, ok := os.LookupEnv(e); ok {
+			err = s.set(n, v, e)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	for n, v := range flags {
+		err = s.set(n, v, "-"+n)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// String returns the settings files separated by commas.
+func (s *Settings) String() string {
+	return strings.Join(s.Files, ", ")
+}
+
+// JSON returns the effective settings as a JSON object.
+func (s *Settings) JSON() ([]byte, error) {
+	return json.Marshal(s.values)
+}
+
+// Configuration returns the configuration from the effective settings without
+// connecting to any stores.
+func (s *Settings) Configuration() (*Configuration, error) {
+	b, err := s.JSON()
+	if err != nil {
+		return nil, err
+	}
+	return parseSettings(s.String(), b)
+}
+
+// Dump returns the effective settings as indented JSON with the values of
+// secret settings masked.
+func (s *Settings) Dump() ([]byte, error) {
+	m := make(map[string]interface{}, len(s.values))
+	for n, v := range s.values {
+		if secretSettings[n] {
+			m[n] = mask(v)
+		} else {
+			m[n] = v
+		}
+	}
+	return json.MarshalIndent(m, "", "    ")
+}
+
+// File returns a JSON settings file with the effective settings for the SWAN,
+// SWIFT and OWID packages that read the settings from a file. If the first
+// settings file is JSON and contains the same shared settings then that file is
+// returned. Otherwise only the shared settings, which are never secret, are
+// written to a temporary file which is removed when the server shuts down.
+func (s *Settings) File() (string, error) {
+	if s.file != "" {
+		return s.file, nil
+	}
+	b, err := json.Marshal(s.shared(s.values))
+	if err != nil {
+		return "", err
+	}
+	if isYAML(s.Files[0]) == false {
+		same, err := s.sameShared(s.Files[0], b)
+		if err != nil {
+			return "", err
+		}
+		if same {
+			return s.Files[0], nil
+		}
+	}
+	f, err := ioutil.TempFile("", "appsettings.shared.*.json")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	_, err = f.Write(b)
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	s.file = f.Name()
+	OnShutdown(func(ctx context.Context) error {
+		return os.Remove(s.file)
+	})
+	return s.file, nil
+}
+
+// shared returns the shared settings from the values provided.
+func (s *Settings) shared(
+	values map[string]interface{}) map[string]interface{} {
+	m := make(map[string]interface{}, len(sharedSettings))
+	for n, v := range values {
+		if _, ok := sharedSettings[s.name(n)]; ok {
+			m[s.name(n)] = v
+		}
+	}
+	return m
+}
+
+// sameShared returns true if the shared settings in the JSON file are the same
+// as the JSON provided. Other settings such as the port or secrets can be
+// overridden without the file being rewritten.
+func (s *Settings) sameShared(file string, b []byte) (bool, error) {
+	f, err := ioutil.ReadFile(file)
+	if err != nil {
+		return false, err
+	}
+	var m map[string]interface{}
+	err = json.Unmarshal(f, &m)
+	if err != nil {
+		return false, fmt.Errorf("%s: %s", file, err)
+	}
+	j, err := json.Marshal(s.shared(m))
+	if err != nil {
+		return false, err
+	}
+	return string(j) == string(b), nil
+}
+
+// readFile merges the settings from the JSON or YAML file into the values.
+func (s *Settings) readFile(file string) error {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var m map[string]interface{}
+	if isYAML(file) {
+		err = yaml.Unmarshal(b, &m)
+	} else {
+		err = json.Unmarshal(b, &m)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %s", file, err)
+	}
+	for n, v := range m {
+		s.values[s.name(n)] = fromYAML(v)
+	}
+	return nil
+}
+
+// set overrides the setting with the text value from an environment variable
+// or flag converted to the type of the setting.
+func (s *Settings) set(name string, value string, source string) error {
+	var v interface{}
+	var err error
+	switch s.types[name].Kind() {
+	case reflect.String:
+		v = value
+		break
+	case reflect.Bool:
+		v, err = strconv.ParseBool(value)
+		break
+	case reflect.Int:
+		v, err = strconv.Atoi(value)
+		break
+	case reflect.Slice:
+		if s.types[name].Elem().Kind() == reflect.String {
+			var a []string
+			for _, i := range strings.Split(value, ",") {
+				if i = strings.TrimSpace(i); i != "" {
+					a = append(a, i)
+				}
+			}
+			v = a
+		} else {
+			err = json.Unmarshal([]byte(value), &v)
+		}
+		break
+	default:
+		err = fmt.Errorf("type '%s' not supported", s.types[name])
+		break
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %s", source, err)
+	}
+	s.values[name] = v
+	return nil
+}
+
+// name returns the setting name for the name used in a file so that names
+// that only differ by case override one another. Names that are not known are
+// returned unchanged.
+func (s *Settings) name(n string) string {
+	if k, ok := s.names[strings.ToLower(n)]; ok {
+		return k
+	}
+	return n
+}
+
+// usage returns the description of the flag for the setting.
+func (s *Settings) usage(n string) string {
+	u := fmt.Sprintf("overrides %s, also %s%s",
+		n,
+		SettingsEnvPrefix,
+		envName(n))
+	if s.types[n].Kind() == reflect.Slice {
+		u += " (comma separated)"
+	}
+	return u
+}
+
+// settingFlag records the value of a flag named after a setting. The value is
+// converted to the type of the setting once all the layers are known.
+type settingFlag struct {
+	name    string            // Name of the setting
+	flags   map[string]string // Values of the flags keyed on setting name
+	boolean bool              // True if the flag can be used without a value
+}
+
+func (f *settingFlag) String() string {
+	if f.flags == nil {
+		return ""
+	}
+	return f.flags[f.name]
+}
+
+func (f *settingFlag) Set(v string) error {
+	f.flags[f.name] = v
+	return nil
+}
+
+func (f *settingFlag) IsBoolFlag() bool {
+	return f.boolean
+}
+
+// envName returns the setting name in upper case with words separated by
+// underscores. For example decryptCacheSize becomes DECRYPT_CACHE_SIZE and
+// localCA becomes LOCAL_CA.
+func envName(n string) string {
+	var b strings.Builder
+	r := []rune(n)
+	for i, c := range r {
+		if i > 0 && c >= 'A' && c <= 'Z' {
+			p := r[i-1]
+			if (p >= 'a' && p <= 'z') || (p >= '0' && p <= '9') ||
+				(i+1 < len(r) && r[i+1] >= 'a' && r[i+1] <= 'z') {
+				b.WriteRune('_')
+			}
+		}
+		b.WriteString(strings.ToUpper(string(c)))
+	}
+	return b.String()
+}
+
+// isYAML returns true if the file has a YAML extension.
+func isYAML(file string) bool {
+	e := strings.ToLower(filepath.Ext(file))
+	return e == ".yaml" || e == ".yml"
+}
+
+// fromYAML converts the maps returned by the YAML decoder, which have
+// interface keys, to maps with string keys so that they can be marshalled as
+// JSON.
+func fromYAML(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, i := range t {
+			m[fmt.Sprint(k)] = fromYAML(i)
+		}
+		return m
+	case map[string]interface{}:
+		for k, i := range t {
+			t[k] = fromYAML(i)
+		}
+		return t
+	case []interface{}:
+		for k, i := range t {
+			t[k] = fromYAML(i)
+		}
+		return t
+	}
+	return v
+}
+
+// mask returns the value with strings replaced so that secrets are not shown.
+// Empty strings are left so that it is clear the secret is not set.
+func mask(v interface{}) interface{} {
+	switch t := v.(type) {
+	case string:
+		if t == "" {
+			return t
+		}
+		return maskedSetting
+	case []string:
+		a := make([]interface{}, len(t))
+		for k, i := range t {
+			a[k] = mask(i)
+		}
+		return a
+	case []interface{}:
+		a := make([]interface{}, len(t))
+		for k, i := range t {
+			a[k] = mask(i)
+		}
+		return a
+	}
+	return maskedSetting
+}
@@ -0,0 +1,116 @@
+/* ****************************************************************************
+ * Copyright 2020 51 Degrees Mobile Experts Limited (51degrees.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations
+ * under the License.
+ * ***************************************************************************/
+
+package common
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeSettings writes the JSON settings to a file in a new temporary folder
+// and returns the name of the file.
+func writeSettings(t *testing.T, name string, v string) string {
+	d, err := ioutil.TempDir("", "settings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(d) })
+	f := filepath.Join(d, name)
+	err = ioutil.WriteFile(f, []byte(v), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestSettingsFile(t *testing.T) {
+	j := writeSettings(t, "appsettings.json", `{
+		"scheme": "https",
+		"debug": false,
+		"title": "SWAN Demo",
+		"nodeCount": 10,
+		"smtpPassword": "secret"}`)
+	y := writeSettings(t, "appsettings.yaml", "scheme: http\ntitle: YAML\n")
+	tests := []struct {
+		name   string
+		args   []string
+		env    map[string]string
+		same   bool                   // True if the JSON file is used as is
+		shared map[string]interface{} // Values expected in a new file
+	}{
+		{"file only", []string{j}, nil, true, nil},
+		{"port", []string{j}, map[string]string{"PORT": "5000"}, true, nil},
+		{"secret", []string{"-smtpPassword=other", j}, nil, true, nil},
+		{"same value", []string{"-nodeCount=10", j}, nil, true, nil},
+		{"title", []string{"-title=Other", j}, nil, false,
+			map[string]interface{}{"title": "Other", "nodeCount": 10.0}},
+		{"scheme", []string{j}, map[string]string{
+			SettingsEnvPrefix + "SCHEME": "http"}, false,
+			map[string]interface{}{"scheme": "http"}},
+		{"debug", []string{"-debug", j}, nil, false,
+			map[string]interface{}{"debug": true}},
+		{"yaml", []string{y}, nil, false,
+			map[string]interface{}{"scheme": "http", "title": "YAML"}},
+	}
+	for _, v := range tests {
+		t.Run(v.name, func(t *testing.T) {
+			for n, e := range v.env {
+				t.Setenv(n, e)
+			}
+			s, err := LoadSettings(v.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f, err := s.File()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v.same {
+				if f != j {
+					t.Errorf("'%s' written", f)
+				}
+				return
+			}
+			if f == j || f == y {
+				t.Fatal("settings file used as is")
+			}
+			b, err := ioutil.ReadFile(f)
+			os.Remove(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var m map[string]interface{}
+			err = json.Unmarshal(b, &m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for n := range m {
+				if _, ok := sharedSettings[n]; ok == false {
+					t.Errorf("'%s' is not shared but was written", n)
+				}
+			}
+			for n, e := range v.shared {
+				if m[n] != e {
+					t.Errorf("'%s' is '%v' not '%v'", n, m[n], e)
+				}
+			}
+		})
+	}
+}
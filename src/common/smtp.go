@@ -17,141 +17,161 @@
 package common
 
 import (
-	"bytes"
 	"crypto/tls"
 	"errors"
 	"fmt"
-	"html/template"
-	"log"
+	"net"
 	"net/smtp"
-	"os"
+	"time"
 )
 
+// smtpTimeout is how long to wait to connect to the SMTP server and then to
+// deliver the message.
+const smtpTimeout = 30 * time.Second
+
+// Security used for the connection to the SMTP server. Set with the
+// smtpSecurity setting.
+const (
+	smtpTLS      = "tls"      // TLS from the start of the connection
+	smtpSTARTTLS = "starttls" // Plain connection upgraded with STARTTLS
+	smtpNone     = "none"     // No encryption, only for local mail servers
+)
+
+// SMTP delivers messages to a mail server.
 type SMTP struct {
-	Sender   string
-	Host     string
-	Port     string
-	Password string
+	Sender   string // Email address the messages are sent from
+	Host     string // Host name of the mail server
+	Port     string // Port of the mail server
+	Password string // Password for the sender, or empty for no authentication
+	Security string // One of tls, starttls or none
 }
 
-func NewSMTP() *SMTP {
+// NewSMTP returns an SMTP mailer configured from the smtp settings.
+func NewSMTP(c *Configuration) *SMTP {
 	p := new(SMTP)
 
-	p.Sender = os.Getenv("SMTP_SENDER")
-	p.Host = os.Getenv("SMTP_HOST")
-	p.Port = os.Getenv("SMTP_PORT")
-	p.Password = os.Getenv("SMTP_PASSWORD")
+	p.Sender = c.SMTPSender
+	p.Host = c.SMTPHost
+	p.Port = c.SMTPPort
+	p.Password = c.SMTPPassword
+	p.Security = c.SMTPSecurity
+	if p.Security == "" {
+		p.Security = smtpTLS
+	}
 
 	return p
 }
 
-func (s *SMTP) Send(
-	email string,
-	subject string,
-	emailTemplate *template.Template,
-	data interface{}) error {
+// Deliver sends the message to the mail server.
+func (s *SMTP) Deliver(m *MailMessage) error {
 	err := canSend(s)
 	if err != nil {
 		return err
 	}
-
-	b, err := build(emailTemplate, subject, data)
+	if m.From == "" {
+		m.From = s.Sender
+	}
+	b, err := m.Bytes()
 	if err != nil {
 		return err
 	}
 
-	err = send(s, email, b)
+	c, err := s.dial()
 	if err != nil {
 		return err
 	}
-
-	return nil
-}
-
-func canSend(s *SMTP) error {
-	if s.Sender == "" ||
-		s.Host == "" ||
-		s.Port == "" ||
-		s.Password == "" {
-		return errors.New(
-			"cannot send email, make sure the following environment " +
-				"variables are configured: SMTP_SENDER, SMTP_HOST, SMTP_PORT, " +
-				"SMTP_PASSWORD")
+	defer c.Close()
+
+	// Authenticate if a password is provided.
+	if s.Password != "" {
+		err = c.Auth(smtp.PlainAuth("", s.Sender, s.Password, s.Host))
+		if err != nil {
+			return err
+		}
 	}
-	return nil
-}
-
-func send(s *SMTP, email string, body *bytes.Buffer) error {
-	// Sender data.
-	from := s.Sender
-	password := s.Password
-
-	// smtp server configuration.
-	smtpHost := s.Host
-	smtpPort := s.Port
 
-	// Authentication.
-	auth := smtp.PlainAuth("", from, password, smtpHost)
-
-	tlsconfig := &tls.Config{
-		ServerName: smtpHost,
+	// To && From
+	err = c.Mail(s.Sender)
+	if err != nil {
+		return err
 	}
-
-	conn, err := tls.Dial("tcp", smtpHost+":"+smtpPort, tlsconfig)
+	err = c.Rcpt(m.To)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
 
-	c, err := smtp.NewClient(conn, smtpHost)
+	w, err := c.Data()
 	if err != nil {
-		log.Print(err)
+		return err
 	}
-
-	// Auth
-	if err = c.Auth(auth); err != nil {
-		log.Print(err)
+	_, err = w.Write(b)
+	if err != nil {
+		return err
 	}
-
-	// To && From
-	if err = c.Mail(s.Sender); err != nil {
-		log.Print(err)
+	err = w.Close()
+	if err != nil {
+		return err
 	}
+	return c.Quit()
+}
 
-	if err = c.Rcpt(email); err != nil {
-		log.Print(err)
+// dial connects to the mail server with the security configured.
+func (s *SMTP) dial() (*smtp.Client, error) {
+	a := net.JoinHostPort(s.Host, s.Port)
+	t := &tls.Config{ServerName: s.Host}
+	d := &net.Dialer{Timeout: smtpTimeout}
+	switch s.Security {
+	case smtpTLS:
+		conn, err := tls.DialWithDialer(d, "tcp", a, t)
+		if err != nil {
+			return nil, err
+		}
+		return newSMTPClient(conn, s.Host)
+	case smtpSTARTTLS, smtpNone:
+		conn, err := d.Dial("tcp", a)
+		if err != nil {
+			return nil, err
+		}
+		c, err := newSMTPClient(conn, s.Host)
+		if err != nil {
+			return nil, err
+		}
+		if s.Security == smtpSTARTTLS {
+			err = c.StartTLS(t)
+			if err != nil {
+				c.Close()
+				return nil, err
+			}
+		}
+		return c, nil
 	}
+	return nil, fmt.Errorf("SMTP_SECURITY '%s' must be tls, starttls or none",
+		s.Security)
+}
 
-	w, err := c.Data()
+// newSMTPClient returns a client for the connection with a deadline so that a
+// mail server that stops responding can't hold up delivery indefinitely.
+func newSMTPClient(conn net.Conn, host string) (*smtp.Client, error) {
+	err := conn.SetDeadline(time.Now().Add(smtpTimeout))
 	if err != nil {
-		log.Print(err)
+		conn.Close()
+		return nil, err
 	}
-
-	_, err = w.Write(body.Bytes())
+	c, err := smtp.NewClient(conn, host)
 	if err != nil {
-		log.Print(err)
+		conn.Close()
+		return nil, err
 	}
+	return c, nil
+}
 
-	err = w.Close()
-	if err != nil {
-		log.Print(err)
+func canSend(s *SMTP) error {
+	if s.Sender == "" ||
+		s.Host == "" ||
+		s.Port == "" {
+		return errors.New(
+			"cannot send email, make sure the following settings are " +
+				"configured: smtpSender, smtpHost, smtpPort, smtpPassword")
 	}
-
-	c.Quit()
-
 	return nil
 }
-
-func build(
-	emailTemplate *template.Template,
-	subject string,
-	data interface{}) (*bytes.Buffer, error) {
-
-	var body bytes.Buffer
-
-	mimeHeaders := "MIME-version: 1.0;\nContent-Type: text/html; charset=\"UTF-8\";\n\n"
-	body.Write([]byte(fmt.Sprintf("Subject: Email Protection Reminder \n%s\n\n", mimeHeaders)))
-
-	emailTemplate.Execute(&body, data)
-
-	return &body, nil
-}
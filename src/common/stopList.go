@@ -0,0 +1,151 @@
+/* ****************************************************************************
+ * Copyright 2020 51 Degrees Mobile Experts Limited (51degrees.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations
+ * under the License.
+ * ***************************************************************************/
+
+package common
+
+import (
+	"encoding/json"
+	"owid"
+	"sort"
+	"strings"
+	"time"
+)
+
+// StopEntry is an advertiser the user has stopped from displaying adverts.
+type StopEntry struct {
+	Host   string    `json:"host"`             // Host of the advertiser
+	Date   time.Time `json:"date"`             // When the advertiser was stopped
+	Domain string    `json:"domain,omitempty"` // Domain that signed the entry
+}
+
+// StopList is the list of advertisers the user has stopped. The list is
+// stored in SWAN as an OWID signed by the CMP with a JSON payload.
+type StopList struct {
+	Entries []*StopEntry `json:"stopped"`
+}
+
+// stopPayload is used to decode either a single signed entry added by the
+// SWAN stop operation or a signed list.
+type stopPayload struct {
+	StopEntry
+	Stopped []*StopEntry `json:"stopped"`
+}
+
+// ParseStopList returns the stop list from the value stored in SWAN. The SWAN
+// stop operation appends new values to the existing value separated with white
+// space. Each value may be a signed list, a signed entry or a host name used
+// before the list was signed. Signed values are only used if they were signed
+// by a demo domain and the signature is verified, so that lists can't be
+// forged. Entries from signed values use the domain of the OWID creator if the
+// entry does not already include it.
+func ParseStopList(c *Configuration, v string) *StopList {
+	var l StopList
+	for _, s := range strings.Fields(v) {
+		o, err := owid.FromBase64(s)
+		if err != nil || o == nil {
+			if strings.ContainsAny(s, "/:@") == false {
+				l.Add(&StopEntry{Host: s})
+			}
+			continue
+		}
+		if c.VerifyOWID(o) == false {
+			Log.Debug("stop list value not verified", "domain", o.Domain)
+			continue
+		}
+		var p stopPayload
+		err = json.Unmarshal(o.Payload, &p)
+		if err != nil {
+			continue
+		}
+		if p.Host != "" {
+			p.StopEntry.Domain = o.Domain
+			if p.Date.IsZero() {
+				p.Date = o.Date
+			}
+			l.Add(&p.StopEntry)
+		}
+		for _, e := range p.Stopped {
+			if e.Domain == "" {
+				e.Domain = o.Domain
+			}
+			l.Add(e)
+		}
+	}
+	return &l
+}
+
+// NewStopEntryOWID returns a signed OWID for a single stopped host which can be
+// appended to the stop list by the SWAN stop operation.
+func NewStopEntryOWID(c *owid.Creator, host string) (*owid.OWID, error) {
+	b, err := json.Marshal(&StopEntry{Host: host, Date: time.Now().UTC()})
+	if err != nil {
+		return nil, err
+	}
+	return c.CreateOWIDandSign(b)
+}
+
+// Add the entry to the list replacing any entry for the same host that was
+// stopped earlier.
+func (l *StopList) Add(e *StopEntry) {
+	for i, c := range l.Entries {
+		if strings.EqualFold(c.Host, e.Host) {
+			if e.Date.After(c.Date) {
+				l.Entries[i] = e
+			}
+			return
+		}
+	}
+	l.Entries = append(l.Entries, e)
+}
+
+// Remove the host from the list returning true if the host was present.
+func (l *StopList) Remove(host string) bool {
+	for i, c := range l.Entries {
+		if strings.EqualFold(c.Host, host) {
+			l.Entries = append(l.Entries[:i], l.Entries[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Hosts returns the hosts in the list.
+func (l *StopList) Hosts() []string {
+	h := make([]string, len(l.Entries))
+	for i, e := range l.Entries {
+		h[i] = e.Host
+	}
+	return h
+}
+
+// Sorted returns the entries with the most recently stopped first.
+func (l *StopList) Sorted() []*StopEntry {
+	s := make([]*StopEntry, len(l.Entries))
+	copy(s, l.Entries)
+	sort.SliceStable(s, func(i, j int) bool {
+		return s[i].Date.After(s[j].Date)
+	})
+	return s
+}
+
+// AsOWID returns the list as an OWID signed by the creator provided.
+func (l *StopList) AsOWID(c *owid.Creator) (*owid.OWID, error) {
+	b, err := json.Marshal(l)
+	if err != nil {
+		return nil, err
+	}
+	return c.CreateOWIDandSign(b)
+}
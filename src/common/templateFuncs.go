@@ -0,0 +1,223 @@
+/* ****************************************************************************
+ * Copyright 2020 51 Degrees Mobile Experts Limited (51degrees.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations
+ * under the License.
+ * ***************************************************************************/
+
+package common
+
+import (
+	"fmt"
+	"html/template"
+	"owid"
+	"swan"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Layout used to format dates if one is not provided to formatDate.
+const templateDateLayout = "2006-01-02 15:04"
+
+// TemplateFuncs returns the functions available to all the HTML templates of
+// the domains. Functions that take a value accept an OWID, a base 64 OWID
+// string, a SWAN pair or an OWID node. If the value can't be turned into an
+// OWID then the function returns an empty value rather than an error so that
+// pages can be built from HTML alone.
+//
+//	role              "Bid", "Empty", "Failed" or "ID" for a SWAN data structure
+//	owid              the OWID for the value, or nil
+//	owidAge           age of the OWID with a unit, e.g. 3 hours
+//	owidVerify        true if the OWID is from a demo domain and its signature
+//	                  is verified by its creator
+//	owidDomain        domain of the OWID creator
+//	owidPayload       payload of the OWID as a string
+//	formatDate        date of a time or OWID using an optional layout
+//	shortSignature    first and last characters of the OWID signature in hex
+//	swanID            the swan.ID contained in the OWID, or nil
+//	preferences       the Preferences in a swan.ID, preferences OWID or payload
+//	uuid              payload of the OWID formatted as a UUID
+//	domainByHost      the demo domain for the host, or nil
+//	domainsByCategory all the demo domains in the category
+func TemplateFuncs(c *Configuration) template.FuncMap {
+	return template.FuncMap{
+		"role":        Role,
+		"owid":        toOWID,
+		"owidAge":     templateOWIDAge,
+		"owidDomain":  templateOWIDDomain,
+		"owidPayload": templateOWIDPayload,
+		"owidVerify": func(v interface{}) bool {
+			return templateOWIDVerify(c, v)
+		},
+		"formatDate":     templateFormatDate,
+		"shortSignature": templateShortSignature,
+		"swanID":         templateSWANID,
+		"preferences":    templatePreferences,
+		"uuid":           templateUUID,
+		"domainByHost": func(h string) *Domain {
+			return c.DomainByHost(h)
+		},
+		"domainsByCategory": func(category string) []*Domain {
+			return c.DomainsByCategory(category)
+		}}
+}
+
+// toOWID returns the OWID for the value provided, or nil if the value is not
+// an OWID.
+func toOWID(v interface{}) *owid.OWID {
+	var o *owid.OWID
+	var err error
+	switch t := v.(type) {
+	case *owid.OWID:
+		o = t
+	case *swan.Pair:
+		if t != nil {
+			o, err = t.AsOWID()
+		}
+	case *owid.Node:
+		if t != nil {
+			o, err = t.GetOWID()
+		}
+	case string:
+		if t != "" {
+			o, err = owid.FromBase64(t)
+		}
+	}
+	if err != nil {
+		return nil
+	}
+	return o
+}
+
+func templateOWIDAge(v interface{}) string {
+	o := toOWID(v)
+	if o == nil {
+		return ""
+	}
+	return formatAge(time.Since(o.Date))
+}
+
+// formatAge returns the duration in the largest whole unit of minutes, hours
+// or days.
+func formatAge(d time.Duration) string {
+	n, u := int(d/time.Minute), "minute"
+	if d >= 24*time.Hour {
+		n, u = int(d/(24*time.Hour)), "day"
+	} else if d >= time.Hour {
+		n, u = int(d/time.Hour), "hour"
+	}
+	if n != 1 {
+		u += "s"
+	}
+	return fmt.Sprintf("%d %s", n, u)
+}
+
+func templateOWIDDomain(v interface{}) string {
+	o := toOWID(v)
+	if o == nil {
+		return ""
+	}
+	return o.Domain
+}
+
+func templateOWIDPayload(v interface{}) string {
+	o := toOWID(v)
+	if o == nil {
+		return ""
+	}
+	return o.PayloadAsString()
+}
+
+// templateOWIDVerify only verifies OWIDs created by demo domains. Verifying
+// fetches the public key from the creator's domain and the OWID can come from
+// the request, so other domains would let anyone make the server send requests
+// to any host.
+func templateOWIDVerify(c *Configuration, v interface{}) bool {
+	o := toOWID(v)
+	if o == nil || c.DomainByHost(o.Domain) == nil {
+		return false
+	}
+	b, err := o.Verify(c.Scheme)
+	if err != nil {
+		return false
+	}
+	return b
+}
+
+func templateFormatDate(v interface{}, layout ...string) string {
+	l := templateDateLayout
+	if len(layout) > 0 {
+		l = layout[0]
+	}
+	if t, ok := v.(time.Time); ok {
+		return t.Format(l)
+	}
+	o := toOWID(v)
+	if o == nil {
+		return ""
+	}
+	return o.Date.Format(l)
+}
+
+func templateShortSignature(v interface{}) string {
+	o := toOWID(v)
+	if o == nil {
+		return ""
+	}
+	s := fmt.Sprintf("%x", o.Signature)
+	if len(s) <= 16 {
+		return s
+	}
+	return s[:8] + "…" + s[len(s)-8:]
+}
+
+func templateSWANID(v interface{}) *swan.ID {
+	o := toOWID(v)
+	if o == nil {
+		return nil
+	}
+	i, err := swan.IDFromOWID(o)
+	if err != nil {
+		return nil
+	}
+	return i
+}
+
+func templatePreferences(v interface{}) *Preferences {
+	if i, ok := v.(*swan.ID); ok {
+		return PreferencesFromID(i)
+	}
+	o := toOWID(v)
+	if o == nil {
+		if s, ok := v.(string); ok {
+			return ParsePreferences(s)
+		}
+		return ParsePreferences("")
+	}
+	if i, err := swan.IDFromOWID(o); err == nil {
+		return PreferencesFromID(i)
+	}
+	return PreferencesFromOWID(o)
+}
+
+func templateUUID(v interface{}) string {
+	o := toOWID(v)
+	if o == nil {
+		return ""
+	}
+	u, err := uuid.FromBytes(o.Payload)
+	if err != nil {
+		return ""
+	}
+	return u.String()
+}
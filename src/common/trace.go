@@ -0,0 +1,578 @@
+/* ****************************************************************************
+ * Copyright 2020 51 Degrees Mobile Experts Limited (51degrees.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations
+ * under the License.
+ * ***************************************************************************/
+
+package common
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"swan"
+	"sync"
+	"time"
+)
+
+// The kinds of span as used by OpenTelemetry.
+const (
+	SpanServer   = "server"   // Handling a request from another process or domain
+	SpanClient   = "client"   // Calling another domain or the SWAN access node
+	SpanInternal = "internal" // Work done within a domain
+)
+
+// traceHeader is the W3C trace context HTTP header.
+const traceHeader = "traceparent"
+
+// traceCookie carries the trace context across the redirects to and from
+// SWAN so that the request returning from SWAN continues the trace.
+const traceCookie = "swan-trace"
+
+// traceCookieSeconds is how long the browser keeps the trace cookie for.
+const traceCookieSeconds = 300
+
+// maxTraces is the number of recent traces kept in memory for display.
+const maxTraces = 200
+
+// maxTraceSpans is the most spans kept and exported for one trace. Any others
+// are dropped so that a single trace can't use up all the memory.
+const maxTraceSpans = 1000
+
+// maxPendingSpans is the most spans waiting to be exported. If the exporter
+// can't keep up then the oldest are dropped.
+const maxPendingSpans = 10000
+
+// traceInterval is how often spans are exported.
+const traceInterval = 5 * time.Second
+
+// Span is a unit of work in a trace such as a domain handling a request or a
+// call to a supplier.
+type Span struct {
+	TraceID    string            `json:"traceId"`
+	SpanID     string            `json:"spanId"`
+	ParentID   string            `json:"parentSpanId,omitempty"`
+	Name       string            `json:"name"`
+	Kind       string            `json:"kind"`
+	Host       string            `json:"host"`
+	Category   string            `json:"category"`
+	StartTime  time.Time         `json:"startTime"`
+	EndTime    time.Time         `json:"endTime"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Error      string            `json:"error,omitempty"`
+	tracer     *Tracer
+	mutex      sync.Mutex
+}
+
+// spanKey is used to store the current span in a context.
+type spanKey struct{}
+
+// Tracer keeps the recent traces for display and exports the spans to a file
+// or an OTLP collector.
+type Tracer struct {
+	mutex    sync.Mutex
+	traces   map[string][]*Span // Recent traces keyed on trace ID
+	active   map[string]int     // Spans started and not ended keyed on trace ID
+	order    []string           // Trace IDs with the oldest first
+	pending  []*Span            // Spans waiting to be exported
+	file     string             // JSON lines file for the spans, or empty
+	endpoint string             // OTLP/HTTP traces endpoint, or empty
+}
+
+var tracer *Tracer       // The single tracer used by all domains
+var tracerOnce sync.Once // Used to create the tracer from the configuration
+
+// Tracer returns the tracer creating it from the configuration the first time
+// it is needed. Spans are exported to the traceFile and traceEndpoint
+// settings if provided.
+func (c *Configuration) Tracer() *Tracer {
+	tracerOnce.Do(func() {
+		tracer = &Tracer{
+			traces:   make(map[string][]*Span),
+			active:   make(map[string]int),
+			file:     c.TraceFile,
+			endpoint: c.TraceEndpoint}
+		if tracer.file != "" || tracer.endpoint != "" {
+			go tracer.run()
+			OnShutdown(tracer.flush)
+		}
+	})
+	return tracer
+}
+
+// StartSpan starts a span for the domain that is a child of the span in the
+// context, or the first span of a new trace if there isn't one. The returned
+// context contains the new span. End must be called on the span.
+func StartSpan(
+	ctx context.Context,
+	d *Domain,
+	name string,
+	kind string) (context.Context, *Span) {
+	var traceID, parentID string
+	if p := SpanFromContext(ctx); p != nil {
+		traceID = p.TraceID
+		parentID = p.SpanID
+	}
+	s := newSpan(d, name, kind, traceID, parentID)
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// startServerSpan starts a span for the domain handling the request. If the
+// request has a traceparent header, or is returning from SWAN with the trace
+// cookie, then the span is part of that trace. The trace context is only used
+// if the trace was started by this server as anyone could set the header or
+// cookie. The trace cookie is removed once used.
+func startServerSpan(
+	w http.ResponseWriter,
+	r *http.Request,
+	d *Domain,
+	name string) (*http.Request, *Span) {
+	t := d.Config.Tracer()
+	traceID, parentID := parseTraceHeader(r.Header.Get(traceHeader))
+	if traceID == "" {
+		if c, err := r.Cookie(traceCookie); err == nil {
+			traceID, parentID = parseTraceHeader(c.Value)
+			http.SetCookie(w, &http.Cookie{
+				Name:   traceCookie,
+				Path:   "/",
+				MaxAge: -1})
+		}
+	}
+	if t.known(traceID) == false {
+		traceID, parentID = "", ""
+	}
+	s := newSpan(d, name, SpanServer, traceID, parentID)
+	s.SetAttribute("http.method", r.Method)
+	s.SetAttribute("http.target", cleanPath(r.URL.Path))
+	return r.WithContext(context.WithValue(r.Context(), spanKey{}, s)), s
+}
+
+// endServerSpan records the response status, and the host redirected to if
+// any, and ends the span.
+func endServerSpan(s *Span, w *statusWriter) {
+	s.SetAttribute("http.status_code", fmt.Sprintf("%d", w.status))
+	if w.status >= 300 && w.status < 400 {
+		if u, err := url.Parse(w.Header().Get("Location")); err == nil {
+			s.SetAttribute("http.redirect", u.Host)
+		}
+	}
+	if w.status >= 500 {
+		s.SetError(fmt.Errorf("Status code '%d'", w.status))
+	}
+	s.End()
+}
+
+// TraceSWANURL calls f to get the URL that the web browser is redirected to
+// for a SWAN operation. The call to the access node is traced as a span with
+// the name provided. The trace context is kept in a cookie so that the request
+// returning from SWAN continues the trace. w is nil if the response has
+// already started and the cookie can't be set.
+func TraceSWANURL(
+	w http.ResponseWriter,
+	r *http.Request,
+	d *Domain,
+	name string,
+	f func() (string, *swan.Error)) (string, *swan.Error) {
+	_, s := StartSpan(r.Context(), d, name, SpanClient)
+	defer s.End()
+	s.SetAttribute("peer.host", d.SWANAccessNode)
+	u, e := f()
+	if e != nil {
+		s.SetError(e)
+		return u, e
+	}
+	setTraceCookie(w, d, s)
+	return u, e
+}
+
+// setTraceCookie keeps the trace context of the span in a cookie so that the
+// request returning from SWAN continues the trace. Nothing is done if w is
+// nil.
+func setTraceCookie(w http.ResponseWriter, d *Domain, s *Span) {
+	if w == nil {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     traceCookie,
+		Value:    traceParent(s),
+		Path:     "/",
+		MaxAge:   traceCookieSeconds,
+		HttpOnly: true,
+		Secure:   d.Config.Scheme == "https",
+		SameSite: http.SameSiteLaxMode})
+}
+
+// SpanFromContext returns the current span from the context, or nil if there
+// isn't one.
+func SpanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// InjectTrace adds the traceparent header for the span in the context to the
+// request so that the domain receiving it continues the trace.
+func InjectTrace(ctx context.Context, r *http.Request) {
+	if s := SpanFromContext(ctx); s != nil {
+		r.Header.Set(traceHeader, traceParent(s))
+	}
+}
+
+// traceParent returns the W3C trace context for the span.
+func traceParent(s *Span) string {
+	return fmt.Sprintf("00-%s-%s-01", s.TraceID, s.SpanID)
+}
+
+// SetAttribute records a value against the span.
+func (s *Span) SetAttribute(key string, value string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.Attributes == nil {
+		s.Attributes = make(map[string]string)
+	}
+	s.Attributes[key] = value
+}
+
+// SetError records the error against the span if it is not nil.
+func (s *Span) SetError(err error) {
+	if err == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.Error = err.Error()
+}
+
+// End records the end time and adds the span to the tracer.
+func (s *Span) End() {
+	s.mutex.Lock()
+	s.EndTime = time.Now()
+	s.mutex.Unlock()
+	s.tracer.add(s)
+}
+
+// Duration returns the time taken by the span.
+func (s *Span) Duration() time.Duration { return s.EndTime.Sub(s.StartTime) }
+
+// Trace returns the spans for the trace ordered by start time, or nil if the
+// trace is not one of the recent traces.
+func (t *Tracer) Trace(id string) []*Span {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	l := append([]*Span(nil), t.traces[id]...)
+	sort.Slice(l, func(i, j int) bool {
+		return l[i].StartTime.Before(l[j].StartTime)
+	})
+	return l
+}
+
+// WaterfallSpan is a span with its position in a waterfall chart of the trace.
+type WaterfallSpan struct {
+	*Span
+	Depth  int     // Number of ancestors of the span in the trace
+	Offset float64 // Percentage of the trace duration before the span started
+	Width  float64 // Percentage of the trace duration taken by the span
+}
+
+// Waterfall returns the spans for the trace with each child following its
+// parent, or nil if the trace is not one of the recent traces.
+func (t *Tracer) Waterfall(id string) []*WaterfallSpan {
+	l := t.Trace(id)
+	if len(l) == 0 {
+		return nil
+	}
+	start := l[0].StartTime
+	end := l[0].EndTime
+	ids := make(map[string]bool)
+	for _, s := range l {
+		if s.EndTime.After(end) {
+			end = s.EndTime
+		}
+		ids[s.SpanID] = true
+	}
+	total := float64(end.Sub(start))
+	if total <= 0 {
+		total = 1
+	}
+	children := make(map[string][]*Span)
+	var roots []*Span
+	for _, s := range l {
+		if ids[s.ParentID] {
+			children[s.ParentID] = append(children[s.ParentID], s)
+		} else {
+			roots = append(roots, s)
+		}
+	}
+	var w []*WaterfallSpan
+	var add func(s *Span, depth int)
+	add = func(s *Span, depth int) {
+		w = append(w, &WaterfallSpan{
+			Span:   s,
+			Depth:  depth,
+			Offset: float64(s.StartTime.Sub(start)) * 100 / total,
+			Width:  float64(s.Duration()) * 100 / total})
+		for _, c := range children[s.SpanID] {
+			add(c, depth+1)
+		}
+	}
+	for _, s := range roots {
+		add(s, 0)
+	}
+	return w
+}
+
+// Roots returns the first span of each recent trace that started in a domain
+// of the category with the most recent first.
+func (t *Tracer) Roots(category string) []*Span {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	var r []*Span
+	for i := len(t.order) - 1; i >= 0; i-- {
+		for _, s := range t.traces[t.order[i]] {
+			if s.ParentID == "" && s.Category == category {
+				r = append(r, s)
+			}
+		}
+	}
+	return r
+}
+
+func newSpan(
+	d *Domain,
+	name string,
+	kind string,
+	traceID string,
+	parentID string) *Span {
+	if traceID == "" {
+		traceID = newTraceID(16)
+	}
+	t := d.Config.Tracer()
+	t.start(traceID)
+	return &Span{
+		TraceID:   traceID,
+		SpanID:    newTraceID(8),
+		ParentID:  parentID,
+		Name:      name,
+		Kind:      kind,
+		Host:      d.Host,
+		Category:  d.Category,
+		StartTime: time.Now(),
+		tracer:    t}
+}
+
+// start records that a span of the trace has started.
+func (t *Tracer) start(traceID string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.active[traceID]++
+}
+
+// known returns true if the trace was started by this server and has spans
+// that have not ended or is one of the recent traces.
+func (t *Tracer) known(traceID string) bool {
+	if traceID == "" {
+		return false
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	_, ok := t.traces[traceID]
+	return ok || t.active[traceID] > 0
+}
+
+// add keeps the span with the recent traces and queues it for export. Spans
+// beyond maxTraceSpans for the trace are dropped.
+func (t *Tracer) add(s *Span) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.active[s.TraceID] <= 1 {
+		delete(t.active, s.TraceID)
+	} else {
+		t.active[s.TraceID]--
+	}
+	if len(t.traces[s.TraceID]) >= maxTraceSpans {
+		return
+	}
+	if _, ok := t.traces[s.TraceID]; ok == false {
+		t.order = append(t.order, s.TraceID)
+		for len(t.order) > maxTraces {
+			delete(t.traces, t.order[0])
+			t.order = t.order[1:]
+		}
+	}
+	t.traces[s.TraceID] = append(t.traces[s.TraceID], s)
+	if t.file != "" || t.endpoint != "" {
+		t.pending = append(t.pending, s)
+		if len(t.pending) > maxPendingSpans {
+			t.pending = t.pending[len(t.pending)-maxPendingSpans:]
+		}
+	}
+}
+
+// run exports the pending spans until the process ends.
+func (t *Tracer) run() {
+	for range time.Tick(traceInterval) {
+		err := t.flush(context.Background())
+		if err != nil {
+			Log.Warn("spans not exported", "error", err)
+		}
+	}
+}
+
+// flush exports the pending spans. If they can't be sent to the endpoint they
+// are dropped rather than held as the collector might not be running.
+func (t *Tracer) flush(ctx context.Context) error {
+	t.mutex.Lock()
+	l := t.pending
+	t.pending = nil
+	t.mutex.Unlock()
+	if len(l) == 0 {
+		return nil
+	}
+	if t.file != "" {
+		err := writeSpans(t.file, l)
+		if err != nil {
+			return err
+		}
+	}
+	if t.endpoint != "" {
+		err := postSpans(ctx, t.endpoint, l)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeSpans appends the spans to the file as JSON lines.
+func writeSpans(file string, l []*Span) error {
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	e := json.NewEncoder(f)
+	for _, s := range l {
+		err = e.Encode(s)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// postSpans sends the spans to the OTLP/HTTP endpoint using the JSON encoding.
+func postSpans(ctx context.Context, endpoint string, l []*Span) error {
+	b, err := json.Marshal(newOTLPRequest(l))
+	if err != nil {
+		return err
+	}
+	r, err := http.NewRequestWithContext(
+		ctx,
+		"POST",
+		endpoint,
+		bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(r)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf(
+			"Trace endpoint '%s' returned status code '%d'",
+			endpoint,
+			res.StatusCode)
+	}
+	return nil
+}
+
+// newOTLPRequest returns the spans in the form of an OTLP export request with
+// the spans for each domain as a separate resource.
+func newOTLPRequest(l []*Span) interface{} {
+	type kv map[string]interface{}
+	attr := func(k string, v string) kv {
+		return kv{"key": k, "value": kv{"stringValue": v}}
+	}
+	kinds := map[string]int{SpanInternal: 1, SpanServer: 2, SpanClient: 3}
+	hosts := make(map[string][]interface{})
+	var order []string
+	for _, s := range l {
+		a := []interface{}{attr("swan.category", s.Category)}
+		for k, v := range s.Attributes {
+			a = append(a, attr(k, v))
+		}
+		t := kv{"code": 1}
+		if s.Error != "" {
+			t = kv{"code": 2, "message": s.Error}
+		}
+		if _, ok := hosts[s.Host]; ok == false {
+			order = append(order, s.Host)
+		}
+		hosts[s.Host] = append(hosts[s.Host], kv{
+			"traceId":           s.TraceID,
+			"spanId":            s.SpanID,
+			"parentSpanId":      s.ParentID,
+			"name":              s.Name,
+			"kind":              kinds[s.Kind],
+			"startTimeUnixNano": fmt.Sprintf("%d", s.StartTime.UnixNano()),
+			"endTimeUnixNano":   fmt.Sprintf("%d", s.EndTime.UnixNano()),
+			"attributes":        a,
+			"status":            t})
+	}
+	var r []interface{}
+	for _, h := range order {
+		r = append(r, kv{
+			"resource": kv{"attributes": []interface{}{
+				attr("service.name", h)}},
+			"scopeSpans": []interface{}{kv{
+				"scope": kv{"name": "swan-demo"},
+				"spans": hosts[h]}}})
+	}
+	return kv{"resourceSpans": r}
+}
+
+// parseTraceHeader returns the trace and parent span IDs from a traceparent
+// header, or empty strings if the header is not valid.
+func parseTraceHeader(h string) (string, string) {
+	p := strings.Split(h, "-")
+	if len(p) != 4 ||
+		len(p[1]) != 32 ||
+		len(p[2]) != 16 ||
+		isHex(p[1]) == false ||
+		isHex(p[2]) == false {
+		return "", ""
+	}
+	return p[1], p[2]
+}
+
+func isHex(s string) bool {
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// newTraceID returns n random bytes as a hex string.
+func newTraceID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
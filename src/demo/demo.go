@@ -21,20 +21,30 @@ import (
 	"common"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"marketer"
+	"net/http"
 	"openrtb"
 	"os"
 	"path/filepath"
 	"publisher"
 	"swanop"
+	"time"
 )
 
-// AddHandlers and outputs configuration information.
-func AddHandlers(settingsFile string) {
+// creatorRetry is the longest time between attempts to resolve the OWID
+// creators of the domains.
+const creatorRetry = time.Minute
+
+// AddHandlers and outputs configuration information. Returns the
+// configuration, or an error if the domains can't be parsed. The server is
+// marked ready once the OWID creators for all the domains have been resolved.
+func AddHandlers(s *common.Settings) (*common.Configuration, error) {
 
 	// Get the demo configuration.
-	dc := common.NewConfig(settingsFile)
+	dc, err := common.NewConfig(s)
+	if err != nil {
+		return nil, err
+	}
 
 	// Get the example simple access control implementations.
 	swa := swanop.NewAccessSimple(dc.AccessKeys)
@@ -42,32 +52,99 @@ func AddHandlers(settingsFile string) {
 	// Get all the domains for the SWAN demo.
 	wd, err := os.Getwd()
 	if err != nil {
-		fmt.Println(err.Error())
-		return
+		return nil, err
+	}
+	www := filepath.Join(wd, "www")
+	domains, err := parseDomains(dc, www)
+	if err != nil {
+		return nil, err
 	}
-	domains, err := parseDomains(&dc, filepath.Join(wd, "www"))
+	err = dc.SetDomains(domains)
 	if err != nil {
-		fmt.Println(err.Error())
-		return
+		return nil, err
 	}
-	dc.Domains = domains
 
 	// Add the SWAN handlers, with the demo handler being used for any
 	// malformed storage requests.
+	settingsFile, err := s.File()
+	if err != nil {
+		return nil, err
+	}
 	err = swanop.AddHandlers(
 		settingsFile,
 		swa,
-		common.Handler(domains))
+		common.Handler(dc))
 	if err != nil {
-		fmt.Println(err.Error())
-		return
+		return nil, err
 	}
 
+	// Report liveness and readiness for load balancers and container
+	// orchestration, and the status of each domain for operators.
+	http.HandleFunc("/healthz", common.HandlerLive)
+	http.HandleFunc("/readyz", common.HandlerReady)
+	http.HandleFunc("/diagnostics", common.HandlerDiagnostics(dc))
+
+	// Expose the metrics in the Prometheus text format.
+	http.HandleFunc("/metrics", common.HandlerMetrics)
+
 	// Output details for information.
-	log.Printf("Demo scheme: %s\n", dc.Scheme)
+	common.Log.Info("demo started", "scheme", dc.Scheme)
+	for _, d := range domains {
+		d.Logger().Info("domain added", "name", d.Name)
+	}
+
+	// The OWID creators might not be registered or the store might not be
+	// available yet so keep trying in the background. The server is ready
+	// once they have all been resolved.
+	go func() {
+		resolveCreators(dc, domains)
+		common.Log.Info("all OWID creators resolved, ready")
+		common.SetReady(true)
+	}()
+
+	// Reload the domains when their files change.
+	go watchDomains(dc, www)
+
+	return dc, nil
+}
+
+// resolveCreators gets the OWID creator for every domain, retrying those that
+// fail with an increasing delay. Domains that have been replaced by a reload
+// are no longer retried.
+func resolveCreators(c *common.Configuration, domains []*common.Domain) {
+	w := time.Second
+	for {
+		domains = tryCreators(domains)
+		if len(domains) == 0 {
+			break
+		}
+		time.Sleep(w)
+		w *= 2
+		if w > creatorRetry {
+			w = creatorRetry
+		}
+		var f []*common.Domain
+		for _, d := range domains {
+			if c.DomainByHost(d.Host) == d {
+				f = append(f, d)
+			}
+		}
+		domains = f
+	}
+}
+
+// tryCreators gets the OWID creator for every domain and returns the domains
+// whose creators are not available.
+func tryCreators(domains []*common.Domain) []*common.Domain {
+	var f []*common.Domain
 	for _, d := range domains {
-		log.Printf("%s:%s:%s", d.Category, d.Host, d.Name)
+		_, err := d.GetOWIDCreator()
+		if err != nil {
+			d.Logger().Warn("OWID creator not available", "error", err)
+			f = append(f, d)
+		}
 	}
+	return f
 }
 
 // parseDomains returns an array of domains (e.g. swan-demo.uk) with all the
@@ -86,17 +163,11 @@ func parseDomains(
 	}
 	for _, f := range files {
 		if f.IsDir() {
-			p := filepath.Join(path, f.Name())
-			g := common.GetConfigFile(p)
-			if g != nil {
-				domain, err := common.NewDomain(c, p, g)
-				if err != nil {
-					return nil, err
-				}
-				err = addHandler(domain)
-				if err != nil {
-					return nil, err
-				}
+			domain, err := parseDomain(c, filepath.Join(path, f.Name()))
+			if err != nil {
+				return nil, err
+			}
+			if domain != nil {
 				domains = append(domains, domain)
 			}
 		}
@@ -104,6 +175,24 @@ func parseDomains(
 	return domains, nil
 }
 
+// parseDomain returns the domain for the folder, or nil if the folder does not
+// contain a config.json file.
+func parseDomain(c *common.Configuration, folder string) (*common.Domain, error) {
+	g := common.GetConfigFile(folder)
+	if g == nil {
+		return nil, nil
+	}
+	domain, err := common.NewDomain(c, folder, g)
+	if err != nil {
+		return nil, err
+	}
+	err = addHandler(domain)
+	if err != nil {
+		return nil, err
+	}
+	return domain, nil
+}
+
 // Set the HTTP handler for the domain.
 func addHandler(d *common.Domain) error {
 	switch d.Category {
@@ -0,0 +1,152 @@
+/* ****************************************************************************
+ * Copyright 2020 51 Degrees Mobile Experts Limited (51degrees.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations
+ * under the License.
+ * ***************************************************************************/
+
+package demo
+
+import (
+	"common"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// defaultReloadSeconds is used if the settings do not set reloadSeconds.
+const defaultReloadSeconds = 2
+
+// watchDomains checks the www folder for changes to the domains' config.json,
+// HTML template and messages files every reloadSeconds. When a change is
+// found all the domains are parsed again and replace the current ones. If they
+// can't be parsed then the current domains continue to be used and the error
+// is reported by the diagnostics.
+func watchDomains(c *common.Configuration, path string) {
+	s := c.ReloadSeconds
+	if s < 0 {
+		return
+	}
+	if s == 0 {
+		s = defaultReloadSeconds
+	}
+	last, err := fingerprint(path)
+	if err != nil {
+		common.Log.Warn("www folder not watched", "error", err)
+		return
+	}
+	for range time.Tick(time.Duration(s) * time.Second) {
+		f, err := fingerprint(path)
+		if err != nil {
+			common.Log.Warn("www folder not checked", "error", err)
+			continue
+		}
+		if f != last {
+			last = f
+			reloadDomains(c, path)
+		}
+	}
+}
+
+// reloadDomains parses all the domains in the path and replaces the current
+// domains if there are no errors and no new problems. Problems the current
+// domains already have don't stop the reload. The OWID creators of the new
+// domains are resolved before they are used, and any that can't be are
+// retried in the background.
+func reloadDomains(c *common.Configuration, path string) {
+	d, err := parseDomains(c, path)
+	if err == nil {
+		err = checkReload(c, d)
+	}
+	var f []*common.Domain
+	if err == nil {
+		f = tryCreators(d)
+		err = c.SetDomains(d)
+	}
+	c.SetReload(err)
+	if err != nil {
+		common.Log.Error(
+			"domains not reloaded, previous configuration still used",
+			"error", err)
+		return
+	}
+	common.Log.Info("domains reloaded", "count", len(d))
+	if len(f) > 0 {
+		go resolveCreators(c, f)
+	}
+}
+
+// checkReload returns an error listing the problems the domains have that the
+// current domains do not.
+func checkReload(c *common.Configuration, d []*common.Domain) error {
+	n, err := c.DomainProblems(d)
+	if err != nil {
+		return err
+	}
+	o, err := c.DomainProblems(c.Domains())
+	if err != nil {
+		return err
+	}
+	k := make(map[string]bool)
+	for _, v := range o {
+		k[v] = true
+	}
+	var p []string
+	for _, v := range n {
+		if k[v] == false {
+			p = append(p, v)
+		}
+	}
+	if len(p) > 0 {
+		return fmt.Errorf("new problems: %s", strings.Join(p, "; "))
+	}
+	return nil
+}
+
+// fingerprint returns a hash of the names, sizes and modified times of the
+// files in the domain folders that are read when a domain is parsed.
+func fingerprint(path string) (string, error) {
+	h := sha256.New()
+	folders, err := ioutil.ReadDir(path)
+	if err != nil {
+		return "", err
+	}
+	for _, d := range folders {
+		if d.IsDir() == false {
+			continue
+		}
+		files, err := ioutil.ReadDir(filepath.Join(path, d.Name()))
+		if err != nil {
+			return "", err
+		}
+		for _, f := range files {
+			if isDomainFile(f.Name()) {
+				fmt.Fprintf(h, "%s/%s %d %d\n",
+					d.Name(),
+					f.Name(),
+					f.Size(),
+					f.ModTime().UnixNano())
+			}
+		}
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// isDomainFile returns true if the file is parsed when the domain is created.
+func isDomainFile(n string) bool {
+	return n == "config.json" ||
+		filepath.Ext(n) == ".html" ||
+		(strings.HasPrefix(n, "messages.") && filepath.Ext(n) == ".json")
+}
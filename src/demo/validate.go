@@ -0,0 +1,67 @@
+/* ****************************************************************************
+ * Copyright 2020 51 Degrees Mobile Experts Limited (51degrees.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations
+ * under the License.
+ * ***************************************************************************/
+
+package demo
+
+import (
+	"common"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// Validate checks the settings and the config.json, HTML template and messages
+// files of every domain in the www folder.
+// It returns all the problems found, or nil if there are none. Unlike starting
+// the server, settings that are not known and problems with the links between
+// domains are reported. An error is returned if the checks can't be carried
+// out.
+func Validate(s *common.Settings, www string) ([]string, error) {
+	c, err := s.Configuration()
+	if err != nil {
+		return nil, err
+	}
+	var p []string
+	for _, v := range c.SettingsProblems() {
+		p = append(p, fmt.Sprintf("%s: %s", s, v))
+	}
+
+	// Parse each domain separately so that all the problems are reported.
+	files, err := ioutil.ReadDir(www)
+	if err != nil {
+		return nil, err
+	}
+	var domains []*common.Domain
+	for _, f := range files {
+		if f.IsDir() == false {
+			continue
+		}
+		d, err := parseDomain(c, filepath.Join(www, f.Name()))
+		if err != nil {
+			p = append(p, fmt.Sprintf("%s: %s", f.Name(), err))
+		} else if d != nil {
+			domains = append(domains, d)
+		}
+	}
+
+	// Check the routes and links between the domains that could be parsed.
+	// The same checks are made before the domains are reloaded.
+	v, err := c.DomainProblems(domains)
+	if err != nil {
+		return append(p, err.Error()), nil
+	}
+	return append(p, v...), nil
+}
@@ -22,7 +22,6 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
-	"os"
 )
 
 // Device is the 51Degrees.com device item returned from calls to
@@ -36,13 +35,17 @@ type FOD struct {
 	Device *Device `json:"device"`
 }
 
+// ResourceKey for the 51Degrees.com cloud service, or empty if crawler
+// detection is not enabled. Set from the fodResourceKey setting or the
+// 51D_RESOURCE_KEY environment variable.
+var ResourceKey string
+
 // GetCrawlerFrom51Degrees used the 51Degrees.com device detection service to
-// determine if the request is from a crawler. Needs the 51D_RESOURCE_KEY
-// environment variable configured with a valid resource key from
-// https://configure.51degrees.com/vXyRZz8B.
+// determine if the request is from a crawler. Needs ResourceKey configured
+// with a valid resource key from https://configure.51degrees.com/vXyRZz8B.
 func GetCrawlerFrom51Degrees(r *http.Request) (bool, error) {
 
-	key := os.Getenv("51D_RESOURCE_KEY")
+	key := ResourceKey
 	if key == "" {
 		// 51Degrees device detection is not enabled so return false as the
 		// default.
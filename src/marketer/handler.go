@@ -37,7 +37,7 @@ func Handler(d *common.Domain, w http.ResponseWriter, r *http.Request) {
 	// Get the SWAN ID that relates to the advert.
 	o, err := getID(r)
 	if err != nil {
-		common.ReturnServerError(d.Config, w, err)
+		common.ReturnServerError(d.Config, w, r, err)
 		return
 	}
 
@@ -54,7 +54,7 @@ func Handler(d *common.Domain, w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Cache-Control", "no-cache")
 	err = t.Execute(g, &m)
 	if err != nil {
-		common.ReturnServerError(d.Config, w, err)
+		common.ReturnServerError(d.Config, w, r, err)
 	}
 }
 
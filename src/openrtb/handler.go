@@ -20,18 +20,48 @@ import (
 	"bytes"
 	"common"
 	"compress/gzip"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
 	"owid"
 	"swan"
 	"sync"
+	"time"
 )
 
 var empty swan.Empty // Used for empty responses
 
+// Metrics for the auctions and the calls to suppliers.
+var (
+	auctionSuppliers = common.NewHistogramVec(
+		"swan_demo_auction_suppliers",
+		"Number of suppliers each auction is sent to.",
+		common.CountBuckets,
+		"host")
+	auctionDuration = common.NewHistogramVec(
+		"swan_demo_auction_duration_seconds",
+		"Time taken for all the suppliers to respond to an auction.",
+		common.DurationBuckets,
+		"host")
+	supplierDuration = common.NewHistogramVec(
+		"swan_demo_supplier_duration_seconds",
+		"Time taken for each supplier to respond.",
+		common.DurationBuckets,
+		"host", "supplier")
+	supplierResults = common.NewCounterVec(
+		"swan_demo_supplier_results_total",
+		"Calls to suppliers by result of ok, error, timeout or status.",
+		"host", "supplier", "result")
+	auctionResponses = common.NewCounterVec(
+		"swan_demo_auction_responses_total",
+		"Responses to auctions by role of Bid, Empty or Failed.",
+		"host", "role")
+)
+
 const openRTBPath = "/demo/api/v1/bid" // The path for this handler
 
 // Handler is responsible for a real time transaction for advertising.
@@ -44,7 +74,7 @@ func Handler(d *common.Domain, w http.ResponseWriter, r *http.Request) {
 		// Unpack the body of the request to form the bid data structure.
 		o, err := getID(d, r)
 		if err != nil {
-			common.ReturnStatusCodeError(d.Config, w, err, http.StatusBadRequest)
+			common.ReturnStatusCodeError(d.Config, w, r, err, http.StatusBadRequest)
 			return
 		}
 
@@ -56,6 +86,7 @@ func Handler(d *common.Domain, w http.ResponseWriter, r *http.Request) {
 				common.ReturnStatusCodeError(
 					d.Config,
 					w,
+					r,
 					err,
 					http.StatusInternalServerError)
 				return
@@ -63,9 +94,9 @@ func Handler(d *common.Domain, w http.ResponseWriter, r *http.Request) {
 		}
 
 		// Handle the bid and return if the URL was found.
-		t, err := HandleTransaction(d, o)
+		t, err := HandleTransaction(r.Context(), d, o)
 		if err != nil {
-			common.ReturnServerError(d.Config, w, err)
+			common.ReturnServerError(d.Config, w, r, err)
 			return
 		}
 
@@ -73,7 +104,7 @@ func Handler(d *common.Domain, w http.ResponseWriter, r *http.Request) {
 		// Processor OWID and the children.
 		b, err := t.AsJSON()
 		if err != nil {
-			common.ReturnServerError(d.Config, w, err)
+			common.ReturnServerError(d.Config, w, r, err)
 			return
 		}
 
@@ -84,7 +115,7 @@ func Handler(d *common.Domain, w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Cache-Control", "no-cache")
 		_, err = g.Write(b)
 		if err != nil {
-			common.ReturnServerError(d.Config, w, err)
+			common.ReturnServerError(d.Config, w, r, err)
 			return
 		}
 	} else {
@@ -125,8 +156,12 @@ func changePubDomain(r *owid.Node, newPubDomain string) error {
 	return nil
 }
 
-// HandleTransaction processes an OpenRTB transaction.
-func HandleTransaction(d *common.Domain, n *owid.Node) (*owid.Node, error) {
+// HandleTransaction processes an OpenRTB transaction. The context carries the
+// trace span for the request.
+func HandleTransaction(
+	ctx context.Context,
+	d *common.Domain,
+	n *owid.Node) (*owid.Node, error) {
 
 	// Verify that this domain can create OWIDs. Failure to register a domain
 	// as an OWID creator is a common setup mistake.
@@ -151,15 +186,29 @@ func HandleTransaction(d *common.Domain, n *owid.Node) (*owid.Node, error) {
 		return nil, fmt.Errorf("Could not create new OWID")
 	}
 
-	// If this domain has adverts then choose one at random. Get a random
-	// byte array to use as the payload from the Processor OWID.
-	if len(d.Adverts) > 0 {
+	// The root node must be the SWAN ID.
+	id, err := swan.IDFromNode(n.GetRoot())
+	if err != nil {
+		return nil, err
+	}
 
-		// The root node must be the SWAN ID.
-		id, err := swan.IDFromNode(n.GetRoot())
+	// The transaction uses the SWAN ID for advertising. If the user has denied
+	// personalized advertising or this domain then it must not take part in
+	// the transaction so it responds with an empty payload and does not pass
+	// the transaction on to its suppliers.
+	p := common.PreferencesFromID(id)
+	if p.Allowed(common.PurposePersonalizedAds, d.Host) == false {
+		t.Payload, err = empty.AsByteArray()
 		if err != nil {
 			return nil, err
 		}
+		auctionResponses.Inc(d.Host, common.Role(&empty))
+		return addProcessor(oc, n, parent, t)
+	}
+
+	// If this domain has adverts then choose one at random. Get a random
+	// byte array to use as the payload from the Processor OWID.
+	if len(d.Adverts) > 0 {
 
 		// Get a random advert checking that it is not on the stopped list.
 		var b swan.Bid
@@ -170,48 +219,68 @@ func HandleTransaction(d *common.Domain, n *owid.Node) (*owid.Node, error) {
 				b.AdvertiserURL = w.AdvertiserURL
 				b.MediaURL = w.MediaURL
 				t.Payload, err = b.AsByteArray()
+				auctionResponses.Inc(d.Host, common.Role(&b))
 				break
 			}
 			i--
 		}
 		if i == 0 {
 			t.Payload, err = empty.AsByteArray()
+			auctionResponses.Inc(d.Host, common.Role(&empty))
 		}
 	} else {
 		t.Payload, err = empty.AsByteArray()
+		auctionResponses.Inc(d.Host, common.Role(&empty))
 	}
 	if err != nil {
 		return nil, err
 	}
 
-	// Sign the Processor OWID with the root OWID now that it's part of the
-	// tree. This can be used by down stream suppliers to verify that this
-	// processor was involved in the transaction.
-	r, err := n.GetOWID()
+	n, err = addProcessor(oc, n, parent, t)
 	if err != nil {
 		return nil, err
 	}
-	err = oc.Sign(t, r)
-	if err != nil {
-		return nil, err
+
+	// Send the transaction on to any suppliers.
+	if len(d.Suppliers) > 0 {
+		return SendToSuppliers(ctx, d, n)
 	}
+	return n, nil
+}
 
-	// Add this signed Processor OWID to the children of the parent.
-	n, err = parent.AddOWID(t)
+// addProcessor signs the Processor OWID t with the root OWID of the
+// transaction n now that it's part of the tree. This can be used by down
+// stream suppliers to verify that this processor was involved in the
+// transaction. The signed OWID is then added to the children of the parent.
+func addProcessor(
+	oc *owid.Creator,
+	n *owid.Node,
+	parent *owid.Node,
+	t *owid.OWID) (*owid.Node, error) {
+	r, err := n.GetOWID()
 	if err != nil {
 		return nil, err
 	}
-
-	// Send the transaction on to any suppliers.
-	if len(d.Suppliers) > 0 {
-		return SendToSuppliers(d, n)
+	err = oc.Sign(t, r)
+	if err != nil {
+		return nil, err
 	}
-	return n, nil
+	return parent.AddOWID(t)
 }
 
-func SendToSuppliers(d *common.Domain, n *owid.Node) (*owid.Node, error) {
+// SendToSuppliers sends the transaction to all the suppliers of the domain and
+// adds their responses as children of the node. The context carries the trace
+// span that the calls to the suppliers are part of.
+func SendToSuppliers(
+	ctx context.Context,
+	d *common.Domain,
+	n *owid.Node) (*owid.Node, error) {
 	var err error
 
+	// Record the number of suppliers and how long they take to respond.
+	auctionSuppliers.Observe(float64(len(d.Suppliers)), d.Host)
+	defer auctionDuration.ObserveSince(time.Now(), d.Host)
+
 	// Call all the suppliers adding them to this Processor OWID's child
 	// transactions.
 	var wg sync.WaitGroup
@@ -221,7 +290,7 @@ func SendToSuppliers(d *common.Domain, n *owid.Node) (*owid.Node, error) {
 	for i, s := range d.Suppliers {
 		go func(i int, s string) {
 			defer wg.Done()
-			c[i], e[i] = sendToSupplier(d, s, n)
+			c[i], e[i] = sendToSupplier(ctx, d, s, n)
 		}(i, s)
 	}
 	wg.Wait()
@@ -298,18 +367,25 @@ func getID(d *common.Domain, r *http.Request) (*owid.Node, error) {
 	if err != nil {
 		return nil, err
 	}
-	if d.Config.Debug {
-		fmt.Println(d.Host)
-		fmt.Println(string(b))
-	}
+	common.LoggerFrom(r.Context()).Debug(
+		"transaction received",
+		"bytes", len(b),
+		"body", string(b))
 	return owid.NodeFromJSON(b)
 }
 
 func sendToSupplier(
+	ctx context.Context,
 	d *common.Domain,
 	s string,
 	n *owid.Node) (*owid.Node, error) {
 
+	// Trace the call to the supplier which continues the trace when it
+	// handles the request.
+	ctx, sp := common.StartSpan(ctx, d, "supplier "+s, common.SpanClient)
+	defer sp.End()
+	sp.SetAttribute("peer.host", s)
+
 	// Turn the node into a byte array.
 	j, err := n.GetRoot().AsJSON()
 	if err != nil {
@@ -321,16 +397,32 @@ func sendToSupplier(
 	up.Scheme = d.Config.Scheme
 	up.Host = s
 	up.Path = openRTBPath
-	res, err := http.Post(
-		up.String(),
-		"application/json",
-		bytes.NewBuffer(j))
+	q, err := http.NewRequest("POST", up.String(), bytes.NewBuffer(j))
 	if err != nil {
+		sp.SetError(err)
+		return nil, err
+	}
+	q.Header.Set("Content-Type", "application/json")
+	common.InjectTrace(ctx, q)
+	st := time.Now()
+	res, err := http.DefaultClient.Do(q)
+	supplierDuration.ObserveSince(st, d.Host, s)
+	if err != nil {
+		sp.SetError(err)
+		if e, ok := err.(net.Error); ok && e.Timeout() {
+			supplierResults.Inc(d.Host, s, "timeout")
+		} else {
+			supplierResults.Inc(d.Host, s, "error")
+		}
 		return nil, err
 	}
+	defer res.Body.Close()
 	if res.StatusCode != http.StatusOK {
+		supplierResults.Inc(d.Host, s, "status")
+		sp.SetError(fmt.Errorf("Status code '%d'", res.StatusCode))
 		return createFailed(d, n, &up, res)
 	}
+	supplierResults.Inc(d.Host, s, "ok")
 
 	// Read the response as a byte array.
 	b, err := ioutil.ReadAll(res.Body)
@@ -356,6 +448,7 @@ func createFailed(
 	var f swan.Failed
 	f.Host = u.Host
 	f.Error = fmt.Sprintf("%d", res.StatusCode)
+	auctionResponses.Inc(u.Host, common.Role(&f))
 	b, err := f.AsByteArray()
 	if err != nil {
 		return nil, err
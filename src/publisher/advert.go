@@ -0,0 +1,70 @@
+/* ****************************************************************************
+ * Copyright 2020 51 Degrees Mobile Experts Limited (51degrees.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations
+ * under the License.
+ * ***************************************************************************/
+
+package publisher
+
+import (
+	"bytes"
+	"common"
+	"html/template"
+	"owid"
+	"swan"
+)
+
+// Icon used for the link to the CMP advert information page.
+const defaultInfoIcon = "noun_Info_1582932.svg"
+
+// defaultAdvertTemplate is used if the publisher does not provide an
+// advert-[placement].html or advert.html template.
+var defaultAdvertTemplate = template.Must(template.New("advert.html").Parse(
+	`<form method="POST" action="//{{ .Bid.AdvertiserURL }}">` +
+		`<div class="form-group">` +
+		`<input type="hidden" id="transaction" name="transaction" value="{{ .Transaction }}">` +
+		`<button type="submit" id="view" name="view" class="advert-button">` +
+		`<img src="//{{ .Bid.MediaURL }}">` +
+		`</button>` +
+		`<a href="{{ .InfoURL }}" class="advert-stop" title="Info about this advert">` +
+		`<img src="{{ .InfoIcon }}">` +
+		`</a>` +
+		`</div>` +
+		`</form>`))
+
+// Advert is the model used with the advert templates. Publishers can provide
+// an advert-[placement].html template for a specific placement, or an
+// advert.html template for all placements, to change the markup, labels and
+// disclosure text of their adverts.
+type Advert struct {
+	Placement   string     // The placement the advert will be displayed in
+	Bid         *swan.Bid  // The winning bid
+	Winner      *owid.Node // The node in the OWID tree of the winning bid
+	Transaction string     // The OWID tree as a base 64 string
+	InfoURL     string     // The URL of the CMP advert information page
+	InfoIcon    string     // The path of the icon for the information link
+}
+
+// html returns the advert rendered with the template for the placement.
+func (a *Advert) html(d *common.Domain) (template.HTML, error) {
+	t := d.LookupHTMLWithDefault(
+		defaultAdvertTemplate,
+		"advert-"+a.Placement+".html",
+		"advert.html")
+	var b bytes.Buffer
+	err := t.Execute(&b, a)
+	if err != nil {
+		return "", err
+	}
+	return template.HTML(b.String()), nil
+}
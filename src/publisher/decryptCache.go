@@ -0,0 +1,249 @@
+/* ****************************************************************************
+ * Copyright 2020 51 Degrees Mobile Experts Limited (51degrees.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations
+ * under the License.
+ * ***************************************************************************/
+
+package publisher
+
+import (
+	"common"
+	"container/list"
+	"context"
+	"swan"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults used if the configuration does not provide values for the cache.
+const (
+	defaultDecryptCacheSize    = 10000
+	defaultDecryptCacheSeconds = 300
+	defaultDecryptStaleSeconds = 86400
+)
+
+// DecryptCacheStats contains the counters for the decryption cache.
+type DecryptCacheStats struct {
+	Entries int    // Number of entries currently in the cache
+	Hits    uint64 // Requests answered from fresh entries
+	Misses  uint64 // Requests that needed the access node
+	Stale   uint64 // Requests answered from stale entries in degraded mode
+	Failed  uint64 // Requests where the access node could not be reached
+}
+
+// HitRate returns the proportion of requests answered from the cache.
+func (s DecryptCacheStats) HitRate() float64 {
+	t := s.Hits + s.Misses
+	if t == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(t)
+}
+
+// decryptCache is a bounded cache of the SWAN data returned by the access node
+// keyed on the encrypted string. The least recently used entries are removed
+// when the cache is full. Entries older than fresh are decrypted again, but
+// can still be used until stale if the access node can't be reached.
+type decryptCache struct {
+	mutex   sync.Mutex
+	size    int
+	fresh   time.Duration
+	stale   time.Duration
+	entries map[string]*list.Element
+	order   *list.List // Most recently used at the front
+	hits    uint64
+	misses  uint64
+	staled  uint64
+	failed  uint64
+}
+
+// decryptEntry is an item in the decryption cache.
+type decryptEntry struct {
+	key     string
+	pairs   []*swan.Pair
+	created time.Time
+}
+
+var cache atomic.Value  // The single *decryptCache used by all publishers
+var cacheOnce sync.Once // Used to create the cache from the configuration
+
+func init() {
+	common.NewGaugeFunc(
+		"swan_demo_decrypt_cache_entries",
+		"Entries in the publisher decryption cache.",
+		func() float64 { return float64(GetDecryptCacheStats().Entries) })
+	common.NewCounterFunc(
+		"swan_demo_decrypt_cache_hits_total",
+		"Requests answered from fresh entries in the decryption cache.",
+		func() float64 { return float64(GetDecryptCacheStats().Hits) })
+	common.NewCounterFunc(
+		"swan_demo_decrypt_cache_misses_total",
+		"Requests to the decryption cache that needed the access node.",
+		func() float64 { return float64(GetDecryptCacheStats().Misses) })
+	common.NewCounterFunc(
+		"swan_demo_decrypt_cache_stale_total",
+		"Requests answered from stale entries in degraded mode.",
+		func() float64 { return float64(GetDecryptCacheStats().Stale) })
+	common.NewCounterFunc(
+		"swan_demo_decrypt_cache_failed_total",
+		"Requests where the access node could not be reached.",
+		func() float64 { return float64(GetDecryptCacheStats().Failed) })
+	common.NewGaugeFunc(
+		"swan_demo_decrypt_cache_hit_ratio",
+		"Proportion of requests answered from fresh entries in the "+
+			"decryption cache.",
+		func() float64 { return GetDecryptCacheStats().HitRate() })
+}
+
+// getDecryptCache returns the cache creating it from the configuration the
+// first time it's used.
+func getDecryptCache(c *common.Configuration) *decryptCache {
+	cacheOnce.Do(func() {
+		cache.Store(newDecryptCache(
+			c.DecryptCacheSize,
+			c.DecryptCacheSeconds,
+			c.DecryptStaleSeconds))
+	})
+	return cache.Load().(*decryptCache)
+}
+
+func newDecryptCache(size int, fresh int, stale int) *decryptCache {
+	if size <= 0 {
+		size = defaultDecryptCacheSize
+	}
+	if fresh <= 0 {
+		fresh = defaultDecryptCacheSeconds
+	}
+	if stale <= 0 {
+		stale = defaultDecryptStaleSeconds
+	}
+	if stale < fresh {
+		stale = fresh
+	}
+	return &decryptCache{
+		size:    size,
+		fresh:   time.Duration(fresh) * time.Second,
+		stale:   time.Duration(stale) * time.Second,
+		entries: make(map[string]*list.Element),
+		order:   list.New()}
+}
+
+// GetDecryptCacheStats returns the current counters for the decryption cache.
+func GetDecryptCacheStats() DecryptCacheStats {
+	var s DecryptCacheStats
+	c, _ := cache.Load().(*decryptCache)
+	if c == nil {
+		return s
+	}
+	c.mutex.Lock()
+	s.Entries = c.order.Len()
+	c.mutex.Unlock()
+	s.Hits = atomic.LoadUint64(&c.hits)
+	s.Misses = atomic.LoadUint64(&c.misses)
+	s.Stale = atomic.LoadUint64(&c.staled)
+	s.Failed = atomic.LoadUint64(&c.failed)
+	return s
+}
+
+// decrypt returns the SWAN data for the encrypted value v. Fresh entries are
+// returned from the cache. Otherwise the access node is used and the result
+// added to the cache. If the access node can't be reached then a stale entry
+// is returned if present and degraded is set to true.
+func (c *decryptCache) decrypt(
+	ctx context.Context,
+	d *common.Domain,
+	v string) (p []*swan.Pair, degraded bool, e *swan.Error) {
+
+	// The access key is specific to the publisher so the host forms part of
+	// the key.
+	k := d.Host + " " + v
+
+	// Return the entry if it is fresh.
+	n, a := c.get(k)
+	if n != nil && a < c.fresh {
+		atomic.AddUint64(&c.hits, 1)
+		return n.pairs, false, nil
+	}
+	atomic.AddUint64(&c.misses, 1)
+
+	// Ask the access node to decrypt the data.
+	_, sp := common.StartSpan(ctx, d, "swan decrypt", common.SpanClient)
+	defer sp.End()
+	sp.SetAttribute("peer.host", d.SWANAccessNode)
+	s := time.Now()
+	p, e = d.SWAN().Decrypt(v)
+	if e != nil {
+		sp.SetError(e)
+		common.SWANDuration.ObserveSince(s, d.Host, "decrypt", "error")
+		if isUnreachable(e) {
+			atomic.AddUint64(&c.failed, 1)
+			if n != nil && a < c.stale {
+				atomic.AddUint64(&c.staled, 1)
+				return n.pairs, true, nil
+			}
+		}
+		return nil, false, e
+	}
+	common.SWANDuration.ObserveSince(s, d.Host, "decrypt", "ok")
+	c.add(k, p)
+	return p, false, nil
+}
+
+// get returns the entry and its age, or nil if there is no entry for the key.
+func (c *decryptCache) get(k string) (*decryptEntry, time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	i, ok := c.entries[k]
+	if ok == false {
+		return nil, 0
+	}
+	n := i.Value.(*decryptEntry)
+	a := time.Since(n.created)
+	if a >= c.stale {
+		c.order.Remove(i)
+		delete(c.entries, k)
+		return nil, 0
+	}
+	c.order.MoveToFront(i)
+	return n, a
+}
+
+// add the pairs to the cache removing the least recently used entries if the
+// cache is full.
+func (c *decryptCache) add(k string, p []*swan.Pair) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if i, ok := c.entries[k]; ok {
+		n := i.Value.(*decryptEntry)
+		n.pairs = p
+		n.created = time.Now()
+		c.order.MoveToFront(i)
+		return
+	}
+	c.entries[k] = c.order.PushFront(&decryptEntry{
+		key:     k,
+		pairs:   p,
+		created: time.Now()})
+	for c.order.Len() > c.size {
+		i := c.order.Back()
+		c.order.Remove(i)
+		delete(c.entries, i.Value.(*decryptEntry).key)
+	}
+}
+
+// isUnreachable returns true if the error indicates the access node could not
+// be reached or failed, rather than rejecting the data provided.
+func isUnreachable(e *swan.Error) bool {
+	return e.Response == nil || e.Response.StatusCode >= 500
+}
@@ -19,11 +19,12 @@ package publisher
 import (
 	"common"
 	"compress/gzip"
+	"context"
 	"fmt"
 	"fod"
-	"log"
 	"net/http"
 	"net/url"
+	"strings"
 	"swan"
 	"swanop"
 	"time"
@@ -38,8 +39,15 @@ func Handler(d *common.Domain, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Try the URL path for the preference values.
-	p, ae := newSWANDataFromPath(d, r)
+	// Check to see if this request is for the AMP variant of the pages.
+	if strings.HasPrefix(r.URL.Path, "/amp/") {
+		handlerAMP(d, w, r)
+		return
+	}
+
+	// Try the URL path for the preference values. If the access node can't be
+	// reached then the page is displayed in degraded mode using the cookies.
+	p, degraded, ae := newSWANDataFromPath(d, r)
 	if ae != nil {
 
 		// If the data can't be decrypted rather than another type of error then
@@ -48,15 +56,21 @@ func Handler(d *common.Domain, w http.ResponseWriter, r *http.Request) {
 			if d.SwanPostMessage == false {
 				http.Redirect(w, r, getCMPURL(d, r, nil), 303)
 			} else {
-				handlerPublisherPage(d, w, r, p)
+				handlerPublisherPage(d, w, r, p, false)
 			}
 			return
 		}
-		common.ReturnServerError(d.Config, w, ae)
-		return
+		if isUnreachable(ae) == false {
+			common.ReturnServerError(d.Config, w, r, ae)
+			return
+		}
+		common.LoggerFrom(r.Context()).Warn(
+			"access node unreachable, using cookies",
+			"error", ae)
+		degraded = true
 	}
 	if p != nil {
-		redirectToCleanURL(d.Config, w, r, p)
+		redirectToCleanURL(d, w, r, p, degraded)
 		return
 	}
 
@@ -64,19 +78,29 @@ func Handler(d *common.Domain, w http.ResponseWriter, r *http.Request) {
 	if p == nil {
 		var err error
 		p, err = newSWANDataFromCookies(r)
-		if err != nil && d.Config.Debug {
-			log.Println(err.Error())
+		if err != nil {
+			common.LoggerFrom(r.Context()).Debug(
+				"SWAN data not read from cookies",
+				"error", err)
 		}
+		degraded = degraded || degradedRedirect(w, r)
+	}
+
+	// If the access node can't be reached then there is no point in
+	// redirecting to SWAN.
+	if degraded {
+		handlerPublisherPage(d, w, r, p, true)
+		return
 	}
 
 	// If the request is from a crawler than ignore SWAN.
 	c, err := fod.GetCrawlerFrom51Degrees(r)
 	if err != nil {
-		common.ReturnServerError(d.Config, w, err)
+		common.ReturnServerError(d.Config, w, r, err)
 		return
 	}
 	if c {
-		handlerPublisherPage(d, w, r, p)
+		handlerPublisherPage(d, w, r, p, false)
 		return
 	}
 
@@ -95,7 +119,7 @@ func Handler(d *common.Domain, w http.ResponseWriter, r *http.Request) {
 				revalidateNeeded(p) {
 				redirectToSWANFetch(d, w, r, p)
 			} else {
-				handlerPublisherPage(d, w, r, p)
+				handlerPublisherPage(d, w, r, p, false)
 			}
 		} else {
 			http.Redirect(w, r, getCMPURL(d, r, p), 303)
@@ -104,7 +128,7 @@ func Handler(d *common.Domain, w http.ResponseWriter, r *http.Request) {
 		if d.SwanPostMessage == false && d.SwanJavaScript == false {
 			redirectToSWANFetch(d, w, r, p)
 		} else {
-			handlerPublisherPage(d, w, r, p)
+			handlerPublisherPage(d, w, r, p, false)
 		}
 	}
 }
@@ -113,7 +137,8 @@ func handlerPublisherPage(
 	d *common.Domain,
 	w http.ResponseWriter,
 	r *http.Request,
-	p []*swan.Pair) {
+	p []*swan.Pair,
+	degraded bool) {
 	t := d.LookupHTML(r.URL.Path)
 	if t == nil {
 		http.NotFound(w, r)
@@ -123,6 +148,7 @@ func handlerPublisherPage(
 	m.Domain = d
 	m.Request = r
 	m.swanData = p
+	m.degraded = degraded
 	g := gzip.NewWriter(w)
 	defer g.Close()
 	w.Header().Set("Content-Encoding", "gzip")
@@ -130,7 +156,7 @@ func handlerPublisherPage(
 	w.Header().Set("Cache-Control", "no-cache")
 	err := t.Execute(g, &m)
 	if err != nil {
-		common.ReturnServerError(d.Config, w, err)
+		common.ReturnServerError(d.Config, w, r, err)
 	}
 }
 
@@ -144,39 +170,77 @@ func newSWANDataFromCookies(r *http.Request) ([]*swan.Pair, error) {
 	return p, nil
 }
 
+// newSWANData returns the SWAN data for the encrypted value v using the
+// decryption cache. degraded is true if the access node could not be reached
+// and recently decrypted data has been returned. The context carries the trace
+// span for the request.
 func newSWANData(
+	ctx context.Context,
 	d *common.Domain,
-	v string) ([]*swan.Pair, *swan.Error) {
-	return d.SWAN().Decrypt(v)
+	v string) ([]*swan.Pair, bool, *swan.Error) {
+	return getDecryptCache(d.Config).decrypt(ctx, d, v)
 }
 
 // Get the section of the URL that has the SWAN data.
 func newSWANDataFromPath(
 	d *common.Domain,
-	r *http.Request) ([]*swan.Pair, *swan.Error) {
+	r *http.Request) ([]*swan.Pair, bool, *swan.Error) {
 	b := common.GetSWANDataFromRequest(r)
 	if b == "" {
-		return nil, nil
+		return nil, false, nil
 	}
-	return newSWANData(d, b)
+	return newSWANData(r.Context(), d, b)
 }
 
+// Cookie set when redirecting to the clean URL with stale data so that the page
+// is displayed in degraded mode.
+const (
+	degradedCookie        = "swan-degraded"
+	degradedCookieSeconds = 60
+)
+
 // SWAN data could be obtained from the URL. Remove the SWAN data string from
 // the URL and redirect back to the page. Set cookies in the redirect so that
-// the data is persisted.
+// the data is persisted. If the data is stale because the access node could
+// not be reached then a cookie is also set so that the page after the redirect
+// is displayed in degraded mode.
 func redirectToCleanURL(
-	c *common.Configuration,
+	d *common.Domain,
 	w http.ResponseWriter,
 	r *http.Request,
-	p []*swan.Pair) {
-	u := common.GetCleanURL(c, r).String()
-	if c.Debug {
-		log.Printf("Redirecting to '%s'\n", u)
-	}
+	p []*swan.Pair,
+	degraded bool) {
+	u := common.GetCleanURL(d, r).String()
+	common.LoggerFrom(r.Context()).Debug("redirecting to clean URL", "url", u)
 	setCookies(r, w, p)
+	if degraded {
+		http.SetCookie(w, &http.Cookie{
+			Name:     degradedCookie,
+			Value:    "1",
+			Path:     "/",
+			MaxAge:   degradedCookieSeconds,
+			HttpOnly: true,
+			Secure:   d.Config.Scheme == "https",
+			SameSite: http.SameSiteLaxMode})
+	}
 	http.Redirect(w, r, u, 303)
 }
 
+// degradedRedirect returns true if the request follows a redirect to the clean
+// URL with stale data, and removes the cookie so that later requests are not
+// affected.
+func degradedRedirect(w http.ResponseWriter, r *http.Request) bool {
+	_, err := r.Cookie(degradedCookie)
+	if err != nil {
+		return false
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:   degradedCookie,
+		Path:   "/",
+		MaxAge: -1})
+	return true
+}
+
 // Redirect back to the current URL after fetching the SWAN data. If SWAN data
 // does not exist then use the values contained in the swan pairs provided in
 // parameter p.
@@ -185,22 +249,28 @@ func redirectToSWANFetch(
 	w http.ResponseWriter,
 	r *http.Request,
 	p []*swan.Pair) {
-	u, err := getSWANURL(d, r, p)
+	u, err := getSWANURL(d, w, r, p)
 	if err != nil {
-		common.ReturnProxyError(d.Config, w, err)
+		if isUnreachable(err) {
+			handlerPublisherPage(d, w, r, p, true)
+			return
+		}
+		common.ReturnProxyError(d.Config, w, r, err)
 		return
 	}
 	http.Redirect(w, r, u, 303)
 }
 
+// getSWANURL returns the URL to redirect to for the SWAN fetch operation. The
+// call to the access node is traced. w is nil if the response has already
+// started, in which case the trace is not continued after SWAN.
 func getSWANURL(
 	d *common.Domain,
+	w http.ResponseWriter,
 	r *http.Request,
 	p []*swan.Pair) (string, *swan.Error) {
-	return d.SWAN().NewFetch(
-		r,
-		common.GetCleanURL(d.Config, r).String(),
-		p).GetURL()
+	f := d.SWAN().NewFetch(r, common.GetCleanURL(d, r).String(), p)
+	return common.TraceSWANURL(w, r, d, "swan fetch", f.GetURL)
 }
 
 func getHomeNode(
@@ -226,7 +296,7 @@ func getCMPURL(d *common.Domain, r *http.Request, p []*swan.Pair) string {
 	u.Host = d.CMP
 	u.Path = "/preferences/"
 	q := u.Query()
-	q.Set("returnUrl", common.GetCleanURL(d.Config, r).String())
+	q.Set("returnUrl", common.GetCleanURL(d, r).String())
 	q.Set("accessNode", d.SWANAccessNode)
 	if d.CmpNodeCount > 0 {
 		q.Set("nodeCount", fmt.Sprintf("%d", d.CmpNodeCount))
@@ -0,0 +1,293 @@
+/* ****************************************************************************
+ * Copyright 2020 51 Degrees Mobile Experts Limited (51degrees.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations
+ * under the License.
+ * ***************************************************************************/
+
+package publisher
+
+import (
+	"common"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ampConsent is the response returned to the amp-consent component's
+// checkConsentHref request.
+type ampConsent struct {
+	ConsentRequired   bool              `json:"consentRequired"`
+	ConsentStateValue string            `json:"consentStateValue"`
+	ConsentString     string            `json:"consentString,omitempty"`
+	SharedData        map[string]string `json:"sharedData,omitempty"`
+}
+
+// ampAdvert is the response returned to the amp-ad custom component and used
+// with the amp-mustache template contained in the page.
+type ampAdvert struct {
+	Placement     string `json:"placement"`
+	AdvertiserURL string `json:"advertiserUrl,omitempty"`
+	MediaURL      string `json:"mediaUrl,omitempty"`
+	InfoURL       string `json:"infoUrl,omitempty"`
+	Message       string `json:"message,omitempty"`
+}
+
+// handlerAMP for the AMP variant of the publisher web pages. AMP pages can't
+// be redirected to SWAN or include arbitrary JavaScript. The SWAN data is
+// therefore only ever taken from the cookies, or from the path when returning
+// from the CMP, and endpoints on the publisher domain are used by the
+// amp-consent and amp-ad components to get the SWAN state and the adverts.
+func handlerAMP(d *common.Domain, w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/amp/consent":
+		handlerAMPConsent(d, w, r)
+		break
+	case "/amp/advert":
+		handlerAMPAdvert(d, w, r)
+		break
+	default:
+		handlerAMPPage(d, w, r)
+		break
+	}
+}
+
+// handlerAMPPage returns the amp.html template for the publisher.
+func handlerAMPPage(d *common.Domain, w http.ResponseWriter, r *http.Request) {
+
+	// Only the AMP template can be used. The category and default templates
+	// are not AMP valid.
+	t := d.LookupHTML("amp.html")
+	if t == nil || t.Name() != "amp.html" {
+		http.NotFound(w, r)
+		return
+	}
+
+	// If the user has just returned from the CMP then the SWAN data will be in
+	// the path. Store it in cookies and redirect to the clean AMP URL. If the
+	// data can't be decrypted then the cookies are used.
+	p, degraded, ae := newSWANDataFromPath(d, r)
+	if ae != nil {
+		common.LoggerFrom(r.Context()).Warn(
+			"SWAN data not decrypted",
+			"error", ae)
+		degraded = isUnreachable(ae)
+	}
+	if p != nil {
+		redirectToCleanURL(d, w, r, p, degraded)
+		return
+	}
+	p, err := newSWANDataFromCookies(r)
+	if err != nil {
+		common.LoggerFrom(r.Context()).Debug(
+			"SWAN data not read from cookies",
+			"error", err)
+	}
+	degraded = degraded || degradedRedirect(w, r)
+
+	var m Model
+	m.Domain = d
+	m.Request = r
+	m.swanData = p
+	m.degraded = degraded
+	g := gzip.NewWriter(w)
+	defer g.Close()
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	err = t.Execute(g, &m)
+	if err != nil {
+		common.ReturnServerError(d.Config, w, r, err)
+	}
+}
+
+// handlerAMPConsent returns the SWAN state from the cookies in the form
+// expected by the amp-consent component. If the SWAN data is not complete
+// then the consent state is unknown and amp-consent will display the prompt
+// that links to the CMP.
+func handlerAMPConsent(
+	d *common.Domain,
+	w http.ResponseWriter,
+	r *http.Request) {
+	var m Model
+	m.Domain = d
+	m.Request = r
+	// If the cookies can't be read then the consent state is unknown rather
+	// than an error so that amp-consent displays the prompt.
+	p, err := newSWANDataFromCookies(r)
+	if err != nil {
+		common.LoggerFrom(r.Context()).Debug(
+			"SWAN data not read from cookies",
+			"error", err)
+		p = nil
+	}
+	m.swanData = p
+
+	var c ampConsent
+	c.ConsentRequired = true
+	if isSet(p) {
+		if m.Personalized() {
+			c.ConsentStateValue = "accepted"
+		} else {
+			c.ConsentStateValue = "rejected"
+		}
+		c.ConsentString = m.SWIDAsString()
+		c.SharedData = map[string]string{
+			"swid":       m.SWIDAsString(),
+			"swidDomain": m.SWIDDomain(),
+			"pref":       m.PrefAsString(),
+			"prefDomain": m.PrefDomain(),
+			"cmpUrl":     m.CMPURL()}
+	} else {
+		c.ConsentStateValue = "unknown"
+		c.SharedData = map[string]string{"cmpUrl": m.CMPURL()}
+	}
+
+	b, err := json.Marshal(&c)
+	if err != nil {
+		common.ReturnServerError(d.Config, w, r, err)
+		return
+	}
+	sendAMPJSON(d, w, r, b)
+}
+
+// handlerAMPAdvert returns the advert for the placement in the form expected
+// by the amp-ad custom component.
+func handlerAMPAdvert(
+	d *common.Domain,
+	w http.ResponseWriter,
+	r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		common.ReturnServerError(d.Config, w, r, err)
+		return
+	}
+
+	// AMP pages are not able to pass encrypted data so the cookies must be
+	// used.
+	var m Model
+	m.Domain = d
+	m.Request = r
+	m.swanData, err = newSWANDataFromCookies(r)
+	if err != nil {
+		common.ReturnStatusCodeError(d.Config, w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	a, err := m.newAMPAdvert(r.Form.Get("placement"))
+	if err != nil {
+		common.ReturnServerError(d.Config, w, r, err)
+		return
+	}
+
+	b, err := json.Marshal(a)
+	if err != nil {
+		common.ReturnServerError(d.Config, w, r, err)
+		return
+	}
+	sendAMPJSON(d, w, r, b)
+}
+
+// newAMPAdvert uses the same logic as NewAdvertHTML to return the advert for
+// the placement. Problems with the SWAN data or the supply chain are returned
+// as a message to display in place of the advert.
+func (m *Model) newAMPAdvert(placement string) (*ampAdvert, error) {
+	var a ampAdvert
+	a.Placement = placement
+	if m.PrefAsString() == "" {
+		a.Message = "Preferences not set"
+		return &a, nil
+	}
+	n, err := m.newSWANIDNode()
+	if err != nil {
+		return nil, err
+	}
+	v, err := m.newAdvert(n, placement)
+	if err != nil {
+		a.Message = err.Error()
+		return &a, nil
+	}
+
+	// The amp-ad custom template can't post a form so the transaction is added
+	// to the query string of the advertiser URL, keeping any parameters the
+	// advertiser URL already has.
+	u, err := url.Parse("//" + v.Bid.AdvertiserURL)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	q.Set("transaction", v.Transaction)
+	u.RawQuery = q.Encode()
+	a.AdvertiserURL = u.String()
+	a.MediaURL = "//" + v.Bid.MediaURL
+	a.InfoURL = v.InfoURL
+	return &a, nil
+}
+
+// sendAMPJSON writes the JSON response with the headers needed for AMP CORS
+// requests.
+func sendAMPJSON(
+	d *common.Domain,
+	w http.ResponseWriter,
+	r *http.Request,
+	b []byte) {
+	setAMPHeaders(d, w, r)
+	g := gzip.NewWriter(w)
+	defer g.Close()
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	_, err := g.Write(b)
+	if err != nil {
+		common.ReturnServerError(d.Config, w, r, err)
+	}
+}
+
+// setAMPHeaders adds the CORS headers required by the AMP runtime. Only the
+// publisher's own origin and the AMP cache are allowed to read the responses.
+// The AMP runtime adds the __amp_source_origin parameter which must be
+// returned in the AMP-Access-Control-Allow-Source-Origin header.
+func setAMPHeaders(d *common.Domain, w http.ResponseWriter, r *http.Request) {
+	p := fmt.Sprintf("%s://%s", d.Config.Scheme, common.RequestHost(d, r))
+	o := r.Header.Get("Origin")
+	if o == p ||
+		o == "https://cdn.ampproject.org" ||
+		strings.HasSuffix(o, ".cdn.ampproject.org") {
+		w.Header().Set("Access-Control-Allow-Origin", o)
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+	w.Header().Set("AMP-Access-Control-Allow-Source-Origin", p)
+	w.Header().Set(
+		"Access-Control-Expose-Headers",
+		"AMP-Access-Control-Allow-Source-Origin")
+}
+
+// AMPURL returns the absolute URL of the AMP endpoint provided for use with
+// the amp-consent and amp-ad components.
+func (m Model) AMPURL(endpoint string) string {
+	return fmt.Sprintf(
+		"%s://%s/amp/%s",
+		m.Config().Scheme,
+		common.RequestHost(m.Domain, m.Request),
+		endpoint)
+}
+
+// MustacheAttr returns an HTML attribute with the amp-mustache field provided
+// as the value. Needed because the Go template and amp-mustache delimiters are
+// the same and Go templates would otherwise escape the value.
+func (m Model) MustacheAttr(name string, field string) template.HTMLAttr {
+	return template.HTMLAttr(fmt.Sprintf("%s=\"{{%s}}\"", name, field))
+}
@@ -35,26 +35,36 @@ func HandlerAdvert(d *common.Domain, w http.ResponseWriter, r *http.Request) {
 	// Get the form parameters which will include the encrypted data.
 	err := r.ParseForm()
 	if err != nil {
-		common.ReturnServerError(d.Config, w, err)
+		common.ReturnServerError(d.Config, w, r, err)
 		return
 	}
 
 	// See if there is also SWAN data in the request. If so then use it for this
-	// advert and set cookies to store it in the response.
+	// advert and set cookies to store it in the response. If the access node
+	// can't be reached then the cookies are used.
 	if r.Form.Get("encrypted") != "" {
 		var e *swan.Error
-		m.swanData, e = newSWANData(d, r.Form.Get("encrypted"))
-		if e != nil {
-			common.ReturnProxyError(d.Config, w, e)
+		m.swanData, m.degraded, e = newSWANData(
+			r.Context(),
+			d,
+			r.Form.Get("encrypted"))
+		if e != nil && isUnreachable(e) == false {
+			common.ReturnProxyError(d.Config, w, r, e)
 			return
 		}
-		setCookies(r, w, m.swanData)
-	} else {
+		if m.swanData != nil {
+			setCookies(r, w, m.swanData)
+		} else {
+			m.degraded = true
+		}
+	}
+	if m.swanData == nil {
 		m.swanData, err = newSWANDataFromCookies(r)
 		if err != nil {
 			common.ReturnStatusCodeError(
 				d.Config,
 				w,
+				r,
 				err,
 				http.StatusBadRequest)
 		}
@@ -62,6 +72,7 @@ func HandlerAdvert(d *common.Domain, w http.ResponseWriter, r *http.Request) {
 			common.ReturnStatusCodeError(
 				d.Config,
 				w,
+				r,
 				fmt.Errorf("SWAN data cookies missing for request"),
 				http.StatusBadRequest)
 			return
@@ -71,7 +82,7 @@ func HandlerAdvert(d *common.Domain, w http.ResponseWriter, r *http.Request) {
 	// Use the new advert HTML to request the advert.
 	t, err := m.NewAdvertHTML(r.Form.Get("placement"))
 	if err != nil {
-		common.ReturnServerError(d.Config, w, err)
+		common.ReturnServerError(d.Config, w, r, err)
 		return
 	}
 
@@ -83,7 +94,7 @@ func HandlerAdvert(d *common.Domain, w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Cache-Control", "no-cache")
 	_, err = g.Write([]byte(t))
 	if err != nil {
-		common.ReturnServerError(d.Config, w, err)
+		common.ReturnServerError(d.Config, w, r, err)
 		return
 	}
 }
@@ -17,7 +17,6 @@
 package publisher
 
 import (
-	"bytes"
 	"common"
 	"encoding/base64"
 	"fmt"
@@ -36,8 +35,13 @@ import (
 type Model struct {
 	common.PageModel
 	swanData []*swan.Pair // The SWAN data for display
+	degraded bool         // True if the SWAN access node could not be reached
 }
 
+// Degraded returns true if the SWAN access node could not be reached and the
+// page is displayed with recently known SWAN data.
+func (m Model) Degraded() bool { return m.degraded }
+
 // CMPURL returns the URL for the CMP dialog.
 func (m Model) CMPURL() string {
 	return getCMPURL(m.Domain, m.Request, m.swanData)
@@ -47,7 +51,7 @@ func (m Model) CMPURL() string {
 // transaction is completed in a pop up window, iFrame or is a JavaScript
 // include.
 func (m Model) SWANURL() string {
-	u, _ := getSWANURL(m.Domain, m.Request, m.swanData)
+	u, _ := getSWANURL(m.Domain, nil, m.Request, m.swanData)
 	return u
 }
 
@@ -69,7 +73,12 @@ func (m Model) IsNew() bool {
 }
 
 // Personalized returns a boolean to indicate if personalized marketing is enabled.
-func (m Model) Personalized() bool { return m.PrefAsString() == "on" }
+func (m Model) Personalized() bool { return m.Preferences().Personalized() }
+
+// Preferences returns the user's choices for each purpose and vendor.
+func (m Model) Preferences() *common.Preferences {
+	return common.ParsePreferences(m.PrefAsString())
+}
 
 // SWIDAsString Secure Web IDentifier
 func (m Model) SWIDAsString() string { return common.AsStringFromUUID(m.swid()) }
@@ -80,6 +89,11 @@ func (m Model) SIDAsString() string { return common.AsPrintable(m.sid()) }
 // PrefAsString true if personalized marketing allowed, otherwise false
 func (m Model) PrefAsString() string { return common.AsString(m.pref()) }
 
+// PrefSummary returns the user's choices in a form that can be displayed.
+func (m Model) PrefSummary() string {
+	return m.Preferences().Summary(m.Config().GetPurposes())
+}
+
 // SWIDDomain returns the domain that created the SWID OWID
 func (m Model) SWIDDomain() string { return common.OWIDDomain(m.swid()) }
 
@@ -100,18 +114,15 @@ func (m Model) PrefDate() string { return common.OWIDDate(m.pref()) }
 
 // Stopped returns a list of the domains that have been stopped for advertising.
 func (m Model) Stopped() []string {
-	return strings.Split(common.AsString(m.stop()), "\r\n")
+	if m.stop() == nil {
+		return nil
+	}
+	return common.ParseStopList(m.Config(), m.stop().Value).Hosts()
 }
 
 // DomainsByCategory returns all the domains that match the category.
 func (m Model) DomainsByCategory(category string) []*common.Domain {
-	var domains []*common.Domain
-	for _, domain := range m.Domain.Config.Domains {
-		if domain.Category == category {
-			domains = append(domains, domain)
-		}
-	}
-	return domains
+	return m.Domain.Config.DomainsByCategory(category)
 }
 
 // NewAdvertHTML provides the HTML for the advert that will be displayed on the
@@ -123,43 +134,62 @@ func (m Model) NewAdvertHTML(placement string) (template.HTML, error) {
 		return template.HTML("<p>Preferences not set</p>"), nil
 	}
 
-	// Seed the random number generator to get a random advert in the demo.
-	rand.Seed(time.Now().UTC().UnixNano())
-
 	// Use the SWAN network to generate the swan.ID.
 	r, err := m.newSWANIDNode()
 	if err != nil {
 		return "", err
 	}
 
-	// Add the publishers signature and then process the supply chain.
-	_, err = openrtb.SendToSuppliers(m.Domain, r)
+	// Process the supply chain to get the advert for the placement.
+	a, err := m.newAdvert(r, placement)
 	if err != nil {
 		return template.HTML("<p>" + err.Error() + "</p>"), nil
 	}
 
+	// Render the advert with the template for the placement.
+	return a.html(m.Domain)
+}
+
+// newAdvert sends the swan.ID node provided to the suppliers and returns the
+// winning advert for the placement.
+func (m Model) newAdvert(r *owid.Node, placement string) (*Advert, error) {
+	var a Advert
+	a.Placement = placement
+	a.InfoIcon = defaultInfoIcon
+
+	// Seed the random number generator to get a random advert in the demo.
+	rand.Seed(time.Now().UTC().UnixNano())
+
+	// Add the publishers signature and then process the supply chain.
+	_, err := openrtb.SendToSuppliers(m.Request.Context(), m.Domain, r)
+	if err != nil {
+		return nil, err
+	}
+
 	// Get the OWID tree as a base 64 string.
 	e, err := r.AsJSON()
 	if err != nil {
-		return template.HTML("<p>" + err.Error() + "</p>"), nil
+		return nil, err
 	}
+	a.Transaction = base64.RawStdEncoding.EncodeToString(e)
 
 	// Get the winning bid node.
-	w, err := swan.WinningNode(r)
+	a.Winner, err = swan.WinningNode(r)
 	if err != nil {
-		return template.HTML("<p>" + err.Error() + "</p>"), nil
+		return nil, err
 	}
 
 	// Get the winning bid.
-	b, err := swan.WinningBid(r)
+	a.Bid, err = swan.WinningBid(r)
 	if err != nil {
-		return template.HTML("<p>" + err.Error() + "</p>"), nil
+		return nil, err
 	}
 
-	// Get the return URL.
-	t, err := common.GetReturnURL(m.Request)
+	// Get the return URL. If the caller did not provide one that is allowed
+	// then return to this page.
+	t, err := common.GetReturnURL(m.Config(), m.Request)
 	if err != nil {
-		return template.HTML("<p>" + err.Error() + "</p>"), nil
+		t = common.GetCleanURL(m.Domain, m.Request)
 	}
 
 	// Get the URL for the info icon.
@@ -168,7 +198,7 @@ func (m Model) NewAdvertHTML(placement string) (template.HTML, error) {
 	i.Host = m.Domain.CMP
 	i.Path = "/info"
 	q := i.Query()
-	n := w
+	n := a.Winner
 	for n != nil {
 		q.Add("owid", n.GetOWIDAsString())
 		n = n.GetParent()
@@ -180,27 +210,9 @@ func (m Model) NewAdvertHTML(placement string) (template.HTML, error) {
 	q.Set("accessNode", m.Domain.SWANAccessNode)
 
 	i.RawQuery = q.Encode()
+	a.InfoURL = i.String()
 
-	// Return a FORM HTML element with a button for the advert. The OWID tree
-	// is a base 64 string added as a hidden field to the form.
-	var html bytes.Buffer
-	html.WriteString(fmt.Sprintf("<form method=\"POST\" action=\"//%s\">"+
-		"<div class=\"form-group\">"+
-		"<input type=\"hidden\" id=\"transaction\" name=\"transaction\" value=\"%s\">"+
-		"<button type=\"submit\" id=\"view\" name=\"view\" class=\"advert-button\">"+
-		"<img src=\"//%s\">"+
-		"</button>"+
-		"<a href=\"%s\" class=\"advert-stop\" title=\"Info about this advert\">"+
-		"<img src=\"%s\">"+
-		"</a>"+
-		"</div>"+
-		"</form>",
-		b.AdvertiserURL,
-		base64.RawStdEncoding.EncodeToString(e),
-		b.MediaURL,
-		i.String(),
-		"noun_Info_1582932.svg"))
-	return template.HTML(html.String()), nil
+	return &a, nil
 }
 
 // SWID Secure Web IDentifier
@@ -271,8 +283,8 @@ func (m *Model) newSWANID() (*swan.ID, error) {
 		return nil, err
 	}
 
-	// Set the publisher domain from the request.
-	o.PubDomain = m.Request.Host
+	// Set the publisher domain from the domain the request was routed to.
+	o.PubDomain = m.Domain.Host
 
 	// Get the SWID as an OWID.
 	o.SWID, err = getOWID(m.Config(), m.Request, m.swid())
@@ -293,23 +305,26 @@ func (m *Model) newSWANID() (*swan.ID, error) {
 	}
 
 	// Get the stopped adverts string.
-	o.Stopped = getStopped(m.Request, m.stop())
+	o.Stopped = getStopped(m.Config(), m.Request, m.stop())
 
 	return o, nil
 }
 
 // Returns an array of stopped advert IDs. As the parameter is optional no error
 // is returned.
-func getStopped(r *http.Request, p *swan.Pair) []string {
+func getStopped(
+	c *common.Configuration,
+	r *http.Request,
+	p *swan.Pair) []string {
 	var s []string
 
 	// Get stopped adverts from swan pair.
 	if p != nil {
-		s = append(s, strings.Split(p.Value, " ")...)
+		s = append(s, common.ParseStopList(c, p.Value).Hosts()...)
 	}
 
 	// Get stopped adverts from the form.
-	s = append(s, strings.Split(r.FormValue("stop"), " ")...)
+	s = append(s, strings.Fields(r.FormValue("stop"))...)
 
 	return s
 }
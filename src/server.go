@@ -17,84 +17,250 @@
 package main
 
 import (
+	"cmp"
+	"common"
+	"context"
 	"demo"
+	"encoding/json"
+	"flag"
 	"fmt"
-	"log"
+	"io/ioutil"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 )
 
-type HTTPSHandler struct {
-}
+// Timeouts for the HTTP servers.
+const (
+	readTimeout  = 30 * time.Second  // To read the request including the body
+	writeTimeout = 60 * time.Second  // To write the response
+	idleTimeout  = 120 * time.Second // Before closing keep alive connections
+)
 
-func getPortHTTP() string {
-	var port string
-	if os.Getenv("HTTP_PLATFORM_PORT") != "" {
-		// Get the port environment variable from Azure App Services.
-		port = os.Getenv("HTTP_PLATFORM_PORT")
-	} else if os.Getenv("PORT") != "" {
-		// Get the port environment variable from Amazon Web Services.
-		port = os.Getenv("PORT")
+// defaultShutdownSeconds is used if the settings do not set shutdownSeconds.
+const defaultShutdownSeconds = 30
+
+func main() {
+	var err error
+
+	// Verify a complaint evidence bundle if requested. No settings or network
+	// are needed.
+	if len(os.Args) >= 3 && os.Args[1] == "verify-evidence" {
+		os.Exit(verifyEvidence(os.Args[2], os.Args[3:]))
 	}
-	return port
-}
 
-func getPortHTTPS() string {
-	var port string
-	if os.Getenv("HTTPS_PLATFORM_PORT") != "" {
-		// Get the port environment variable from Azure App Services.
-		port = os.Getenv("HTTPS_PLATFORM_PORT")
+	// Check the settings and domains if requested and exit with 1 if there
+	// are problems.
+	if len(os.Args) >= 2 && os.Args[1] == "validate" {
+		os.Exit(validate(os.Args[2:]))
 	}
-	return port
-}
 
-func main() {
-	var err error
-	var settingsFile string
+	// Output the effective settings with secrets masked if requested.
+	if len(os.Args) >= 2 && os.Args[1] == "dump" {
+		os.Exit(dump(os.Args[2:]))
+	}
 
-	// Get the path to the settings file.
-	if len(os.Args) >= 2 {
-		settingsFile = os.Args[1]
-	} else {
-		settingsFile = "appsettings.json"
+	// Get the settings from the files, environment variables and flags.
+	settings, err := common.LoadSettings(os.Args[1:])
+	if err != nil {
+		os.Exit(settingsExitCode(err))
 	}
 
+	// Add the SWAN handlers.
+	c, err := demo.AddHandlers(settings)
+	if err != nil {
+		common.Log.Error("demo not started", "error", err)
+		os.Exit(1)
+	}
+
+	// Register the shutdown hooks now rather than when first used so that they
+	// always run. They are called in reverse order so the email in the outbox
+	// is sent and the trace spans written before the final metrics.
+	c.WriteMetricsOnShutdown()
+	c.Tracer()
+	c.Outbox()
+
 	// Get the ports for HTTP or HTTPS.
-	portHttp := getPortHTTP()
-	portHttps := getPortHTTPS()
+	portHttp := c.HTTPPort
+	portHttps := c.HTTPSPort
 
-	// Add the SWAN handlers.
-	demo.AddHandlers(settingsFile)
+	// Errors from the servers stop the process.
+	errs := make(chan error, 2)
+	var servers []*http.Server
 
-	// Start the HTTPS proxy if there is a provided port.
+	// Start the HTTPS web server if there is a provided port. The certificate
+	// for each host is chosen from the certificates folder.
 	if portHttps != "" {
+		t, err := common.NewCertificates(c)
+		if err != nil {
+			common.Log.Error("certificates not loaded", "error", err)
+			os.Exit(1)
+		}
+		for _, p := range t.Check(c.Domains()) {
+			common.Log.Warn("certificate problem", "problem", p)
+		}
+		s := newServer(portHttps, http.DefaultServeMux)
+		s.TLSConfig = t.TLSConfig()
+		servers = append(servers, s)
 		go func() {
-			log.Printf("Listenning on HTTPS port: %s\n", portHttps)
-			err := http.ListenAndServeTLS(
-				fmt.Sprintf(":%s", portHttps),
-				"uk.crt",
-				"uk.key",
-				&HTTPSHandler{})
-			if err != nil {
-				log.Println(err)
-			}
+			common.Log.Info("listening for HTTPS", "port", portHttps)
+			errs <- s.ListenAndServeTLS("", "")
 		}()
 	}
 
 	// Start the HTTP web server on the port provided.
-	log.Printf("Listenning on HTTP port: %s\n", portHttp)
-	err = http.ListenAndServe(fmt.Sprintf(":%s", portHttp), nil)
+	s := newServer(portHttp, http.DefaultServeMux)
+	servers = append(servers, s)
+	go func() {
+		common.Log.Info("listening for HTTP", "port", portHttp)
+		errs <- s.ListenAndServe()
+	}()
+
+	// Wait for a signal to stop or for a server to fail.
+	q := make(chan os.Signal, 1)
+	signal.Notify(q, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case g := <-q:
+		common.Log.Info("shutting down", "signal", g)
+		break
+	case err = <-errs:
+		common.Log.Error("server failed", "error", err)
+		break
+	}
+	shutdown(c, servers)
+}
+
+// newServer returns a server for the port and handler with timeouts so that
+// slow or idle clients can't hold connections open.
+func newServer(port string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:         fmt.Sprintf(":%s", port),
+		Handler:      handler,
+		ReadTimeout:  readTimeout,
+		WriteTimeout: writeTimeout,
+		IdleTimeout:  idleTimeout}
+}
+
+// shutdown stops the servers accepting new requests and waits for the
+// requests in progress to finish, up to shutdownSeconds from the settings.
+// The shutdown hooks are then called with the time that is left, for example
+// to send email waiting in the outbox.
+func shutdown(c *common.Configuration, servers []*http.Server) {
+	common.SetReady(false)
+	t := c.ShutdownSeconds
+	if t <= 0 {
+		t = defaultShutdownSeconds
+	}
+	ctx, cancel := context.WithTimeout(
+		context.Background(),
+		time.Duration(t)*time.Second)
+	defer cancel()
+	var w sync.WaitGroup
+	for _, s := range servers {
+		w.Add(1)
+		go func(s *http.Server) {
+			defer w.Done()
+			err := s.Shutdown(ctx)
+			if err != nil {
+				common.Log.Error("server not shut down", "error", err)
+			}
+		}(s)
+	}
+	w.Wait()
+	common.Shutdown(ctx)
+	common.Log.Info("shutdown complete")
+}
+
+// verifyEvidence outputs the report for the evidence bundle in the file and
+// returns the exit code. 0 if the bundle is valid, 1 if it is not, and 2 if
+// the files can't be read. The optional keys file is a JSON object of creator
+// domains to the public keys the user trusts for them.
+func verifyEvidence(file string, keys []string) int {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	t := make(map[string]string)
+	if len(keys) > 0 {
+		k, err := ioutil.ReadFile(keys[0])
+		if err != nil {
+			fmt.Println(err)
+			return 2
+		}
+		err = json.Unmarshal(k, &t)
+		if err != nil {
+			fmt.Printf("keys file '%s': %s\n", keys[0], err)
+			return 2
+		}
+	}
+	r, err := cmp.VerifyEvidence(b, func(d string) string { return t[d] })
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	j, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	fmt.Println(string(j))
+	if r.Valid == false {
+		return 1
+	}
+	return 0
+}
+
+// validate outputs the problems with the settings and the domains in the www
+// folder and returns the exit code. 0 if there are no problems, 1 if there
+// are, and 2 if the checks can't be carried out.
+func validate(args []string) int {
+	s, err := common.LoadSettings(args)
+	if err != nil {
+		return settingsExitCode(err)
+	}
+	p, err := demo.Validate(s, "www")
 	if err != nil {
-		log.Println(err)
+		fmt.Println(err)
+		return 2
 	}
+	for _, v := range p {
+		fmt.Println(v)
+	}
+	if len(p) > 0 {
+		fmt.Printf("%d problems found\n", len(p))
+		return 1
+	}
+	fmt.Println("No problems found")
+	return 0
 }
 
-func (h HTTPSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	var u url.URL
-	u.Scheme = "http"
-	u.Host = r.Host
-	p := httputil.NewSingleHostReverseProxy(&u)
-	p.ServeHTTP(w, r)
+// dump outputs the effective settings with the values of secrets masked and
+// returns the exit code. 0 if the settings could be read, otherwise 2.
+func dump(args []string) int {
+	s, err := common.LoadSettings(args)
+	if err != nil {
+		return settingsExitCode(err)
+	}
+	b, err := s.Dump()
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	fmt.Println(string(b))
+	return 0
+}
+
+// settingsExitCode outputs the error from loading the settings and returns the
+// exit code. 0 if the flags for the settings were requested with -h,
+// otherwise 2.
+func settingsExitCode(err error) int {
+	if err == flag.ErrHelp {
+		return 0
+	}
+	fmt.Println(err)
+	return 2
 }
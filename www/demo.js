@@ -20,11 +20,21 @@ stop = function(s, d, r, a) {
     });
 }
 
+// Returns the OWIDs provided to the info page as form parameters so that the
+// CMP can include the full path from the root to the party in the evidence.
+complaintPath = function() {
+    var p = "";
+    new URLSearchParams(window.location.search).getAll("owid").forEach(v => {
+        p += "&owid=" + encodeURIComponent(v);
+    });
+    return p;
+}
+
 appendComplaintEmail = function(e, d, o, s, g) {
     loadOWID().then(() => {
         fetch((d ? "//" + d : "") + "/complain?" +
             "swanid=" + encodeURIComponent(o) + "&" +
-            "partyid=" + encodeURIComponent(s),
+            "partyid=" + encodeURIComponent(s) + complaintPath(),
             { method: "GET", mode: "cors", cache: "no-cache" })
             .then(r => r.text() )
             .then(m => {
@@ -45,6 +55,38 @@ appendComplaintEmail = function(e, d, o, s, g) {
     });
 }
 
+// c is the CSRF token from the page that must be posted with the complaint.
+appendComplaintSubmit = function(e, d, o, s, c, t) {
+    var b = document.createElement("button");
+    b.className = "btn btn-sm btn-outline-secondary ml-2";
+    b.innerText = t ? t : "Submit";
+    b.onclick = function() {
+        b.disabled = true;
+        fetch((d ? "//" + d : "") + "/complain",
+            { 
+                method: "POST", 
+                mode: "cors", 
+                cache: "no-cache",
+                body: new URLSearchParams("swanid=" + encodeURIComponent(o) + 
+                    "&partyid=" + encodeURIComponent(s) + 
+                    "&csrf=" + encodeURIComponent(c) +
+                    "&submit=on" + complaintPath())
+            })
+            .then(r => {
+                if (!r.ok) {
+                    throw r.status;
+                }
+                return r.text();
+            })
+            .then(u => { window.location.href = u; })
+            .catch(x => {
+                console.log(x);
+                b.disabled = false;
+            });
+    };
+    e.appendChild(b);
+}
+
 appendName = function(e, s) {
     loadOWID().then(() => {
         var supplier = new owid(s);